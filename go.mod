@@ -1,6 +1,6 @@
 module github.com/ssetin/PenguinCast
 
-go 1.13
+go 1.21
 
 require (
 	github.com/eyedeekay/i2pkeys v0.0.0-20220310055120-b97558c06ac8
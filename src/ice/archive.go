@@ -0,0 +1,663 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Archive: rolling disk archive of the mount for time-shift listening. The broadcast is written
+// to segments of Archive.Segment minutes, every source session starts a new segment.
+// A segment is the audio, its index (time and offset of every page), StreamTitle changes and
+// the content type of the stream, Ogg segments also keep the stream headers. Segments older than Archive.Hours are removed.
+// Listener requests /mount?start=-3600 (seconds back), unix time or RFC 3339 time and gets
+// the archive at real-time pace with its titles. GET /mount/live?id= (id is sent in X-Timeshift-Id
+// header) switches the listener to the live stream at the frame boundary
+
+const (
+	cArchiveHours   = 24
+	cArchiveSegment = 10
+	cArchiveQueue   = 120
+	// gaps of the archive (the mount was off) are not waited for
+	cArchiveMaxGap     = 5 * time.Second
+	cArchiveTimeLayout = "20060102-150405.000"
+	cTimeshiftIDHeader = "X-Timeshift-Id"
+)
+
+// archive - archive settings of the mount
+type archive struct {
+	Path string `yaml:"Path"`
+	// how long the archive is kept
+	Hours int `yaml:"Hours,omitempty"`
+	// minutes
+	Segment int `yaml:"Segment,omitempty"`
+}
+
+// archivePage - page of the broadcast or the title change (session start) for the archive writer
+type archivePage struct {
+	time    time.Time
+	data    []byte
+	title   string
+	isTitle bool
+	session bool
+}
+
+// archiver - writes the archive of the mount and finds the segments for time-shift listeners
+type archiver struct {
+	mount *mount
+	conf  *archive
+	dir   string
+	pages chan archivePage
+	quit  chan struct{}
+	done  chan struct{}
+
+	dropped int64
+
+	// state of the writer goroutine
+	audio, index, titles *os.File
+	segStart             time.Time
+	size                 int64
+	title                string
+	newSession           bool
+}
+
+// archiveSegment - segment of the archive, named by its start time
+type archiveSegment struct {
+	base  string
+	start time.Time
+}
+
+type archiveEntry struct {
+	time   time.Time
+	offset int64
+}
+
+type archiveTitle struct {
+	time  time.Time
+	title string
+}
+
+// initArchive - start the archive writer of the mount
+func (m *mount) initArchive() error {
+	if m.Archive == nil {
+		return nil
+	}
+	if m.Archive.Path == "" {
+		return errors.New("mount " + m.Name + ": archive path is not set")
+	}
+	dir := filepath.Join(m.Archive.Path, m.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	m.archiver = &archiver{
+		mount: m,
+		conf:  m.Archive,
+		dir:   dir,
+		pages: make(chan archivePage, cArchiveQueue),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go m.archiver.run()
+	return nil
+}
+
+func (a *archiver) hours() time.Duration {
+	if a.conf.Hours > 0 {
+		return time.Duration(a.conf.Hours) * time.Hour
+	}
+	return cArchiveHours * time.Hour
+}
+
+func (a *archiver) segmentDuration() time.Duration {
+	if a.conf.Segment > 0 {
+		return time.Duration(a.conf.Segment) * time.Minute
+	}
+	return cArchiveSegment * time.Minute
+}
+
+// send - queue the page, the mount is never blocked
+func (a *archiver) send(p archivePage) {
+	if a == nil {
+		return
+	}
+	select {
+	case <-a.quit:
+		return
+	default:
+	}
+	select {
+	case a.pages <- p:
+	default:
+		if atomic.AddInt64(&a.dropped, 1) == 1 {
+			a.mount.logger.Warning("Archive of mount %s: the disk is too slow, pages are dropped", a.mount.Name)
+		}
+	}
+}
+
+func (a *archiver) write(page []byte) {
+	if a != nil && len(page) > 0 {
+		a.send(archivePage{time: time.Now(), data: append([]byte(nil), page...)})
+	}
+}
+
+func (a *archiver) setTitle(title string) {
+	a.send(archivePage{time: time.Now(), title: title, isTitle: true})
+}
+
+// session - the source takes the mount, the next page starts a new segment
+func (a *archiver) session() {
+	a.send(archivePage{time: time.Now(), session: true})
+}
+
+func (a *archiver) Close() {
+	if a == nil {
+		return
+	}
+	close(a.quit)
+	<-a.done
+}
+
+func (a *archiver) run() {
+	defer close(a.done)
+	defer a.closeSegment()
+	a.cleanup()
+	for {
+		select {
+		case <-a.quit:
+			return
+		case p := <-a.pages:
+			a.handle(p)
+		}
+	}
+}
+
+func (a *archiver) handle(p archivePage) {
+	switch {
+	case p.session:
+		a.closeSegment()
+		a.newSession = true
+	case p.isTitle:
+		a.title = p.title
+		if a.titles != nil {
+			a.writeTitle(p.time)
+		}
+	default:
+		if a.audio != nil && p.time.Sub(a.segStart) >= a.segmentDuration() {
+			a.closeSegment()
+			a.cleanup()
+		}
+		if a.audio == nil {
+			if err := a.openSegment(p); err != nil {
+				a.mount.logger.Error("Archive of mount %s: %s", a.mount.Name, err.Error())
+				return
+			}
+		}
+		if err := a.writePage(p); err != nil {
+			a.mount.logger.Error("Archive of mount %s: %s", a.mount.Name, err.Error())
+			a.closeSegment()
+		}
+	}
+}
+
+// openSegment - new segment starts with the current title, Ogg stream headers of the session are kept
+func (a *archiver) openSegment(p archivePage) error {
+	base := filepath.Join(a.dir, p.time.UTC().Format(cArchiveTimeLayout))
+	var err error
+	if a.newSession && codecByContentType(a.mount.getContentType()) == codecOgg {
+		if head := oggHeaderPages(p.data); len(head) > 0 {
+			err = ioutil.WriteFile(base+".head", head, 0666)
+		}
+	} else if prev := a.lastHead(); prev != "" {
+		err = copyFile(prev, base+".head")
+	}
+	a.newSession = false
+	if err != nil {
+		return err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if a.audio, err = os.OpenFile(base+".audio", flags, 0666); err != nil {
+		return err
+	}
+	// the archive is played after the restart, when the mount has no stream yet
+	if contentType := a.mount.getContentType(); contentType > "" {
+		_ = ioutil.WriteFile(base+".type", []byte(contentType), 0666)
+	}
+	a.index, _ = os.OpenFile(base+".idx", flags, 0666)
+	a.titles, _ = os.OpenFile(base+".titles", flags, 0666)
+	if a.index == nil || a.titles == nil {
+		a.closeSegment()
+		return errors.New("segment " + base + " is not created")
+	}
+	a.segStart = p.time
+	a.size = 0
+	a.writeTitle(p.time)
+	return nil
+}
+
+// lastHead - stream headers of the current Ogg session, they are kept by the segments of the session
+func (a *archiver) lastHead() string {
+	if codecByContentType(a.mount.getContentType()) != codecOgg {
+		return ""
+	}
+	segments := a.segments()
+	if len(segments) == 0 {
+		return ""
+	}
+	name := segments[len(segments)-1].base + ".head"
+	if _, err := os.Stat(name); err != nil {
+		return ""
+	}
+	return name
+}
+
+func (a *archiver) writePage(p archivePage) error {
+	entry := make([]byte, 16)
+	binary.LittleEndian.PutUint64(entry, uint64(p.time.UnixNano()))
+	binary.LittleEndian.PutUint64(entry[8:], uint64(a.size))
+	n, err := a.audio.Write(p.data)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	_, err = a.index.Write(entry)
+	return err
+}
+
+func (a *archiver) writeTitle(t time.Time) {
+	_, _ = a.titles.WriteString(strconv.FormatInt(t.UnixNano(), 10) + "\t" + strings.ReplaceAll(a.title, "\n", " ") + "\n")
+}
+
+func (a *archiver) closeSegment() {
+	for _, f := range []*os.File{a.audio, a.index, a.titles} {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+	a.audio, a.index, a.titles = nil, nil, nil
+}
+
+// cleanup - remove segments, which are older than the archive
+func (a *archiver) cleanup() {
+	segments := a.segments()
+	for idx, s := range segments {
+		// the segment ends, when the next one starts
+		if idx+1 >= len(segments) || time.Since(segments[idx+1].start) < a.hours() {
+			break
+		}
+		for _, ext := range []string{".audio", ".idx", ".titles", ".head", ".type"} {
+			_ = os.Remove(s.base + ext)
+		}
+	}
+}
+
+// segments - segments of the archive from the oldest one
+func (a *archiver) segments() []archiveSegment {
+	names, _ := filepath.Glob(filepath.Join(a.dir, "*.idx"))
+	var segments []archiveSegment
+	for _, name := range names {
+		base := strings.TrimSuffix(name, ".idx")
+		start, err := time.Parse(cArchiveTimeLayout, filepath.Base(base))
+		if err == nil {
+			segments = append(segments, archiveSegment{base: base, start: start})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].start.Before(segments[j].start)
+	})
+	return segments
+}
+
+// segmentAt - the segment of time t, the oldest one for earlier times. False, if the archive is empty
+func (a *archiver) segmentAt(t time.Time) (archiveSegment, bool) {
+	segments := a.segments()
+	if len(segments) == 0 {
+		return archiveSegment{}, false
+	}
+	s := segments[0]
+	for _, seg := range segments {
+		if seg.start.After(t) {
+			break
+		}
+		s = seg
+	}
+	return s, true
+}
+
+// segmentContentType - content type of the segment stream, the mount one for segments without it
+func (m *mount) segmentContentType(s archiveSegment) string {
+	if data, err := ioutil.ReadFile(s.base + ".type"); err == nil && len(data) > 0 {
+		return string(data)
+	}
+	return m.getContentType()
+}
+
+func readArchiveIndex(base string) []archiveEntry {
+	data, _ := ioutil.ReadFile(base + ".idx")
+	entries := make([]archiveEntry, 0, len(data)/16)
+	for pos := 0; pos+16 <= len(data); pos += 16 {
+		entries = append(entries, archiveEntry{
+			time:   time.Unix(0, int64(binary.LittleEndian.Uint64(data[pos:]))),
+			offset: int64(binary.LittleEndian.Uint64(data[pos+8:])),
+		})
+	}
+	return entries
+}
+
+func readArchiveTitles(base string) []archiveTitle {
+	f, err := os.Open(base + ".titles")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var titles []archiveTitle
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if n, err := strconv.ParseInt(parts[0], 10, 64); err == nil {
+			titles = append(titles, archiveTitle{time: time.Unix(0, n), title: parts[1]})
+		}
+	}
+	return titles
+}
+
+func copyFile(from, to string) error {
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, data, 0666)
+}
+
+// archiveCursor - reads the archive page by page, from segment to segment
+type archiveCursor struct {
+	archiver *archiver
+	segment  archiveSegment
+	entries  []archiveEntry
+	titles   []archiveTitle
+	file     *os.File
+	idx      int
+	title    string
+}
+
+// open - start reading the segment from the page of time t
+func (c *archiveCursor) open(s archiveSegment, t time.Time) error {
+	c.close()
+	file, err := os.Open(s.base + ".audio")
+	if err != nil {
+		return err
+	}
+	c.file = file
+	c.segment = s
+	c.entries = readArchiveIndex(s.base)
+	c.titles = readArchiveTitles(s.base)
+	c.idx = sort.Search(len(c.entries), func(i int) bool {
+		return c.entries[i].time.After(t)
+	}) - 1
+	if c.idx < 0 {
+		c.idx = 0
+	}
+	return nil
+}
+
+func (c *archiveCursor) close() {
+	if c.file != nil {
+		_ = c.file.Close()
+		c.file = nil
+	}
+}
+
+// next - the next page, its time and title. Nil page is returned, when the end of the archive is reached
+func (c *archiveCursor) next() ([]byte, time.Time, error) {
+	for {
+		var end int64
+		if c.idx+1 >= len(c.entries) {
+			finished := c.nextSegment() != nil
+			// the segment could grow before the next one is started
+			c.entries = readArchiveIndex(c.segment.base)
+			switch {
+			case c.idx+1 < len(c.entries):
+			case c.idx < len(c.entries) && finished:
+				info, err := c.file.Stat()
+				if err != nil {
+					return nil, time.Time{}, err
+				}
+				end = info.Size()
+			case finished:
+				if err := c.open(*c.nextSegment(), time.Time{}); err != nil {
+					return nil, time.Time{}, err
+				}
+				continue
+			default:
+				return nil, time.Time{}, nil
+			}
+		}
+		e := c.entries[c.idx]
+		if end == 0 {
+			end = c.entries[c.idx+1].offset
+		}
+		c.idx++
+		page := make([]byte, end-e.offset)
+		if _, err := c.file.ReadAt(page, e.offset); err != nil && err != io.EOF {
+			return nil, time.Time{}, err
+		}
+		for len(c.titles) > 0 && !c.titles[0].time.After(e.time) {
+			c.title = c.titles[0].title
+			c.titles = c.titles[1:]
+		}
+		return page, e.time, nil
+	}
+}
+
+// nextSegment - the segment after the current one, nil if it's the latest
+func (c *archiveCursor) nextSegment() *archiveSegment {
+	for _, s := range c.archiver.segments() {
+		if s.start.After(c.segment.start) {
+			return &s
+		}
+	}
+	return nil
+}
+
+// timeshift - the listener of the archive
+type timeshift struct {
+	id    int64
+	start time.Time
+	live  chan struct{}
+	once  sync.Once
+}
+
+// jump - switch the listener to the live stream
+func (ts *timeshift) jump() {
+	ts.once.Do(func() { close(ts.live) })
+}
+
+// timeshiftStart - time requested by the listener: seconds back, unix time or RFC 3339 time.
+// Zero time means the live stream
+func (m *mount) timeshiftStart(r *http.Request) (time.Time, error) {
+	param := r.URL.Query().Get("start")
+	if m.archiver == nil || param == "" || param == "live" {
+		return time.Time{}, nil
+	}
+	var start time.Time
+	if n, err := strconv.ParseInt(param, 10, 64); err == nil {
+		if n <= 0 {
+			start = time.Now().Add(time.Duration(n) * time.Second)
+		} else {
+			start = time.Unix(n, 0)
+		}
+	} else if start, err = time.Parse(time.RFC3339, param); err != nil {
+		return start, errors.New("wrong start time " + param)
+	}
+	if time.Since(start) < time.Second {
+		return time.Time{}, nil
+	}
+	return start, nil
+}
+
+// newTimeshift - register the listener, so it could be switched to live. The id is the only
+// credential of /mount/live, so it's random and not predictable
+func (m *mount) newTimeshift(start time.Time) (*timeshift, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	ts := &timeshift{id: int64(binary.BigEndian.Uint64(id) >> 1), start: start, live: make(chan struct{})}
+	m.mux.Lock()
+	if m.timeshifts == nil {
+		m.timeshifts = make(map[int64]*timeshift)
+	}
+	m.timeshifts[ts.id] = ts
+	m.mux.Unlock()
+	return ts, nil
+}
+
+func (m *mount) removeTimeshift(ts *timeshift) {
+	m.mux.Lock()
+	delete(m.timeshifts, ts.id)
+	m.mux.Unlock()
+}
+
+// timeshiftHeaders - response headers of the time-shift listener
+type timeshiftHeaders struct {
+	streamWriter
+	ts *timeshift
+}
+
+func (w *timeshiftHeaders) writeHeaders(h http.Header) error {
+	h.Set(cTimeshiftIDHeader, strconv.FormatInt(w.ts.id, 10))
+	h.Set("X-Timeshift-Start", w.ts.start.UTC().Format(time.RFC3339))
+	return w.streamWriter.writeHeaders(h)
+}
+
+// playArchive - send the archive by whole frames at real-time pace, until the listener jumps to live
+// or the archive is over. Returns the number of bytes sent
+func (m *mount) playArchive(ts *timeshift, out streamWriter, audio io.Writer, icy *icyWriter) (int, error) {
+	s, ok := m.archiver.segmentAt(ts.start)
+	if !ok {
+		return 0, nil
+	}
+	cursor := &archiveCursor{archiver: m.archiver}
+	defer cursor.close()
+	if err := cursor.open(s, ts.start); err != nil {
+		return 0, err
+	}
+	m.logger.Debug("readMount %s from the archive %s", m.Name, ts.start.String())
+
+	var splitter *frameSplitter
+	// pages of the unknown format (segments of earlier versions after the restart) are sent as they are
+	if c := codecByContentType(m.segmentContentType(s)); m.PCM == nil && c != codecUnknown {
+		splitter = newFrameSplitter(c)
+		if c == codecOgg {
+			head, _ := ioutil.ReadFile(s.base + ".head")
+			_, _ = splitter.Write(head)
+		}
+	}
+	if icy != nil {
+		liveMeta := icy.meta
+		icy.meta = func() ([]byte, int) {
+			meta := icyMetaBlock("StreamTitle='" + cursor.title + "';")
+			return meta, len(meta)
+		}
+		defer func() { icy.meta = liveMeta }()
+	}
+
+	writeTimeOut := time.Second * time.Duration(m.Server.Options.Limits.WriteTimeOut)
+	idleTimeOut := time.Duration(m.Server.Options.Limits.EmptyBufferIdleTimeOut) * time.Second
+	sent := 0
+	var clock time.Duration
+	var prev time.Time
+	wallStart := time.Now()
+	for atomic.LoadInt32(&m.Server.Started) == 1 {
+		page, t, err := cursor.next()
+		if err != nil {
+			return sent, err
+		}
+		if page == nil {
+			// the live edge is reached
+			if time.Since(wallStart)-clock > idleTimeOut {
+				return sent, nil
+			}
+			select {
+			case <-ts.live:
+				return sent, nil
+			case <-time.After(250 * time.Millisecond):
+			}
+			continue
+		}
+
+		// real-time pace, the burst goes at once and gaps are skipped
+		if dt := t.Sub(prev); !prev.IsZero() && dt > 0 && dt < cArchiveMaxGap {
+			clock += dt
+		} else if !prev.IsZero() {
+			clock += time.Second
+		}
+		prev = t
+		if sent < m.BurstSize {
+			wallStart = time.Now().Add(-clock)
+		} else if wait := clock - time.Since(wallStart); wait > 0 {
+			select {
+			case <-ts.live:
+				return sent, nil
+			case <-time.After(wait):
+			}
+		}
+		select {
+		case <-ts.live:
+			return sent, nil
+		default:
+		}
+
+		if splitter != nil {
+			_, _ = splitter.Write(page)
+			page = page[:0]
+			for frame, _ := splitter.Next(); frame != nil; frame, _ = splitter.Next() {
+				page = append(page, frame...)
+			}
+		}
+		_ = out.SetWriteDeadline(time.Now().Add(writeTimeOut))
+		n, err := audio.Write(page)
+		if err == nil {
+			err = out.Flush()
+		}
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+/*
+	liveHandler
+	/mount/live?id=N: switch the time-shift listener to the live stream
+*/
+func (m *mount) liveHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	m.mux.Lock()
+	ts := m.timeshifts[id]
+	m.mux.Unlock()
+	if ts == nil {
+		http.Error(w, "Unknown time-shift listener", http.StatusNotFound)
+		return
+	}
+	ts.jump()
+	w.WriteHeader(http.StatusNoContent)
+}
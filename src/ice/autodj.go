@@ -0,0 +1,664 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf16"
+)
+
+// Auto-DJ: the mount is fed from MP3, AAC (ADTS) or Ogg files of the directory or .m3u playlist.
+// Files are paced in real time by frame durations, StreamTitle is taken from ID3 or Vorbis comments.
+// The mount is taken, when there is no other source, all files should be of the same format
+
+const (
+	cAutoDJRescanInterval = 60
+	cAutoDJReadSize       = 64 * 1024
+	cAutoDJTagsSize       = 256 * 1024
+	// duration of the buffer page
+	cAutoDJPageDuration = time.Second
+)
+
+// autoDJ - playlist source of the mount
+type autoDJ struct {
+	Path           string `yaml:"Path"`
+	Shuffle        bool   `yaml:"Shuffle,omitempty"`
+	RescanInterval int    `yaml:"RescanInterval,omitempty"`
+
+	pacer
+	source int64
+
+	files     []string
+	order     []int
+	pos       int
+	current   string
+	signature uint64
+	scanned   time.Time
+	codec     codec
+}
+
+// pacer - collects frames into buffer pages and appends them in real time, while write returns true
+type pacer struct {
+	mount *mount
+	done  chan struct{}
+	write func(page []byte) bool
+
+	// the next page is appended at clock + sent
+	clock     time.Time
+	sent      time.Duration
+	page      []byte
+	pageDur   time.Duration
+	bytesSent int
+}
+
+func (d *autoDJ) init(m *mount) error {
+	if d.Path == "" {
+		return errors.New("AutoDJ of mount " + m.Name + " has no Path")
+	}
+	if _, err := os.Stat(d.Path); err != nil {
+		return err
+	}
+	d.pacer = pacer{mount: m, done: make(chan struct{}), write: d.writeSource}
+	return nil
+}
+
+// writeSource - append the page, while auto-DJ owns the mount
+func (d *autoDJ) writeSource(page []byte) bool {
+	if !d.mount.isSource(d.source) {
+		return false
+	}
+	d.mount.appendBuffer(page)
+	return true
+}
+
+// Close - stop playing
+func (d *autoDJ) Close() {
+	if d.done != nil {
+		close(d.done)
+	}
+}
+
+func codecByExtension(name string) codec {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3":
+		return codecMP3
+	case ".aac", ".adts":
+		return codecAAC
+	case ".ogg", ".oga", ".opus":
+		return codecOgg
+	}
+	return codecUnknown
+}
+
+func (c codec) contentType() string {
+	switch c {
+	case codecMP3:
+		return "audio/mpeg"
+	case codecAAC:
+		return "audio/aac"
+	case codecOgg:
+		return "audio/ogg"
+	}
+	return ""
+}
+
+// scan - list of the files and signature of the source, which is changed with any file
+func (d *autoDJ) scan() ([]string, uint64, error) {
+	var files []string
+	h := fnv.New64a()
+	addSignature := func(path string, info os.FileInfo) {
+		fmt.Fprintf(h, "%s|%d|%d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+
+	info, err := os.Stat(d.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !info.IsDir() {
+		// playlist: paths are relative to its directory
+		addSignature(d.Path, info)
+		f, err := os.Open(d.Path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(filepath.Dir(d.Path), line)
+			}
+			if codecByExtension(line) != codecUnknown {
+				files = append(files, line)
+			}
+		}
+		return files, h.Sum64(), scanner.Err()
+	}
+
+	err = filepath.Walk(d.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if codecByExtension(path) != codecUnknown {
+			files = append(files, path)
+			addSignature(path, info)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, h.Sum64(), err
+}
+
+func (d *autoDJ) rescanInterval() time.Duration {
+	if d.RescanInterval <= 0 {
+		return cAutoDJRescanInterval * time.Second
+	}
+	return time.Duration(d.RescanInterval) * time.Second
+}
+
+// rescan - reload the list, if the directory or playlist is changed
+func (d *autoDJ) rescan() {
+	if d.files != nil && time.Since(d.scanned) < d.rescanInterval() {
+		return
+	}
+	d.scanned = time.Now()
+	files, signature, err := d.scan()
+	if err != nil {
+		d.mount.logger.Error("AutoDJ %s: %s", d.Path, err.Error())
+	}
+	if d.files != nil && signature == d.signature {
+		return
+	}
+	if d.files != nil {
+		d.mount.logger.Info("AutoDJ %s: playlist is changed, %d files", d.Path, len(files))
+	}
+	// the format is taken from the first file of the new list
+	d.files, d.signature, d.codec = files, signature, codecUnknown
+	d.reorder()
+}
+
+// reorder - play order of the list, sequential order continues after the current file
+func (d *autoDJ) reorder() {
+	d.order = make([]int, len(d.files))
+	for idx := range d.order {
+		d.order[idx] = idx
+	}
+	d.pos = 0
+	if d.Shuffle {
+		rand.Shuffle(len(d.order), func(i, j int) { d.order[i], d.order[j] = d.order[j], d.order[i] })
+		// do not repeat the current file
+		if len(d.order) > 1 && d.files[d.order[0]] == d.current {
+			d.order[0], d.order[len(d.order)-1] = d.order[len(d.order)-1], d.order[0]
+		}
+		return
+	}
+	for idx, name := range d.files {
+		if name == d.current {
+			d.pos = idx + 1
+		}
+	}
+}
+
+// next - the next file to play
+func (d *autoDJ) next() string {
+	d.rescan()
+	if len(d.files) == 0 {
+		return ""
+	}
+	if d.pos >= len(d.order) {
+		d.reorder()
+		d.pos = 0
+	}
+	d.current = d.files[d.order[d.pos]]
+	d.pos++
+	return d.current
+}
+
+// acquire - wait until the mount is free and take it
+func (d *autoDJ) acquire() bool {
+	m := d.mount
+	for {
+		if atomic.LoadInt32(&m.Server.Started) == 1 {
+			m.mux.Lock()
+			id, err := m.claimSource(sourceAutoDJ)
+			m.mux.Unlock()
+			if err == nil {
+				d.source = id
+				return true
+			}
+		}
+		select {
+		case <-d.done:
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// run - play files while the mount is free
+func (d *autoDJ) run() {
+	m := d.mount
+	for d.acquire() {
+		start := time.Now()
+		m.Server.incSources()
+		m.logger.Info("writeMount %s (AutoDJ %s)", m.Name, d.Path)
+
+		d.serve()
+		m.closeConn(true, &d.bytesSent, start, "-", "SOURCE /"+m.Name+" AutoDJ", "-", "-")
+		if !m.isSource(d.source) {
+			// replaced by the live source, the mount is taken back when it's free
+			continue
+		}
+		m.releaseSource(d.source)
+
+		// there is nothing to play, wait for the changes
+		select {
+		case <-d.done:
+			return
+		case <-time.After(d.rescanInterval()):
+		}
+	}
+}
+
+// serve - play files until the source is stopped, replaced or there is nothing to play
+func (d *autoDJ) serve() {
+	m := d.mount
+	d.reset()
+	failures := 0
+	for {
+		name := d.next()
+		if name == "" {
+			m.logger.Error("AutoDJ %s: no files to play", d.Path)
+			return
+		}
+		err := d.play(name)
+		if err == errAutoDJStopped {
+			return
+		}
+		if err != nil {
+			m.logger.Error("AutoDJ %s: %s", name, err.Error())
+			// all files are broken
+			if failures++; failures >= len(d.files) {
+				return
+			}
+			continue
+		}
+		failures = 0
+	}
+}
+
+var errAutoDJStopped = errors.New("AutoDJ is stopped")
+
+// play - send the file to the mount buffer frame by frame
+func (d *autoDJ) play(name string) error {
+	c := codecByExtension(name)
+	if d.codec == codecUnknown {
+		d.codec = c
+	}
+	if c != d.codec {
+		return errors.New("format differs from " + d.codec.String())
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, cAutoDJTagsSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	head = head[:n]
+	title, skip := fileTags(c, head)
+	end := int64(-1)
+	if c != codecOgg {
+		if info, err := f.Stat(); err == nil && info.Size() > 128 {
+			tail := make([]byte, 128)
+			if _, err = f.ReadAt(tail, info.Size()-128); err == nil && bytes.HasPrefix(tail, []byte("TAG")) {
+				end = info.Size() - 128
+				if title == "" {
+					title = id3v1Title(tail)
+				}
+			}
+		}
+	}
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	}
+
+	m := d.mount
+	m.mux.Lock()
+	m.ContentType = c.contentType()
+	m.mux.Unlock()
+	m.setStreamTitle(title)
+	m.logger.Info("AutoDJ %s: playing %s", m.Name, name)
+
+	if _, err = f.Seek(int64(skip), io.SeekStart); err != nil {
+		return err
+	}
+	var reader io.Reader = f
+	if end > 0 {
+		reader = io.LimitReader(f, end-int64(skip))
+	}
+
+	frames, err := d.send(c, reader)
+	if err != nil {
+		return err
+	}
+	if frames == 0 {
+		return errors.New("no audio frames")
+	}
+	return nil
+}
+
+// reset - start pacing from now
+func (p *pacer) reset() {
+	p.clock, p.sent, p.bytesSent = time.Time{}, 0, 0
+	p.page, p.pageDur = p.page[:0], 0
+}
+
+// send - read the stream by frames and add them, errAutoDJStopped is returned, when the pacer is stopped
+func (p *pacer) send(c codec, reader io.Reader) (int, error) {
+	splitter := newFrameSplitter(c)
+	ogg := &oggDuration{}
+	chunk := make([]byte, cAutoDJReadSize)
+	frames := 0
+	for {
+		n, err := reader.Read(chunk)
+		_, _ = splitter.Write(chunk[:n])
+		for {
+			frame, af := splitter.Next()
+			if frame == nil {
+				break
+			}
+			dur := af.Duration()
+			if c == codecOgg {
+				dur = ogg.page(frame)
+			}
+			if !p.add(frame, dur) {
+				return frames, errAutoDJStopped
+			}
+			frames++
+		}
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+	}
+}
+
+// add - collect frames into the page and append it, when its time has come.
+// Pages are cut at frame boundaries, the frame which doesn't fit starts the next page
+func (p *pacer) add(frame []byte, dur time.Duration) bool {
+	maxPage := p.mount.BitRate * 1024 / 8
+	if len(p.page) > 0 && len(p.page)+len(frame) > maxPage {
+		if !p.flush(p.page, p.pageDur) {
+			return false
+		}
+		p.page, p.pageDur = p.page[:0], 0
+	}
+	p.page = append(p.page, frame...)
+	p.pageDur += dur
+
+	if p.pageDur >= cAutoDJPageDuration || len(p.page) >= maxPage {
+		if !p.flush(p.page, p.pageDur) {
+			return false
+		}
+		p.page, p.pageDur = p.page[:0], 0
+	}
+	return true
+}
+
+func (p *pacer) flush(page []byte, dur time.Duration) bool {
+	now := time.Now()
+	if p.clock.IsZero() {
+		p.clock = now
+	}
+	if wait := p.clock.Add(p.sent).Sub(now); wait > 0 {
+		select {
+		case <-p.done:
+			return false
+		case <-time.After(wait):
+		}
+	}
+	if atomic.LoadInt32(&p.mount.Server.Started) == 0 || !p.write(page) {
+		return false
+	}
+	p.bytesSent += len(page)
+	p.sent += dur
+	return true
+}
+
+// oggDuration - duration of ogg pages by granule positions of the logical stream
+type oggDuration struct {
+	demuxer oggDemuxer
+	rate    int
+	granule int64
+}
+
+func (o *oggDuration) page(page []byte) time.Duration {
+	packets, bos := o.demuxer.Packets(page)
+	if bos {
+		o.rate, o.granule = 0, 0
+		if len(packets) > 0 {
+			switch p := packets[0]; {
+			case bytes.HasPrefix(p, []byte("OpusHead")):
+				o.rate = 48000
+			case bytes.HasPrefix(p, []byte("\x01vorbis")) && len(p) >= 16:
+				o.rate = int(binary.LittleEndian.Uint32(p[12:]))
+			}
+		}
+	}
+	granule := int64(binary.LittleEndian.Uint64(page[6:]))
+	if o.rate == 0 || granule < 0 || granule <= o.granule {
+		return 0
+	}
+	dur := time.Duration(granule-o.granule) * time.Second / time.Duration(o.rate)
+	o.granule = granule
+	return dur
+}
+
+//***************************************
+
+// fileTags - title from the tags at the beginning of the file and the size of ID3v2 tag to skip
+func fileTags(c codec, head []byte) (string, int) {
+	if c == codecOgg {
+		var demuxer oggDemuxer
+		for len(head) > 0 {
+			f, ok := parseOggPage(head)
+			if !ok || f.Size <= 0 || f.Size > len(head) {
+				break
+			}
+			packets, _ := demuxer.Packets(head[:f.Size])
+			for _, p := range packets {
+				if bytes.HasPrefix(p, []byte("OpusTags")) {
+					return vorbisCommentTitle(p[8:]), 0
+				}
+				if bytes.HasPrefix(p, []byte("\x03vorbis")) {
+					return vorbisCommentTitle(p[7:]), 0
+				}
+			}
+			head = head[f.Size:]
+		}
+		return "", 0
+	}
+	return id3v2Title(head)
+}
+
+func joinTitle(artist, title string) string {
+	artist, title = strings.TrimSpace(artist), strings.TrimSpace(title)
+	if artist > "" && title > "" {
+		return artist + " - " + title
+	}
+	return title
+}
+
+// id3v2Title - "artist - title" of ID3v2.2-2.4 tag and the tag size
+func id3v2Title(b []byte) (string, int) {
+	if len(b) < 10 || string(b[:3]) != "ID3" {
+		return "", 0
+	}
+	version := b[3]
+	flags := b[5]
+	size := 10 + syncSafe(b[6:10])
+	if flags&0x10 != 0 {
+		// footer
+		size += 10
+	}
+	if size < len(b) {
+		b = b[:size]
+	}
+
+	pos := 10
+	if flags&0x40 != 0 && len(b) >= 14 {
+		// extended header
+		if version == 4 {
+			pos += syncSafe(b[10:14])
+		} else {
+			pos += 4 + int(binary.BigEndian.Uint32(b[10:14]))
+		}
+	}
+
+	var artist, title string
+	for {
+		var id string
+		var frameSize, headerSize int
+		if version == 2 {
+			if pos+6 > len(b) {
+				break
+			}
+			id, frameSize, headerSize = string(b[pos:pos+3]), int(b[pos+3])<<16|int(b[pos+4])<<8|int(b[pos+5]), 6
+		} else {
+			if pos+10 > len(b) {
+				break
+			}
+			id, headerSize = string(b[pos:pos+4]), 10
+			if version == 4 {
+				frameSize = syncSafe(b[pos+4 : pos+8])
+			} else {
+				frameSize = int(binary.BigEndian.Uint32(b[pos+4:]))
+			}
+		}
+		if id[0] == 0 || frameSize <= 0 || pos+headerSize+frameSize > len(b) {
+			break
+		}
+		data := b[pos+headerSize : pos+headerSize+frameSize]
+		switch id {
+		case "TIT2", "TT2":
+			title = id3Text(data)
+		case "TPE1", "TP1":
+			artist = id3Text(data)
+		}
+		pos += headerSize + frameSize
+	}
+	return joinTitle(artist, title), size
+}
+
+func syncSafe(b []byte) int {
+	return int(b[0]&0x7F)<<21 | int(b[1]&0x7F)<<14 | int(b[2]&0x7F)<<7 | int(b[3]&0x7F)
+}
+
+// id3Text - text frame value: encoding byte and the string
+func id3Text(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	text := data[1:]
+	switch data[0] {
+	case 1, 2:
+		bigEndian := data[0] == 2
+		if len(text) >= 2 && (text[0] == 0xFE && text[1] == 0xFF || text[0] == 0xFF && text[1] == 0xFE) {
+			bigEndian = text[0] == 0xFE
+			text = text[2:]
+		}
+		units := make([]uint16, 0, len(text)/2)
+		for idx := 0; idx+1 < len(text); idx += 2 {
+			var u uint16
+			if bigEndian {
+				u = binary.BigEndian.Uint16(text[idx:])
+			} else {
+				u = binary.LittleEndian.Uint16(text[idx:])
+			}
+			if u == 0 {
+				break
+			}
+			units = append(units, u)
+		}
+		return string(utf16.Decode(units))
+	case 3:
+		return strings.TrimRight(string(text), "\x00")
+	}
+	// ISO-8859-1
+	runes := make([]rune, 0, len(text))
+	for _, c := range text {
+		if c == 0 {
+			break
+		}
+		runes = append(runes, rune(c))
+	}
+	return string(runes)
+}
+
+// id3v1Title - 128 bytes tag at the end of the file
+func id3v1Title(tag []byte) string {
+	field := func(b []byte) string {
+		return strings.TrimSpace(strings.TrimRight(string(b), "\x00"))
+	}
+	return joinTitle(field(tag[33:63]), field(tag[3:33]))
+}
+
+// vorbisCommentTitle - TITLE and ARTIST of Vorbis comment (OpusTags) packet without the signature
+func vorbisCommentTitle(p []byte) string {
+	if len(p) < 4 {
+		return ""
+	}
+	vendorLen := int(binary.LittleEndian.Uint32(p))
+	if len(p) < 8+vendorLen {
+		return ""
+	}
+	count := int(binary.LittleEndian.Uint32(p[4+vendorLen:]))
+	pos := 8 + vendorLen
+
+	var artist, title string
+	for idx := 0; idx < count && pos+4 <= len(p); idx++ {
+		l := int(binary.LittleEndian.Uint32(p[pos:]))
+		pos += 4
+		if l < 0 || pos+l > len(p) {
+			break
+		}
+		comment := string(p[pos : pos+l])
+		pos += l
+		eq := strings.Index(comment, "=")
+		if eq < 0 {
+			continue
+		}
+		switch strings.ToUpper(comment[:eq]) {
+		case "TITLE":
+			title = comment[eq+1:]
+		case "ARTIST":
+			artist = comment[eq+1:]
+		}
+	}
+	return joinTitle(artist, title)
+}
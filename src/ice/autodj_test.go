@@ -0,0 +1,55 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestPacerAdd - pages are cut at frame boundaries and carry the duration of their frames
+func TestPacerAdd(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []int
+		pages  []int
+		// frames of the appended pages
+		sent int
+	}{
+		{"frames fit the page", []int{300, 300, 300}, nil, 0},
+		{"frame doesn't fit", []int{400, 400, 400, 400, 400}, []int{800, 800}, 4},
+		{"full page", []int{512, 512, 100}, []int{1024}, 2},
+		{"frame bigger than the page", []int{100, 2000, 100}, []int{100, 2000}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{Started: 1}
+			var pages []int
+			p := &pacer{
+				mount: &mount{Server: srv, BitRate: 8},
+				done:  make(chan struct{}),
+				write: func(page []byte) bool {
+					pages = append(pages, len(page))
+					return true
+				},
+			}
+			for _, size := range tt.frames {
+				if !p.add(make([]byte, size), time.Millisecond) {
+					t.Fatal("pacer is stopped")
+				}
+			}
+			if !reflect.DeepEqual(pages, tt.pages) {
+				t.Errorf("pages %v, want %v", pages, tt.pages)
+			}
+			flushed := 0
+			for _, size := range pages {
+				flushed += size
+			}
+			if sent := time.Duration(tt.sent) * time.Millisecond; p.sent != sent || p.bytesSent != flushed {
+				t.Errorf("sent %v and %d bytes, want %v and %d bytes", p.sent, p.bytesSent, sent, flushed)
+			}
+		})
+	}
+}
@@ -6,12 +6,14 @@ package ice
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 //BufElement - kind of buffer page
 type bufElement struct {
 	locked int32
 	len    int
+	pos    int64
 	buffer []byte
 	next   *bufElement
 	prev   *bufElement
@@ -26,6 +28,7 @@ type bufferQueue struct {
 	minBufferSize int
 	first, last   *bufElement
 	pool          *sync.Pool
+	written       int64
 }
 
 // BufferInfo - struct for monitoring
@@ -116,6 +119,13 @@ func (q *bufferQueue) Size() int {
 	return q.size
 }
 
+// Written - stream position of the next page
+func (q *bufferQueue) Written() int64 {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.written
+}
+
 // Info - returns buffer state
 func (q *bufferQueue) Info() bufferInfo {
 	var result bufferInfo
@@ -228,6 +238,10 @@ func (q *bufferQueue) Append(buffer []byte, read int) {
 	q.mux.Lock()
 	defer q.mux.Unlock()
 
+	// absolute position of the page in the stream
+	t.pos = q.written
+	q.written += int64(read)
+
 	if q.size == 0 {
 		q.size = 1
 		t.next = nil
@@ -244,3 +258,90 @@ func (q *bufferQueue) Append(buffer []byte, read int) {
 	q.last = t
 	q.size++
 }
+
+//***************************************
+
+// bufferCursor - position of the internal consumer (segmenter, relay, recorder) in the buffer queue.
+// Current page is kept locked, so it will not be truncated
+type bufferCursor struct {
+	queue *bufferQueue
+	pack  *bufElement
+	start *bufElement
+}
+
+// NewCursor - returns cursor, which starts from the live edge of the queue
+func (q *bufferQueue) NewCursor() *bufferCursor {
+	return &bufferCursor{queue: q}
+}
+
+// NewBurstCursor - returns cursor, which starts burstSize bytes before the live edge
+func (q *bufferQueue) NewBurstCursor(burstSize int) *bufferCursor {
+	t := q.Start(burstSize)
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	return q.cursorFrom(t)
+}
+
+// NewCursorAt - returns cursor, which starts from the page containing stream position pos
+// and offset of the position in the page. Returns nil, if the position is out of the buffer
+func (q *bufferQueue) NewCursorAt(pos int64) (*bufferCursor, int) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for t := q.first; t != nil; t = t.next {
+		if pos >= t.pos && pos < t.pos+int64(t.len) {
+			return q.cursorFrom(t), int(pos - t.pos)
+		}
+	}
+	return nil, 0
+}
+
+// cursorFrom - should be called under queue lock, so the page can't be truncated before it's locked
+func (q *bufferQueue) cursorFrom(t *bufElement) *bufferCursor {
+	c := &bufferCursor{queue: q}
+	if t != nil {
+		t.Lock()
+		c.start = t
+	}
+	return c
+}
+
+// Next - returns the next page, waiting for it not longer than timeout. Returns nil if there is no new data
+func (c *bufferCursor) Next(timeout time.Duration) *bufElement {
+	if c.start != nil {
+		c.pack, c.start = c.start, nil
+		return c.pack
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var next *bufElement
+		if c.pack == nil {
+			next = c.queue.Last()
+		} else {
+			next = c.pack.Next()
+		}
+		if next != nil {
+			next.Lock()
+			if c.pack != nil {
+				c.pack.UnLock()
+			}
+			c.pack = next
+			return next
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+// Close - release current page
+func (c *bufferCursor) Close() {
+	if c.start != nil {
+		c.start.UnLock()
+		c.start = nil
+	}
+	if c.pack != nil {
+		c.pack.UnLock()
+		c.pack = nil
+	}
+}
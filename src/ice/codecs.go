@@ -2,3 +2,638 @@
 // Licensed under the Apache License, Version 2.0 (the "License")
 
 package ice
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+type codec int
+
+const (
+	codecUnknown codec = iota
+	codecMP3
+	codecAAC
+	codecOgg
+)
+
+// audioFrame - parsed header of the compressed audio frame (or ogg page)
+type audioFrame struct {
+	Size       int
+	Samples    int
+	SampleRate int
+	Channels   int
+	BitRate    int
+}
+
+// Duration - playing time of the frame
+func (f audioFrame) Duration() time.Duration {
+	if f.SampleRate == 0 {
+		return 0
+	}
+	return time.Duration(f.Samples) * time.Second / time.Duration(f.SampleRate)
+}
+
+func codecByContentType(contentType string) codec {
+	contentType = strings.ToLower(contentType)
+	if idx := strings.Index(contentType, ";"); idx >= 0 {
+		contentType = contentType[:idx]
+	}
+	switch strings.TrimSpace(contentType) {
+	case "audio/mpeg", "audio/mp3", "audio/mpeg3", "audio/x-mpeg":
+		return codecMP3
+	case "audio/aac", "audio/aacp", "audio/x-aac", "audio/x-aacp":
+		return codecAAC
+	case "audio/ogg", "application/ogg", "audio/opus", "audio/x-ogg":
+		return codecOgg
+	}
+	return codecUnknown
+}
+
+func (c codec) String() string {
+	switch c {
+	case codecMP3:
+		return "mp3"
+	case codecAAC:
+		return "aac"
+	case codecOgg:
+		return "ogg"
+	}
+	return "unknown"
+}
+
+// parseFrame - parse frame header at the beginning of b
+func (c codec) parseFrame(b []byte) (audioFrame, bool) {
+	switch c {
+	case codecMP3:
+		return parseMP3Frame(b)
+	case codecAAC:
+		return parseADTSFrame(b)
+	case codecOgg:
+		return parseOggPage(b)
+	}
+	return audioFrame{}, false
+}
+
+var (
+	mp3BitRates = [5][16]int{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0}, // MPEG1 layer I
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},    // MPEG1 layer II
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},     // MPEG1 layer III
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},    // MPEG2 layer I
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},         // MPEG2 layer II, III
+	}
+	mp3SampleRates = [4][3]int{
+		{11025, 12000, 8000},  // MPEG2.5
+		{0, 0, 0},             // reserved
+		{22050, 24000, 16000}, // MPEG2
+		{44100, 48000, 32000}, // MPEG1
+	}
+	aacSampleRates = [16]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350, 0, 0, 0}
+)
+
+func parseMP3Frame(b []byte) (audioFrame, bool) {
+	var f audioFrame
+	if len(b) < 4 || b[0] != 0xFF || b[1]&0xE0 != 0xE0 {
+		return f, false
+	}
+	version := (b[1] >> 3) & 3
+	layer := (b[1] >> 1) & 3
+	bitRateIdx := b[2] >> 4
+	sampleRateIdx := (b[2] >> 2) & 3
+	padding := int((b[2] >> 1) & 1)
+	if version == 1 || layer == 0 || bitRateIdx == 0 || bitRateIdx == 15 || sampleRateIdx == 3 {
+		return f, false
+	}
+
+	var table int
+	if version == 3 {
+		table = int(3 - layer)
+	} else if layer == 3 {
+		table = 3
+	} else {
+		table = 4
+	}
+	f.BitRate = mp3BitRates[table][bitRateIdx]
+	f.SampleRate = mp3SampleRates[version][sampleRateIdx]
+	f.Channels = 2
+	if b[3]>>6 == 3 {
+		f.Channels = 1
+	}
+
+	switch {
+	case layer == 3: // layer I
+		f.Samples = 384
+		f.Size = (12*f.BitRate*1000/f.SampleRate + padding) * 4
+	case layer == 1 && version != 3: // layer III, MPEG2 and 2.5
+		f.Samples = 576
+		f.Size = 72*f.BitRate*1000/f.SampleRate + padding
+	default:
+		f.Samples = 1152
+		f.Size = 144*f.BitRate*1000/f.SampleRate + padding
+	}
+	return f, true
+}
+
+// adtsConfig - AudioSpecificConfig and header length of the ADTS frame
+func adtsConfig(b []byte) ([]byte, int) {
+	objectType := b[2]>>6 + 1
+	sampleRateIdx := (b[2] >> 2) & 0x0F
+	channels := (b[2]&1)<<2 | b[3]>>6
+	headerLen := 7
+	if b[1]&1 == 0 {
+		headerLen = 9
+	}
+	return []byte{objectType<<3 | sampleRateIdx>>1, sampleRateIdx<<7 | channels<<3}, headerLen
+}
+
+// adtsHeader - ADTS header without CRC for the raw AAC frame described by AudioSpecificConfig
+func adtsHeader(asc []byte, size int) []byte {
+	objectType := asc[0] >> 3
+	sampleRateIdx := (asc[0]&7)<<1 | asc[1]>>7
+	channels := (asc[1] >> 3) & 0x0F
+	size += 7
+	return []byte{
+		0xFF, 0xF1,
+		(objectType-1)<<6 | sampleRateIdx<<2 | channels>>2,
+		(channels&3)<<6 | byte(size>>11),
+		byte(size >> 3),
+		byte(size&7)<<5 | 0x1F,
+		0xFC,
+	}
+}
+
+func parseADTSFrame(b []byte) (audioFrame, bool) {
+	var f audioFrame
+	if len(b) < 7 || b[0] != 0xFF || b[1]&0xF6 != 0xF0 {
+		return f, false
+	}
+	f.SampleRate = aacSampleRates[(b[2]>>2)&0x0F]
+	f.Channels = int((b[2]&1)<<2 | b[3]>>6)
+	f.Size = int(b[3]&3)<<11 | int(b[4])<<3 | int(b[5]>>5)
+	f.Samples = 1024 * (int(b[6]&3) + 1)
+	if f.SampleRate == 0 || f.Size < 7 {
+		return f, false
+	}
+	f.BitRate = f.Size * 8 * f.SampleRate / f.Samples / 1000
+	return f, true
+}
+
+// silenceFrame - MP3 or AAC frame of digital silence in the format of f (44.1kHz stereo by default).
+// MP3 frame has zero side info and the bitrate of f (the lowest one by default), AAC frame has no spectral
+// data and it's filled up to the size of f
+func silenceFrame(c codec, f audioFrame) ([]byte, audioFrame, bool) {
+	if f.SampleRate == 0 {
+		f.SampleRate = 44100
+	}
+	if f.Channels != 1 {
+		f.Channels = 2
+	}
+	switch c {
+	case codecMP3:
+		for version, rates := range mp3SampleRates {
+			for idx, rate := range rates {
+				if rate != f.SampleRate {
+					continue
+				}
+				// layer III, no CRC, mono or joint stereo
+				header := []byte{0xFF, 0xE0 | byte(version)<<3 | 1<<1 | 1, 0, 0}
+				if f.Channels == 1 {
+					header[3] = 3 << 6
+				}
+				bitRateIdx := byte(1)
+				for i := byte(2); i < 15; i++ {
+					header[2] = i<<4 | byte(idx)<<2
+					if same, ok := parseMP3Frame(header); ok && same.BitRate == f.BitRate {
+						bitRateIdx = i
+					}
+				}
+				header[2] = bitRateIdx<<4 | byte(idx)<<2
+				silence, _ := parseMP3Frame(header)
+				frame := make([]byte, silence.Size)
+				copy(frame, header)
+				return frame, silence, true
+			}
+		}
+	case codecAAC:
+		for idx, rate := range aacSampleRates {
+			if rate != f.SampleRate || rate == 0 {
+				continue
+			}
+			// SCE or CPE without common window, global gain, long window, max_sfb=0, END
+			var w bitWriter
+			w.write(uint(f.Channels-1), 3)
+			w.write(0, 4)
+			if f.Channels == 2 {
+				w.write(0, 1)
+			}
+			for ch := 0; ch < f.Channels; ch++ {
+				w.write(160, 8)
+				w.write(0, 11+3)
+			}
+			if f.Size > 7 {
+				aacFill(&w, (f.Size-7)*8-int(w.bits)-3)
+			}
+			w.write(7, 3)
+			raw := w.bytes()
+			// AAC LC
+			asc := []byte{2<<3 | byte(idx)>>1, byte(idx)<<7 | byte(f.Channels)<<3}
+			frame := append(adtsHeader(asc, len(raw)), raw...)
+			silence, _ := parseADTSFrame(frame)
+			return frame, silence, true
+		}
+	}
+	return nil, audioFrame{}, false
+}
+
+// aacFill - FIL elements of up to avail bits, so the frame keeps the size of the stream frames
+func aacFill(w *bitWriter, avail int) {
+	for avail >= 7+8 {
+		cnt := (avail - 7) / 8
+		if cnt >= 15 {
+			if cnt = (avail - 15) / 8; cnt > 15+255-1 {
+				cnt = 15 + 255 - 1
+			}
+		}
+		w.write(6, 3)
+		if cnt < 15 {
+			w.write(uint(cnt), 4)
+			avail -= 7
+		} else {
+			w.write(15, 4)
+			w.write(uint(cnt-14), 8)
+			avail -= 15
+		}
+		// EXT_FILL with fill nibble, then fill bytes
+		w.write(0, 8)
+		for i := 1; i < cnt; i++ {
+			w.write(0xA5, 8)
+		}
+		avail -= cnt * 8
+	}
+}
+
+// bitWriter - MSB first bit stream
+type bitWriter struct {
+	buf  []byte
+	bits uint
+}
+
+func (w *bitWriter) write(value uint, n uint) {
+	for n > 0 {
+		n--
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if value>>n&1 != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> (w.bits % 8)
+		}
+		w.bits++
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+// parseOggPage - Ogg page size, samples are not known without the logical stream state
+func parseOggPage(b []byte) (audioFrame, bool) {
+	var f audioFrame
+	if len(b) < 27 || string(b[:4]) != "OggS" || b[4] != 0 {
+		return f, false
+	}
+	segments := int(b[26])
+	if len(b) < 27+segments {
+		// size is unknown yet, but page is recognized
+		f.Size = -1
+		return f, true
+	}
+	f.Size = 27 + segments
+	for _, s := range b[27 : 27+segments] {
+		f.Size += int(s)
+	}
+	return f, true
+}
+
+// oggDemuxer - collects packets of the logical stream from ogg pages
+type oggDemuxer struct {
+	partial []byte
+}
+
+// Packets - complete packets of the page. Beginning of the stream resets the state
+func (d *oggDemuxer) Packets(page []byte) (packets [][]byte, bos bool) {
+	segments := int(page[26])
+	lacing := page[27 : 27+segments]
+	data := page[27+segments:]
+	bos = page[5]&0x02 != 0
+	if page[5]&0x01 == 0 || bos {
+		d.partial = d.partial[:0]
+	}
+	pos := 0
+	for _, l := range lacing {
+		d.partial = append(d.partial, data[pos:pos+int(l)]...)
+		pos += int(l)
+		if l < 255 {
+			packets = append(packets, d.partial)
+			d.partial = nil
+		}
+	}
+	return packets, bos
+}
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04C11DB7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return
+}()
+
+func oggCRC(b []byte) uint32 {
+	var crc uint32
+	for _, v := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^v]
+	}
+	return crc
+}
+
+// oggMuxer - builds pages of the single logical stream
+type oggMuxer struct {
+	serial uint32
+	seq    uint32
+}
+
+// Page - page with complete packets, granule is the position after the last packet
+func (o *oggMuxer) Page(packets [][]byte, granule int64, flags byte) []byte {
+	var lacing []byte
+	size := 0
+	for _, p := range packets {
+		for l := len(p); ; l -= 255 {
+			if l < 255 {
+				lacing = append(lacing, byte(l))
+				break
+			}
+			lacing = append(lacing, 255)
+		}
+		size += len(p)
+	}
+
+	page := make([]byte, 27, 27+len(lacing)+size)
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.seq)
+	page[26] = byte(len(lacing))
+	page = append(page, lacing...)
+	for _, p := range packets {
+		page = append(page, p...)
+	}
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	o.seq++
+	return page
+}
+
+// opusTags - minimal OpusTags header packet
+func opusTags(vendor string) []byte {
+	b := make([]byte, 8+4+len(vendor)+4)
+	copy(b, "OpusTags")
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(vendor)))
+	copy(b[12:], vendor)
+	return b
+}
+
+// opusHead - parsed OpusHead identification header
+type opusHead struct {
+	Channels   int
+	PreSkip    uint16
+	SampleRate uint32
+	Gain       int16
+	Family     byte
+	Mapping    []byte
+}
+
+func parseOpusHead(p []byte) (opusHead, bool) {
+	var h opusHead
+	if len(p) < 19 || string(p[:8]) != "OpusHead" {
+		return h, false
+	}
+	h.Channels = int(p[9])
+	h.PreSkip = binary.LittleEndian.Uint16(p[10:])
+	h.SampleRate = binary.LittleEndian.Uint32(p[12:])
+	h.Gain = int16(binary.LittleEndian.Uint16(p[16:]))
+	h.Family = p[18]
+	if h.Family != 0 && len(p) >= 21+h.Channels {
+		h.Mapping = p[19 : 21+h.Channels]
+	}
+	return h, true
+}
+
+// opusPacketSamples - duration of the opus packet at 48 kHz
+func opusPacketSamples(p []byte) int {
+	if len(p) == 0 {
+		return 0
+	}
+	config := p[0] >> 3
+	var frame int
+	switch {
+	case config < 12:
+		frame = []int{480, 960, 1920, 2880}[config&3]
+	case config < 16:
+		frame = []int{480, 960}[config&1]
+	default:
+		frame = []int{120, 240, 480, 960}[config&3]
+	}
+	switch p[0] & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return frame * 2
+	}
+	if len(p) < 2 {
+		return 0
+	}
+	return frame * int(p[1]&0x3F)
+}
+
+// frameSplitter - collects stream data and returns it by whole frames
+type frameSplitter struct {
+	codec codec
+	buf   []byte
+	// bytes dropped from the buffer: frames and garbage
+	consumed int64
+}
+
+func newFrameSplitter(c codec) *frameSplitter {
+	return &frameSplitter{codec: c}
+}
+
+// Write - append stream data
+func (s *frameSplitter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+// Next - returns next complete frame or nil, when more data is needed.
+// Garbage between frames is skipped
+func (s *frameSplitter) Next() ([]byte, audioFrame) {
+	for {
+		pos := s.sync()
+		if pos < 0 {
+			// keep possible beginning of the header
+			if len(s.buf) > 3 {
+				s.consumed += int64(len(s.buf) - 3)
+				s.buf = append(s.buf[:0], s.buf[len(s.buf)-3:]...)
+			}
+			return nil, audioFrame{}
+		}
+		if pos > 0 {
+			s.consumed += int64(pos)
+			s.buf = append(s.buf[:0], s.buf[pos:]...)
+		}
+		f, ok := s.codec.parseFrame(s.buf)
+		if !ok {
+			if len(s.buf) < 27 {
+				return nil, f
+			}
+			s.consumed++
+			s.buf = s.buf[1:]
+			continue
+		}
+		if f.Size < 0 || len(s.buf) < f.Size {
+			return nil, f
+		}
+		frame := make([]byte, f.Size)
+		copy(frame, s.buf)
+		s.buf = s.buf[:copy(s.buf, s.buf[f.Size:])]
+		s.consumed += int64(f.Size)
+		return frame, f
+	}
+}
+
+// sync - position of the possible frame beginning
+func (s *frameSplitter) sync() int {
+	if s.codec == codecOgg {
+		return strings.Index(string(s.buf), "OggS")
+	}
+	for idx := 0; idx+1 < len(s.buf); idx++ {
+		if s.buf[idx] == 0xFF && s.buf[idx+1]&0xE0 == 0xE0 {
+			return idx
+		}
+	}
+	return -1
+}
+
+// frameBoundary - offset of the first frame in b, which is followed by another valid frame
+// or ends exactly at the end of b
+func (c codec) frameBoundary(b []byte) int {
+	for idx := 0; idx+4 < len(b); idx++ {
+		f, ok := c.parseFrame(b[idx:])
+		if !ok || f.Size <= 0 {
+			continue
+		}
+		next := idx + f.Size
+		if next == len(b) {
+			return idx
+		}
+		if next < len(b) {
+			if _, ok := c.parseFrame(b[next:]); ok {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+// frameReader - reads mount buffer by whole frames (pages for ogg streams)
+type frameReader struct {
+	mount    *mount
+	cursor   *bufferCursor
+	splitter *frameSplitter
+	// offset in the first page and stream position of the splitter beginning
+	skip int
+	base int64
+}
+
+func (m *mount) newFrameReader() *frameReader {
+	return m.newFrameReaderFrom(m.buffer.NewCursor(), 0)
+}
+
+// newFrameReaderFrom - reader starting skip bytes after the beginning of the cursor's first page
+func (m *mount) newFrameReaderFrom(cursor *bufferCursor, skip int) *frameReader {
+	return &frameReader{mount: m, cursor: cursor, skip: skip}
+}
+
+// Next - returns the next frame and stream codec. Nil frame is returned, when there was
+// no data during timeout or the stream codec is unknown
+func (r *frameReader) Next(timeout time.Duration) ([]byte, audioFrame, codec) {
+	for {
+		if r.splitter != nil {
+			if frame, f := r.splitter.Next(); frame != nil {
+				return frame, f, r.splitter.codec
+			}
+		}
+		page := r.cursor.Next(timeout)
+		if page == nil {
+			return nil, audioFrame{}, codecUnknown
+		}
+		data := page.buffer
+		if r.skip > 0 && r.skip < len(data) {
+			data = data[r.skip:]
+		}
+		r.skip = 0
+
+		r.mount.mux.Lock()
+		c := codecByContentType(r.mount.ContentType)
+		r.mount.mux.Unlock()
+		if r.splitter == nil || r.splitter.codec != c {
+			r.splitter = newFrameSplitter(c)
+			r.base = page.pos + int64(page.len-len(data))
+		}
+		if c == codecUnknown {
+			return nil, audioFrame{}, c
+		}
+		_, _ = r.splitter.Write(data)
+	}
+}
+
+// Pos - stream position right after the last returned frame
+func (r *frameReader) Pos() int64 {
+	if r.splitter == nil {
+		return r.base
+	}
+	return r.base + r.splitter.consumed
+}
+
+// Close - release mount buffer
+func (r *frameReader) Close() {
+	r.cursor.Close()
+}
+
+// streamFormat - codec of the mount and the frame parameters of the latest buffer page
+func (m *mount) streamFormat() (codec, audioFrame) {
+	m.mux.Lock()
+	c := codecByContentType(m.ContentType)
+	m.mux.Unlock()
+
+	var f audioFrame
+	last := m.buffer.Last()
+	if last == nil || c == codecOgg {
+		return c, f
+	}
+	last.Lock()
+	page := append([]byte(nil), last.buffer...)
+	last.UnLock()
+	if idx := c.frameBoundary(page); idx >= 0 {
+		f, _ = c.parseFrame(page[idx:])
+	}
+	return c, f
+}
@@ -23,15 +23,53 @@ type options struct {
 	Host            string `yaml:"Host"`
 
 	Socket struct {
-		Port int `yaml:"Port"`
+		Port       int    `yaml:"Port,omitempty"`
+		StreamMode string `yaml:"StreamMode,omitempty"`
 	} `yaml:"Socket"`
 
+	Sockets   []*listenSocket    `yaml:"Sockets,omitempty"`
+	ShoutCast []*shoutcastSocket `yaml:"ShoutCast,omitempty"`
+	RTMP      []*rtmpSocket      `yaml:"RTMP,omitempty"`
+
+	TLS struct {
+		Port           int         `yaml:"Port,omitempty"`
+		Certificates   []certFiles `yaml:"Certificates"`
+		ReloadInterval int         `yaml:"ReloadInterval,omitempty"`
+	} `yaml:"TLS,omitempty"`
+
+	HLS struct {
+		Enabled         bool `yaml:"Enabled"`
+		SegmentDuration int  `yaml:"SegmentDuration,omitempty"`
+		Window          int  `yaml:"Window,omitempty"`
+	} `yaml:"HLS,omitempty"`
+
+	DASH struct {
+		Enabled         bool `yaml:"Enabled"`
+		SegmentDuration int  `yaml:"SegmentDuration,omitempty"`
+		Window          int  `yaml:"Window,omitempty"`
+		LowLatency      bool `yaml:"LowLatency,omitempty"`
+		ChunkDuration   int  `yaml:"ChunkDuration,omitempty"`
+	} `yaml:"DASH,omitempty"`
+
+	Emergency struct {
+		Alerts    []*emergencyAlert `yaml:"Alerts,omitempty"`
+		MaxUpload int               `yaml:"MaxUpload,omitempty"`
+	} `yaml:"Emergency,omitempty"`
+
+	Spots struct {
+		Clips       []*spotClip `yaml:"Clips,omitempty"`
+		GeoClasses  []*geoClass `yaml:"GeoClasses,omitempty"`
+		TargetParam string      `yaml:"TargetParam,omitempty"`
+		CuePrefix   string      `yaml:"CuePrefix,omitempty"`
+	} `yaml:"Spots,omitempty"`
+
 	Limits struct {
 		Clients                int32 `yaml:"Clients"`
 		Sources                int32 `yaml:"Sources"`
 		SourceIdleTimeOut      int   `yaml:"SourceIdleTimeOut"`
 		EmptyBufferIdleTimeOut int   `yaml:"EmptyBufferIdleTimeOut"`
 		WriteTimeOut           int   `yaml:"WriteTimeOut"`
+		GracePeriod            int   `yaml:"GracePeriod,omitempty"`
 	} `yaml:"Limits"`
 
 	Auth struct {
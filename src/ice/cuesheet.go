@@ -0,0 +1,155 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Track marks of the recordings: every StreamTitle change starts a new track from the next frame
+// boundary of the recorded audio. Tracks are written to the CUE sheet next to the recording with
+// byte offsets and air time, or every track is recorded to its own file
+
+const (
+	// CUE sheet frames per second
+	cCueFrames = 75
+	// length of the title in the file name
+	cTitleNameMax = 100
+)
+
+// cueTrack - track of the recording
+type cueTrack struct {
+	Title string
+	// file offset of the first frame and its playing time from the beginning of the file
+	Offset int64
+	Time   time.Duration
+}
+
+// trackClock - playing time of the recorded audio, counted by whole frames. The next track
+// is started at the first frame after the title change
+type trackClock struct {
+	codec    codec
+	splitter *frameSplitter
+	ogg      oggDuration
+	// PCM bytes per second and file offset of the samples
+	byteRate int
+	base     int64
+	pos      int64
+	dur      time.Duration
+	next     *cueTrack
+}
+
+func newTrackClock(c codec, pcm *pcmFormat, base int64) *trackClock {
+	t := &trackClock{codec: c, base: base, pos: base}
+	if pcm != nil {
+		t.byteRate = pcm.SampleRate * pcm.blockAlign()
+	} else {
+		t.splitter = newFrameSplitter(c)
+	}
+	return t
+}
+
+// mark - the track starts at the next frame, the previous mark is replaced, if it isn't reached yet
+func (t *trackClock) mark(title string) {
+	t.next = &cueTrack{Title: title}
+}
+
+// add - count the recorded audio, returns the track, which is started in it
+func (t *trackClock) add(data []byte) *cueTrack {
+	var started *cueTrack
+	if t.byteRate > 0 {
+		if t.next != nil && len(data) > 0 {
+			t.next.Offset, t.next.Time = t.pos, t.dur
+			started, t.next = t.next, nil
+		}
+		t.pos += int64(len(data))
+		t.dur = time.Duration(t.pos-t.base) * time.Second / time.Duration(t.byteRate)
+		return started
+	}
+	if t.codec == codecUnknown {
+		return nil
+	}
+	_, _ = t.splitter.Write(data)
+	for {
+		frame, f := t.splitter.Next()
+		if frame == nil {
+			return started
+		}
+		if t.next != nil {
+			t.next.Offset = t.base + t.splitter.consumed - int64(len(frame))
+			t.next.Time = t.dur
+			started, t.next = t.next, nil
+		}
+		if t.codec == codecOgg {
+			t.dur += t.ogg.page(frame)
+		} else {
+			t.dur += f.Duration()
+		}
+	}
+}
+
+// cueSheetName - name of the CUE sheet of the recording
+func cueSheetName(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".cue"
+}
+
+// writeCueSheet - CUE sheet of the recording with its tracks, REM lines keep byte offsets and air time,
+// and the duration of the finished recording
+func writeCueSheet(name, mount string, started time.Time, tracks []*cueTrack, duration time.Duration) error {
+	fileType := "MP3"
+	if strings.EqualFold(filepath.Ext(name), ".wav") {
+		fileType = "WAVE"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "REM DATE %s\r\n", started.Format("2006-01-02"))
+	if duration > 0 {
+		fmt.Fprintf(&b, "REM DURATION %s\r\n", duration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(&b, "TITLE \"%s\"\r\n", cueQuote(mount))
+	fmt.Fprintf(&b, "FILE \"%s\" %s\r\n", cueQuote(filepath.Base(name)), fileType)
+	for idx, t := range tracks {
+		fmt.Fprintf(&b, "  TRACK %02d AUDIO\r\n", idx+1)
+		performer, title := "", t.Title
+		if parts := strings.SplitN(t.Title, " - ", 2); len(parts) == 2 {
+			performer, title = parts[0], parts[1]
+		}
+		if title > "" {
+			fmt.Fprintf(&b, "    TITLE \"%s\"\r\n", cueQuote(title))
+		}
+		if performer > "" {
+			fmt.Fprintf(&b, "    PERFORMER \"%s\"\r\n", cueQuote(performer))
+		}
+		fmt.Fprintf(&b, "    REM OFFSET %d\r\n", t.Offset)
+		fmt.Fprintf(&b, "    REM AIRED %s\r\n", started.Add(t.Time).Format(time.RFC3339))
+		frames := int64(t.Time * cCueFrames / time.Second)
+		fmt.Fprintf(&b, "    INDEX 01 %02d:%02d:%02d\r\n", frames/cCueFrames/60, frames/cCueFrames%60, frames%cCueFrames)
+	}
+	return ioutil.WriteFile(cueSheetName(name), b.Bytes(), 0666)
+}
+
+func cueQuote(s string) string {
+	return strings.NewReplacer("\"", "'", "\r", " ", "\n", " ").Replace(s)
+}
+
+// titleFileName - title as a part of the file name
+func titleFileName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if r := []rune(name); len(r) > cTitleNameMax {
+		name = string(r[:cTitleNameMax])
+	}
+	if name == "" {
+		name = "untitled"
+	}
+	return name
+}
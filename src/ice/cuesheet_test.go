@@ -0,0 +1,70 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCueSheet - tracks, air time and duration of the written CUE sheet are read back
+func TestCueSheet(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "show.mp3")
+	started := time.Date(2020, 3, 10, 10, 0, 0, 0, time.UTC)
+	tracks := []*cueTrack{
+		{Title: "Intro", Offset: 0},
+		{Title: "Artist - Song", Offset: 4096, Time: 62 * time.Second},
+	}
+	tests := []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"recording", 0},
+		{"finished", 3723456 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := writeCueSheet(name, "Rock", started, tracks, tt.duration); err != nil {
+				t.Fatal(err)
+			}
+			read, aired, duration, err := readCueSheet(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !aired.Equal(started) || duration != tt.duration {
+				t.Errorf("started %v, duration %v, want %v, %v", aired, duration, started, tt.duration)
+			}
+			if len(read) != len(tracks) {
+				t.Fatalf("%d tracks, want %d", len(read), len(tracks))
+			}
+			for idx, track := range read {
+				if *track != *tracks[idx] {
+					t.Errorf("track %d: %+v, want %+v", idx, *track, *tracks[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestEstimateDuration(t *testing.T) {
+	tests := []struct {
+		name     string
+		m        *mount
+		size     int64
+		duration time.Duration
+	}{
+		{"bitrate", &mount{BitRate: 128}, 16384 * 60, time.Minute},
+		{"no bitrate", &mount{}, 16384, 0},
+		{"wav", &mount{PCM: &pcmFormat{SampleRate: 44100, Channels: 2, BitDepth: 16}}, 44 + 176400*2, 2 * time.Second},
+		{"wav header only", &mount{PCM: &pcmFormat{SampleRate: 44100, Channels: 2, BitDepth: 16}}, 40, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := tt.m.estimateDuration(tt.size); d != tt.duration {
+				t.Errorf("duration %v, want %v", d, tt.duration)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// MPEG-DASH output: AAC (ADTS) and Opus (Ogg) streams are repackaged into CMAF segments.
+// Segment number n always starts at availabilityStartTime + n*duration, so after a source
+// break numbering jumps forward to the wall clock.
+// In low latency mode segments are made of several chunks and the segment being built
+// is sent to the client chunk by chunk
+
+const (
+	cDASHSegmentDuration = 4
+	cDASHWindow          = 8
+	cDASHChunkDuration   = 500
+	cDASHKeepSegments    = 2
+)
+
+type dashSegment struct {
+	Number   int
+	data     []byte
+	complete bool
+}
+
+type dashSegmenter struct {
+	mount      *mount
+	target     time.Duration
+	chunk      time.Duration
+	window     int
+	lowLatency bool
+
+	mux      sync.Mutex
+	cond     *sync.Cond
+	track    *mp4Track
+	init     []byte
+	start    time.Time
+	segments []*dashSegment
+	closed   bool
+	done     chan struct{}
+
+	// state of the segment being built
+	current      *dashSegment
+	number       int
+	segSamples   uint64
+	chunkSamples uint64
+	decodeTime   uint64
+	segStart     uint64
+	chunkStart   uint64
+	samples      [][]byte
+	durations    []uint32
+	fragmentSeq  uint32
+	resync       bool
+	ogg          oggDemuxer
+}
+
+func newDASHSegmenter(m *mount, duration, window int, lowLatency bool, chunk int) *dashSegmenter {
+	if duration <= 0 {
+		duration = cDASHSegmentDuration
+	}
+	if window <= 0 {
+		window = cDASHWindow
+	}
+	if chunk <= 0 {
+		chunk = cDASHChunkDuration
+	}
+	d := &dashSegmenter{
+		mount:      m,
+		target:     time.Duration(duration) * time.Second,
+		chunk:      time.Duration(chunk) * time.Millisecond,
+		window:     window,
+		lowLatency: lowLatency,
+		done:       make(chan struct{}),
+	}
+	if !lowLatency || d.chunk > d.target {
+		d.chunk = d.target
+	}
+	d.cond = sync.NewCond(&d.mux)
+	return d
+}
+
+func (d *dashSegmenter) Close() {
+	close(d.done)
+	d.mux.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mux.Unlock()
+}
+
+// run - consume mount buffer and cut it to the segments
+func (d *dashSegmenter) run() {
+	reader := d.mount.newFrameReader()
+	defer reader.Close()
+
+	idle := time.Duration(0)
+	for {
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+
+		frame, f, c := reader.Next(time.Second)
+		if frame == nil {
+			// source is gone, finish the segment, next one will be aligned to the wall clock
+			idle += time.Second
+			if idle >= d.target && d.current != nil {
+				d.finishSegment()
+				d.resync = true
+			}
+			continue
+		}
+		idle = 0
+
+		switch c {
+		case codecAAC:
+			asc, headerLen := adtsConfig(frame)
+			if headerLen >= len(frame) {
+				continue
+			}
+			d.setTrack(aacTrack(asc, f))
+			d.addSample(frame[headerLen:], uint32(f.Samples))
+		case codecOgg:
+			packets, _ := d.ogg.Packets(frame)
+			for _, p := range packets {
+				if head, ok := parseOpusHead(p); ok {
+					d.setTrack(opusTrack(head))
+					continue
+				}
+				if d.track == nil || d.track.opus == nil || bytes.HasPrefix(p, []byte("OpusTags")) {
+					continue
+				}
+				d.addSample(p, uint32(opusPacketSamples(p)))
+			}
+		}
+	}
+}
+
+// setTrack - new init segment is published, if stream parameters are changed
+func (d *dashSegmenter) setTrack(t *mp4Track) {
+	if d.track.equal(t) {
+		return
+	}
+	if d.current != nil {
+		d.finishSegment()
+	}
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if t.BitRate == 0 {
+		t.BitRate = d.mount.BitRate * 1000
+	}
+	d.track = t
+	d.init = t.initSegment()
+	d.start = time.Now()
+	d.segments = nil
+	d.number = 0
+	d.segSamples = 0
+}
+
+func (d *dashSegmenter) addSample(sample []byte, duration uint32) {
+	if duration == 0 {
+		return
+	}
+	if d.segSamples == 0 {
+		// segment and chunk duration are rounded to the whole number of frames
+		d.mux.Lock()
+		d.segSamples = roundSamples(d.target, d.track.Timescale, duration)
+		d.chunkSamples = roundSamples(d.chunk, d.track.Timescale, duration)
+		d.mux.Unlock()
+	}
+	if d.current == nil {
+		d.startSegment()
+	}
+
+	d.samples = append(d.samples, sample)
+	d.durations = append(d.durations, duration)
+	d.decodeTime += uint64(duration)
+
+	if d.decodeTime-d.segStart >= d.segSamples {
+		d.finishSegment()
+	} else if d.decodeTime-d.chunkStart >= d.chunkSamples {
+		d.flushChunk(false)
+	}
+}
+
+func roundSamples(duration time.Duration, timescale uint32, frame uint32) uint64 {
+	frames := (uint64(duration)*uint64(timescale)/uint64(time.Second) + uint64(frame) - 1) / uint64(frame)
+	if frames == 0 {
+		frames = 1
+	}
+	return frames * uint64(frame)
+}
+
+func (d *dashSegmenter) segmentDuration() time.Duration {
+	return time.Duration(d.segSamples) * time.Second / time.Duration(d.track.Timescale)
+}
+
+func (d *dashSegmenter) startSegment() {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	// align with the wall clock, if the source was away
+	if d.resync {
+		number := int(time.Since(d.start)/d.segmentDuration()) + 1
+		if number > d.number {
+			d.number = number
+		}
+		d.resync = false
+	}
+	d.segStart = uint64(d.number) * d.segSamples
+	d.decodeTime = d.segStart
+	d.chunkStart = d.segStart
+
+	d.current = &dashSegment{Number: d.number, data: mp4SegmentType()}
+	d.segments = append(d.segments, d.current)
+	d.number++
+}
+
+// flushChunk - write collected samples as CMAF chunk
+func (d *dashSegmenter) flushChunk(last bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if len(d.samples) > 0 {
+		d.fragmentSeq++
+		d.current.data = append(d.current.data, mp4Fragment(d.fragmentSeq, d.chunkStart, d.samples, d.durations)...)
+	}
+	d.samples = d.samples[:0]
+	d.durations = d.durations[:0]
+	d.chunkStart = d.decodeTime
+	if last {
+		d.current.complete = true
+		d.current = nil
+		for len(d.segments) > d.window+cDASHKeepSegments {
+			d.segments = d.segments[1:]
+		}
+	}
+	d.cond.Broadcast()
+}
+
+func (d *dashSegmenter) finishSegment() {
+	d.flushChunk(true)
+}
+
+// segment - returns the segment by number, should be called under lock
+func (d *dashSegmenter) segment(number int) *dashSegment {
+	for _, s := range d.segments {
+		if s.Number == number {
+			return s
+		}
+	}
+	return nil
+}
+
+// mpd - live manifest with number based segment template
+func (d *dashSegmenter) mpd() []byte {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.track == nil || d.segSamples == 0 {
+		return nil
+	}
+	t := d.track
+	segDuration := d.segmentDuration()
+	now := time.Now().UTC()
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	fmt.Fprintf(&b, `<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011,urn:mpeg:dash:profile:cmaf:2019" type="dynamic" availabilityStartTime="%s" publishTime="%s" minimumUpdatePeriod="PT%dS" minBufferTime="PT%.3fS" timeShiftBufferDepth="PT%.3fS" suggestedPresentationDelay="PT%.3fS">`+"\n",
+		d.start.UTC().Format(time.RFC3339Nano), now.Format(time.RFC3339Nano), int(d.target.Seconds()),
+		segDuration.Seconds(), (segDuration * time.Duration(d.window)).Seconds(), (segDuration * 2).Seconds())
+	if d.lowLatency {
+		fmt.Fprintf(&b, `  <ServiceDescription id="0"><Latency referenceId="0" target="%d" min="%d" max="%d"/></ServiceDescription>`+"\n",
+			(segDuration + d.chunk).Milliseconds(), d.chunk.Milliseconds()*2, (segDuration * 3).Milliseconds())
+	}
+	b.WriteString(`  <Period id="0" start="PT0S">` + "\n")
+	fmt.Fprintf(&b, `    <AdaptationSet id="0" contentType="audio" mimeType="audio/mp4" segmentAlignment="true" lang="und">`+"\n")
+	fmt.Fprintf(&b, `      <Representation id="audio" codecs="%s" audioSamplingRate="%d" bandwidth="%d">`+"\n", t.Codecs, t.Timescale, t.BitRate)
+	fmt.Fprintf(&b, `        <AudioChannelConfiguration schemeIdUri="urn:mpeg:dash:23003:3:audio_channel_configuration:2011" value="%d"/>`+"\n", t.Channels)
+	fmt.Fprintf(&b, `        <SegmentTemplate timescale="%d" duration="%d" startNumber="0" initialization="%s/dash/init.mp4" media="%s/dash/$Number$.m4s"`,
+		t.Timescale, d.segSamples, d.mount.Name, d.mount.Name)
+	if d.lowLatency {
+		fmt.Fprintf(&b, ` availabilityTimeOffset="%.3f" availabilityTimeComplete="false"`, (segDuration - d.chunk).Seconds())
+	}
+	b.WriteString("/>\n      </Representation>\n    </AdaptationSet>\n  </Period>\n")
+	fmt.Fprintf(&b, `  <UTCTiming schemeIdUri="urn:mpeg:dash:utc:direct:2014" value="%s"/>`+"\n", now.Format(time.RFC3339Nano))
+	b.WriteString("</MPD>\n")
+	return b.Bytes()
+}
+
+//***************************************
+
+// dashManifestHandler - /{mount}.mpd
+func (m *mount) dashManifestHandler(w http.ResponseWriter, r *http.Request) {
+	mpd := m.dash.mpd()
+	if mpd == nil {
+		http.Error(w, "Stream is not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_, _ = w.Write(mpd)
+}
+
+// dashInitHandler - /{mount}/dash/init.mp4
+func (m *mount) dashInitHandler(w http.ResponseWriter, r *http.Request) {
+	m.dash.mux.Lock()
+	init := m.dash.init
+	m.dash.mux.Unlock()
+	if init == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "audio/mp4")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(init)))
+	_, _ = w.Write(init)
+}
+
+// dashSegmentHandler - /{mount}/dash/{number}.m4s. In low latency mode segment, which is being built,
+// (or is going to be built next) is sent chunk by chunk
+func (m *mount) dashSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	d := m.dash
+	number, err := strconv.Atoi(mux.Vars(r)["number"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	s := d.segment(number)
+	if s == nil && d.lowLatency && number == d.number {
+		// wait for the next segment no longer than its duration
+		deadline := time.Now().Add(d.target)
+		for s == nil && !d.closed && time.Now().Before(deadline) {
+			d.mux.Unlock()
+			time.Sleep(time.Millisecond * 50)
+			d.mux.Lock()
+			s = d.segment(number)
+		}
+	}
+	if s == nil || (!s.complete && !d.lowLatency) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "audio/mp4")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if s.complete {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+		_, _ = w.Write(s.data)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	sent := 0
+	for {
+		for len(s.data) == sent && !s.complete && !d.closed {
+			d.cond.Wait()
+		}
+		data := s.data[sent:]
+		complete := s.complete || d.closed
+		d.mux.Unlock()
+		_, err = w.Write(data)
+		if err == nil {
+			err = rc.Flush()
+		}
+		d.mux.Lock()
+		if err != nil || complete {
+			return
+		}
+		sent += len(data)
+	}
+}
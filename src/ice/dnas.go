@@ -0,0 +1,177 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SHOUTcast DNAS v2 compatible listener URLs and status pages, stream ID (sid) is mapped to the mount
+
+type dnasStats struct {
+	XMLName          xml.Name `xml:"SHOUTCASTSERVER" json:"-"`
+	CurrentListeners int32    `xml:"CURRENTLISTENERS" json:"currentlisteners"`
+	PeakListeners    int32    `xml:"PEAKLISTENERS" json:"peaklisteners"`
+	MaxListeners     int32    `xml:"MAXLISTENERS" json:"maxlisteners"`
+	UniqueListeners  int32    `xml:"UNIQUELISTENERS" json:"uniquelisteners"`
+	AverageTime      int      `xml:"AVERAGETIME" json:"averagetime"`
+	ServerGenre      string   `xml:"SERVERGENRE" json:"servergenre"`
+	ServerURL        string   `xml:"SERVERURL" json:"serverurl"`
+	ServerTitle      string   `xml:"SERVERTITLE" json:"servertitle"`
+	SongTitle        string   `xml:"SONGTITLE" json:"songtitle"`
+	StreamHits       int32    `xml:"STREAMHITS" json:"streamhits"`
+	StreamStatus     int      `xml:"STREAMSTATUS" json:"streamstatus"`
+	BackupStatus     int      `xml:"BACKUPSTATUS" json:"backupstatus"`
+	StreamListed     int      `xml:"STREAMLISTED" json:"streamlisted"`
+	StreamPath       string   `xml:"STREAMPATH" json:"streampath"`
+	StreamUptime     int      `xml:"STREAMUPTIME" json:"streamuptime"`
+	BitRate          int      `xml:"BITRATE" json:"bitrate"`
+	Content          string   `xml:"CONTENT" json:"content"`
+	Version          string   `xml:"VERSION" json:"version"`
+}
+
+type dnasPlayed struct {
+	PlayedAt int64  `xml:"playedat" json:"playedat"`
+	Title    string `xml:"title" json:"title"`
+}
+
+type dnasHistory struct {
+	XMLName xml.Name     `xml:"SHOUTCASTSERVER" json:"-"`
+	Songs   []dnasPlayed `xml:"SONGHISTORY>SONG"`
+}
+
+func (i *Server) configureDNASRouter(r *mux.Router) {
+	configured := false
+	for _, m := range i.Options.Mounts {
+		if m.SID > 0 {
+			r.HandleFunc("/stream/"+strconv.Itoa(m.SID)+"/", m.read).Methods("GET")
+			configured = true
+		}
+	}
+	if !configured {
+		return
+	}
+	r.HandleFunc("/stats", i.dnasStatsHandler).Methods("GET")
+	r.HandleFunc("/7.html", i.dnas7Handler).Methods("GET")
+	r.HandleFunc("/played.html", i.dnasPlayedHandler).Methods("GET")
+	r.HandleFunc("/played", i.dnasPlayedHandler).Methods("GET")
+}
+
+// dnasMount - mount by sid parameter, stream 1 by default
+func (i *Server) dnasMount(w http.ResponseWriter, r *http.Request) *mount {
+	sid := 1
+	if str := r.URL.Query().Get("sid"); str > "" {
+		var err error
+		if sid, err = strconv.Atoi(str); err != nil {
+			http.Error(w, "Bad stream ID", http.StatusBadRequest)
+			return nil
+		}
+	}
+	m := i.findMountBySID(sid)
+	if m == nil {
+		http.NotFound(w, r)
+	}
+	return m
+}
+
+func (m *mount) dnasStats() dnasStats {
+	var st dnasStats
+	st.CurrentListeners = atomic.LoadInt32(&m.State.Listeners)
+	st.PeakListeners = atomic.LoadInt32(&m.State.Peak)
+	st.UniqueListeners = st.CurrentListeners
+	st.StreamHits = atomic.LoadInt32(&m.State.Hits)
+	st.MaxListeners = int32(m.MaxListeners)
+	if st.MaxListeners == 0 {
+		st.MaxListeners = atomic.LoadInt32(&m.Server.Options.Limits.Clients)
+	}
+	st.StreamPath = "/stream/" + strconv.Itoa(m.SID) + "/"
+	st.Version = m.Server.version
+
+	m.mux.Lock()
+	st.ServerGenre = m.Genre
+	st.ServerTitle = m.StreamName
+	if st.ServerTitle == "" {
+		st.ServerTitle = m.Description
+	}
+	st.ServerURL = m.StreamURL
+	st.SongTitle = m.State.MetaInfo.StreamTitle
+	st.BitRate = m.BitRate
+	st.Content = m.ContentType
+	if m.State.Started {
+		st.StreamStatus = 1
+		st.StreamUptime = int(time.Since(m.State.StartedTime).Seconds())
+	}
+	m.mux.Unlock()
+	return st
+}
+
+// dnasStatsHandler - /stats?sid=1[&json=1]
+func (i *Server) dnasStatsHandler(w http.ResponseWriter, r *http.Request) {
+	m := i.dnasMount(w, r)
+	if m == nil {
+		return
+	}
+	st := m.dnasStats()
+	if r.URL.Query().Get("json") == "1" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(st)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	_, _ = w.Write([]byte(xml.Header))
+	_ = xml.NewEncoder(w).Encode(st)
+}
+
+// dnas7Handler - /7.html?sid=1 legacy status line:
+// current listeners, stream status, peak, max, unique listeners, bitrate, song title
+func (i *Server) dnas7Handler(w http.ResponseWriter, r *http.Request) {
+	m := i.dnasMount(w, r)
+	if m == nil {
+		return
+	}
+	st := m.dnasStats()
+	w.Header().Set("Content-Type", "text/html")
+	_, _ = fmt.Fprintf(w, "<html><body>%d,%d,%d,%d,%d,%d,%s</body></html>",
+		st.CurrentListeners, st.StreamStatus, st.PeakListeners, st.MaxListeners, st.UniqueListeners, st.BitRate,
+		template.HTMLEscapeString(st.SongTitle))
+}
+
+// dnasPlayedHandler - /played.html?sid=1 or /played?sid=1&type=json|xml
+func (i *Server) dnasPlayedHandler(w http.ResponseWriter, r *http.Request) {
+	m := i.dnasMount(w, r)
+	if m == nil {
+		return
+	}
+	history := m.getHistory()
+
+	kind := r.URL.Query().Get("type")
+	if kind == "" && r.URL.Path == "/played.html" {
+		kind = "html"
+	}
+	songs := make([]dnasPlayed, 0, len(history))
+	for _, t := range history {
+		songs = append(songs, dnasPlayed{PlayedAt: t.Played.Unix(), Title: t.Title})
+	}
+
+	switch kind {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(songs)
+	case "xml":
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(xml.Header))
+		_ = xml.NewEncoder(w).Encode(dnasHistory{Songs: songs})
+	default:
+		i.renderData(w, r, "templates/played.gohtml", history)
+	}
+}
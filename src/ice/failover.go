@@ -0,0 +1,222 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"time"
+)
+
+// Failover: redundant live sources of the mount. Every source authenticated with the mount credentials
+// (priority 1) or with the credentials of Failover.Sources is kept connected. The highest priority
+// healthy source feeds the buffer, the others are drained as standby. The active source is switched,
+// when it sends no data during Failover.TimeOut seconds, or when the source of higher priority is
+// healthy for the same time. The stream of the new source continues from its frame boundary
+
+const (
+	// seconds without data, after which the source is unhealthy
+	cFailoverTimeOut = 3
+	// priority of the mount credentials and the default one of the backup sources
+	cPrimaryPriority = 1
+	cBackupPriority  = 2
+)
+
+// failover - backup sources of the mount
+type failover struct {
+	TimeOut int             `yaml:"TimeOut,omitempty"`
+	Sources []*backupSource `yaml:"Sources"`
+}
+
+// backupSource - credentials of the backup source, the lower number is the higher priority
+type backupSource struct {
+	User     string `yaml:"User"`
+	Password string `yaml:"Password"`
+	Priority int    `yaml:"Priority,omitempty"`
+}
+
+// liveSource - connected source of the failover mount
+type liveSource struct {
+	priority int
+	// the beginning of the current run of data
+	since    time.Time
+	lastData time.Time
+	// the source is made active by failover, its stream should start from the frame boundary
+	switched bool
+}
+
+// sourceState - what the live source does with the read page
+type sourceState int
+
+const (
+	sourceStopped sourceState = iota
+	sourceActive
+	sourceSwitched
+	sourceStandby
+)
+
+func (f *failover) timeOut() time.Duration {
+	if f.TimeOut > 0 {
+		return time.Duration(f.TimeOut) * time.Second
+	}
+	return cFailoverTimeOut * time.Second
+}
+
+func (s *backupSource) priority() int {
+	if s.Priority > 0 {
+		return s.Priority
+	}
+	return cBackupPriority
+}
+
+// sourcePriority - priority of the source with matching credentials, 0 if there is no one
+func (m *mount) sourcePriority(match func(user, password string) bool) int {
+	if match(m.User, m.Password) {
+		return cPrimaryPriority
+	}
+	if m.Failover != nil {
+		for _, s := range m.Failover.Sources {
+			if match(s.User, s.Password) {
+				return s.priority()
+			}
+		}
+	}
+	return 0
+}
+
+// isActivePriority - metadata updates of the standby sources are ignored, while they are not active
+func (m *mount) isActivePriority(priority int) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	active := m.liveSources[m.source]
+	return active == nil || active.priority == priority
+}
+
+// claimLive - take the mount for the live source of given priority, m.mux should be locked.
+// With failover, the source of lower priority than the active one is kept as standby
+func (m *mount) claimLive(priority int) (int64, error) {
+	if m.Failover == nil {
+		return m.claimSource(sourceLive)
+	}
+	if err := m.sourceAllowed(sourceLive); err != nil {
+		return 0, err
+	}
+	m.sourceSeq++
+	id := m.sourceSeq
+	now := time.Now()
+	if m.liveSources == nil {
+		m.liveSources = make(map[int64]*liveSource)
+	}
+	m.liveSources[id] = &liveSource{priority: priority, since: now, lastData: now}
+	if active := m.liveSources[m.source]; active != nil && !m.sourceIdle && priority >= active.priority {
+		m.logger.Info("Standby source of mount %s, priority %d", m.Name, priority)
+		return id, nil
+	}
+	m.setSource(id, sourceLive)
+	m.liveSources[id].switched = true
+	return id, nil
+}
+
+// checkSource - state of the live source after the read, the failover switch is made here
+func (m *mount) checkSource(id int64, data bool) sourceState {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	s := m.liveSources[id]
+	if s == nil {
+		if m.source == id {
+			return sourceActive
+		}
+		return sourceStopped
+	}
+	now := time.Now()
+	if data {
+		if now.Sub(s.lastData) >= m.Failover.timeOut() {
+			s.since = now
+		}
+		s.lastData = now
+	}
+	m.switchSource(now)
+
+	switch {
+	case m.source != id:
+		return sourceStandby
+	case s.switched && data:
+		s.switched = false
+		return sourceSwitched
+	}
+	return sourceActive
+}
+
+// switchSource - make the best healthy source active, m.mux should be locked.
+// The healthy active source is replaced only by the stable source of higher priority
+func (m *mount) switchSource(now time.Time) {
+	active := m.liveSources[m.source]
+	var best int64
+	for id, s := range m.liveSources {
+		if id == m.source || !m.healthy(s, now) {
+			continue
+		}
+		if active != nil && m.healthy(active, now) &&
+			(s.priority >= active.priority || now.Sub(s.since) < m.Failover.timeOut()) {
+			continue
+		}
+		if best == 0 || s.better(m.liveSources[best]) {
+			best = id
+		}
+	}
+	if best != 0 {
+		m.promote(best)
+	}
+}
+
+// promoteStandby - the active source is lost, the best of the standby sources takes the mount,
+// healthy ones go first. Returns false, if there is no one. m.mux should be locked
+func (m *mount) promoteStandby() bool {
+	now := time.Now()
+	var best int64
+	for id, s := range m.liveSources {
+		if best == 0 {
+			best = id
+			continue
+		}
+		b := m.liveSources[best]
+		if h := m.healthy(s, now); h != m.healthy(b, now) {
+			if h {
+				best = id
+			}
+		} else if s.better(b) {
+			best = id
+		}
+	}
+	if best == 0 {
+		return false
+	}
+	m.promote(best)
+	return true
+}
+
+// healthy - the source has sent data recently
+func (m *mount) healthy(s *liveSource, now time.Time) bool {
+	return now.Sub(s.lastData) < m.Failover.timeOut()
+}
+
+// better - the source of higher priority, or the one which has data for longer time
+func (s *liveSource) better(b *liveSource) bool {
+	return s.priority < b.priority || s.priority == b.priority && s.since.Before(b.since)
+}
+
+// promote - the standby source becomes active, m.mux should be locked
+func (m *mount) promote(id int64) {
+	s := m.liveSources[id]
+	s.switched = true
+	m.source = id
+	m.sourceKind = sourceLive
+	m.sourceIdle = false
+	m.State.Started = true
+	m.logger.Info("Failover of mount %s to the source of priority %d", m.Name, s.priority)
+}
+
+// switchPage - the first page of the switched source: the last frame of the previous source is completed
+// with zeros and the stream goes on from the frame boundary of the new one
+func (m *mount) switchPage(page []byte) []byte {
+	return append(make([]byte, m.partialFrame()), page[m.frameAt(page, 0):]...)
+}
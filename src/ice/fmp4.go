@@ -0,0 +1,205 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// Fragmented MP4 (CMAF) muxer for single audio track: AAC or Opus
+
+// mp4Track - audio track parameters
+type mp4Track struct {
+	Timescale uint32
+	Channels  int
+	Codecs    string
+	BitRate   int
+	// AudioSpecificConfig for AAC
+	asc []byte
+	// OpusHead for Opus
+	opus *opusHead
+}
+
+func aacTrack(asc []byte, f audioFrame) *mp4Track {
+	return &mp4Track{
+		Timescale: uint32(f.SampleRate),
+		Channels:  f.Channels,
+		Codecs:    "mp4a.40." + strconv.Itoa(int(asc[0]>>3)),
+		BitRate:   f.BitRate * 1000,
+		asc:       asc,
+	}
+}
+
+func opusTrack(head opusHead) *mp4Track {
+	return &mp4Track{
+		Timescale: 48000,
+		Channels:  head.Channels,
+		Codecs:    "opus",
+		opus:      &head,
+	}
+}
+
+// equal - tracks are compatible, so the same init segment is valid
+func (t *mp4Track) equal(o *mp4Track) bool {
+	if t == nil || o == nil {
+		return t == o
+	}
+	return t.Timescale == o.Timescale && t.Channels == o.Channels && t.Codecs == o.Codecs &&
+		string(t.asc) == string(o.asc) && (t.opus == nil) == (o.opus == nil)
+}
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, u32(uint32(size))...)
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := u32(flags)
+	header[0] = version
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+var mp4Matrix = []byte{
+	0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+}
+
+// initSegment - ftyp and moov with empty sample tables
+func (t *mp4Track) initSegment() []byte {
+	ftyp := mp4Box("ftyp", []byte("iso6"), u32(0), []byte("iso6cmfcdashmp41"))
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0), // creation, modification, timescale, duration
+		u32(0x00010000), u16(0x0100), make([]byte, 10), // rate, volume, reserved
+		mp4Matrix, make([]byte, 24), u32(2)) // pre_defined, next_track_ID
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(1), u32(0), u32(0), // creation, modification, track_ID, reserved, duration
+		make([]byte, 8), u16(0), u16(0), u16(0x0100), u16(0), // reserved, layer, alternate_group, volume
+		mp4Matrix, u32(0), u32(0)) // width, height
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.Timescale), u32(0), u16(0x55C4), u16(0)) // und
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte("soun"), make([]byte, 12), []byte("SoundHandler\x00"))
+	smhd := mp4FullBox("smhd", 0, 0, u16(0), u16(0))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), t.sampleEntry()),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)))
+	mdia := mp4Box("mdia", mdhd, hdlr, mp4Box("minf", smhd, dinf, stbl))
+	mvex := mp4Box("mvex", mp4FullBox("trex", 0, 0, u32(1), u32(1), u32(0), u32(0), u32(0)))
+
+	return append(ftyp, mp4Box("moov", mvhd, mp4Box("trak", tkhd, mdia), mvex)...)
+}
+
+func (t *mp4Track) sampleEntry() []byte {
+	typ := "mp4a"
+	var config []byte
+	if t.opus != nil {
+		typ = "Opus"
+		config = t.dOps()
+	} else {
+		config = t.esds()
+	}
+	rate := t.Timescale
+	if rate > 0xFFFF {
+		rate = 0
+	}
+	return mp4Box(typ,
+		make([]byte, 6), u16(1), // reserved, data_reference_index
+		make([]byte, 8), u16(uint16(t.Channels)), u16(16), // reserved, channelcount, samplesize
+		u32(0), u32(rate<<16), config)
+}
+
+// esds - MPEG-4 elementary stream descriptor with AudioSpecificConfig
+func (t *mp4Track) esds() []byte {
+	descriptor := func(tag byte, payload ...[]byte) []byte {
+		b := []byte{tag, 0}
+		for _, p := range payload {
+			b = append(b, p...)
+		}
+		b[1] = byte(len(b) - 2)
+		return b
+	}
+	decoderConfig := descriptor(0x04, []byte{0x40, 0x15, 0, 0, 0}, u32(uint32(t.BitRate)), u32(uint32(t.BitRate)),
+		descriptor(0x05, t.asc))
+	es := descriptor(0x03, u16(1), []byte{0}, decoderConfig, descriptor(0x06, []byte{0x02}))
+	return mp4FullBox("esds", 0, 0, es)
+}
+
+// dOps - Opus specific box, fields of OpusHead in big endian
+func (t *mp4Track) dOps() []byte {
+	h := t.opus
+	b := []byte{0, byte(h.Channels)}
+	b = append(b, u16(h.PreSkip)...)
+	b = append(b, u32(h.SampleRate)...)
+	b = append(b, u16(uint16(h.Gain))...)
+	b = append(b, h.Family)
+	b = append(b, h.Mapping...)
+	return mp4Box("dOps", b)
+}
+
+// mp4SegmentType - styp box starting every media segment
+func mp4SegmentType() []byte {
+	return mp4Box("styp", []byte("msdh"), u32(0), []byte("msdhmsixcmfs"))
+}
+
+// mp4Fragment - moof and mdat with the samples, which start at decodeTime
+func mp4Fragment(seq uint32, decodeTime uint64, samples [][]byte, durations []uint32) []byte {
+	size := 0
+	entries := make([]byte, 0, len(samples)*8)
+	for idx, s := range samples {
+		entries = append(entries, u32(durations[idx])...)
+		entries = append(entries, u32(uint32(len(s)))...)
+		size += len(s)
+	}
+
+	moof := func(offset uint32) []byte {
+		return mp4Box("moof",
+			mp4FullBox("mfhd", 0, 0, u32(seq)),
+			mp4Box("traf",
+				mp4FullBox("tfhd", 0, 0x020000, u32(1)), // default-base-is-moof
+				mp4FullBox("tfdt", 1, 0, u64(decodeTime)),
+				mp4FullBox("trun", 0, 0x000301, u32(uint32(len(samples))), u32(offset), entries))) // data-offset, duration, size
+	}
+	b := moof(0)
+	b = moof(uint32(len(b) + 8))
+
+	mdat := make([]byte, 0, size+8)
+	mdat = append(mdat, u32(uint32(size+8))...)
+	mdat = append(mdat, "mdat"...)
+	for _, s := range samples {
+		mdat = append(mdat, s...)
+	}
+	return append(b, mdat...)
+}
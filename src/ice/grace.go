@@ -0,0 +1,132 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Grace period: when the live source is lost, the mount keeps its listeners with silence in the format
+// of the stream. Silence goes while the idle source is detected (Limits.SourceIdleTimeOut) and then
+// for GracePeriod seconds. The reconnected source takes the mount over from the idle one or from
+// the silence, and the stream goes on for the listeners. The mount is released, when the period is over
+
+// silenceFiller - silence of the mount format, the rest of the frame is carried over to the next page
+type silenceFiller struct {
+	frame []byte
+	dur   time.Duration
+	carry time.Duration
+	// completes the last frame of the lost source
+	pad []byte
+}
+
+// gracePeriod - grace period of the mount or the server default
+func (m *mount) gracePeriod() time.Duration {
+	sec := m.GracePeriod
+	if sec == 0 {
+		sec = m.Server.Options.Limits.GracePeriod
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// silence - silent frame (short page for PCM mounts) in the mount format, MP3 when there was no stream yet
+func (m *mount) silence() ([]byte, time.Duration, error) {
+	if m.PCM != nil {
+		return make([]byte, int(cSilencePCMDuration.Seconds()*float64(m.PCM.SampleRate))*m.PCM.blockAlign()),
+			cSilencePCMDuration, nil
+	}
+	c, f := m.streamFormat()
+	if c == codecUnknown {
+		c = codecMP3
+		m.mux.Lock()
+		m.ContentType = c.contentType()
+		m.mux.Unlock()
+	}
+	silence, sf, ok := silenceFrame(c, f)
+	if !ok {
+		return nil, 0, errors.New("no silence for " + c.String() + " stream")
+	}
+	return silence, sf.Duration(), nil
+}
+
+func (m *mount) newSilenceFiller() (*silenceFiller, error) {
+	frame, dur, err := m.silence()
+	if err != nil {
+		return nil, err
+	}
+	return &silenceFiller{frame: frame, dur: dur, pad: make([]byte, m.partialFrame())}, nil
+}
+
+// partialFrame - bytes missing from the last frame of the buffer, the lost source could stop in the middle of it
+func (m *mount) partialFrame() int {
+	c, _ := m.streamFormat()
+	last := m.buffer.Last()
+	if m.PCM != nil || c == codecOgg || last == nil {
+		return 0
+	}
+	last.Lock()
+	defer last.UnLock()
+	page := last.buffer
+	idx := c.frameBoundary(page)
+	if idx < 0 {
+		return 0
+	}
+	for idx < len(page) {
+		f, ok := c.parseFrame(page[idx:])
+		if !ok || f.Size <= 0 {
+			return 0
+		}
+		idx += f.Size
+	}
+	return idx - len(page)
+}
+
+// appendSilence - append d of silence, pages are limited by the bitrate of the mount
+func (m *mount) appendSilence(s *silenceFiller, d time.Duration) {
+	s.carry += d
+	frames := int(s.carry / s.dur)
+	s.carry -= time.Duration(frames) * s.dur
+
+	page := append(s.pad, bytes.Repeat(s.frame, frames)...)
+	s.pad = nil
+	maxPage := m.BitRate * 1024 / 8
+	for len(page) > maxPage {
+		m.appendBuffer(page[:maxPage])
+		page = page[maxPage:]
+	}
+	m.appendBuffer(page)
+}
+
+// setSourceIdle - the source has no stream, it could be replaced by the reconnected one in the grace period
+func (m *mount) setSourceIdle(id int64, idle bool) {
+	m.mux.Lock()
+	if m.source == id {
+		m.sourceIdle = idle
+	}
+	m.mux.Unlock()
+}
+
+// grace - silence after the lost live source, until the source is back or the period is over
+func (m *mount) grace(id int64, period time.Duration) {
+	defer m.releaseSource(id)
+	filler, err := m.newSilenceFiller()
+	if err != nil {
+		m.logger.Warning("No grace period for mount %s: %s", m.Name, err.Error())
+		return
+	}
+	m.logger.Info("Source of mount %s is lost, grace period %s", m.Name, period.String())
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for start := time.Now(); time.Since(start) < period; <-ticker.C {
+		if atomic.LoadInt32(&m.Server.Started) == 0 || !m.isSource(id) {
+			return
+		}
+		m.appendSilence(filler, time.Second)
+	}
+	m.logger.Info("Grace period of mount %s is over", m.Name)
+}
@@ -36,16 +36,19 @@ func (i *Server) updateMonitorHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (i *Server) renderPage(w http.ResponseWriter, r *http.Request, tplName string) {
+	j := i
+	j.Options.Host = r.Host
+	i.renderData(w, r, tplName, j)
+}
+
+func (i *Server) renderData(w http.ResponseWriter, r *http.Request, tplName string, data interface{}) {
 	t, err := template.ParseFiles(tplName)
 	if err != nil {
 		i.logger.Error(err.Error())
 		i.internalHandler(w, r)
 		return
 	}
-	j := i
-	j.Options.Host = r.Host
-	err = t.Execute(w, j)
-	//err = t.Execute(w, i)
+	err = t.Execute(w, data)
 	if err != nil {
 		i.logger.Error(err.Error())
 		i.internalHandler(w, r)
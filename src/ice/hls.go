@@ -0,0 +1,299 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HLS output: mount buffer is cut by frame boundaries into packed audio segments (raw MP3 or ADTS AAC).
+// Every segment starts with ID3 tag containing its timestamp and current StreamTitle,
+// title changes inside of the segment are marked with additional ID3 tags
+
+const (
+	cHLSSegmentDuration = 6
+	cHLSWindow          = 6
+	// segments, which are already out of the playlist, but still may be requested by slow clients
+	cHLSKeepSegments = 2
+	cHLSClock        = 90000
+)
+
+type hlsSegment struct {
+	Seq           int
+	Duration      time.Duration
+	Discontinuity bool
+	data          []byte
+}
+
+type hlsSegmenter struct {
+	mount  *mount
+	target time.Duration
+	window int
+
+	mux              sync.Mutex
+	codec            codec
+	segments         []*hlsSegment
+	discontinuitySeq int
+	done             chan struct{}
+
+	// state of the segment being built
+	current *hlsSegment
+	seq     int
+	pts     uint64
+	title   string
+	// PTS is counted from the samples since the last sample rate change, so it doesn't drift
+	ptsBase uint64
+	samples uint64
+	rate    int
+}
+
+func newHLSSegmenter(m *mount, duration, window int) *hlsSegmenter {
+	if duration <= 0 {
+		duration = cHLSSegmentDuration
+	}
+	if window <= 0 {
+		window = cHLSWindow
+	}
+	return &hlsSegmenter{
+		mount:  m,
+		target: time.Duration(duration) * time.Second,
+		window: window,
+		done:   make(chan struct{}),
+	}
+}
+
+func (h *hlsSegmenter) Close() {
+	close(h.done)
+}
+
+// run - consume mount buffer and cut it to the segments
+func (h *hlsSegmenter) run() {
+	reader := h.mount.newFrameReader()
+	defer reader.Close()
+
+	discontinuity := false
+	idle := time.Duration(0)
+
+	for {
+		select {
+		case <-h.done:
+			return
+		default:
+		}
+
+		frame, f, c := reader.Next(time.Second)
+		if frame == nil {
+			// source is gone, publish what we have and mark the next segment
+			idle += time.Second
+			if idle >= h.target && h.current != nil {
+				h.publish()
+				discontinuity = true
+			}
+			continue
+		}
+		idle = 0
+
+		if c != codecMP3 && c != codecAAC {
+			continue
+		}
+		if c != h.codec {
+			if h.current != nil {
+				h.publish()
+			}
+			discontinuity = discontinuity || h.codec != codecUnknown
+			h.mux.Lock()
+			h.codec = c
+			h.mux.Unlock()
+		}
+
+		h.addFrame(frame, f, discontinuity)
+		discontinuity = false
+	}
+}
+
+func (h *hlsSegmenter) addFrame(frame []byte, f audioFrame, discontinuity bool) {
+	title := h.mount.getStreamTitle()
+
+	if h.current == nil {
+		h.current = &hlsSegment{Seq: h.seq, Discontinuity: discontinuity}
+		h.seq++
+		h.title = title
+		h.current.data = append(h.current.data, id3Tag(h.pts, title)...)
+	} else if title != h.title {
+		h.title = title
+		h.current.data = append(h.current.data, id3Tag(h.pts, title)...)
+	}
+
+	h.current.data = append(h.current.data, frame...)
+	h.current.Duration += f.Duration()
+	if f.SampleRate != h.rate {
+		h.ptsBase, h.samples, h.rate = h.pts, 0, f.SampleRate
+	}
+	if h.rate > 0 {
+		h.samples += uint64(f.Samples)
+		h.pts = h.ptsBase + h.samples*cHLSClock/uint64(h.rate)
+	}
+
+	if h.current.Duration >= h.target {
+		h.publish()
+	}
+}
+
+// publish - add built segment to the playlist and drop ones, which are out of the window
+func (h *hlsSegmenter) publish() {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.segments = append(h.segments, h.current)
+	h.current = nil
+	for len(h.segments) > h.window+cHLSKeepSegments {
+		if h.segments[0].Discontinuity {
+			h.discontinuitySeq++
+		}
+		h.segments = h.segments[1:]
+	}
+}
+
+func (h *hlsSegmenter) extension() string {
+	if h.codec == codecAAC {
+		return "aac"
+	}
+	return "mp3"
+}
+
+// playlist - live media playlist with the last window segments
+func (h *hlsSegmenter) playlist() []byte {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	segments := h.segments
+	if len(segments) > h.window {
+		segments = segments[len(segments)-h.window:]
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+	discontinuitySeq := h.discontinuitySeq
+	for _, s := range h.segments[:len(h.segments)-len(segments)] {
+		if s.Discontinuity {
+			discontinuitySeq++
+		}
+	}
+
+	target := h.target
+	for _, s := range segments {
+		if s.Duration > target {
+			target = s.Duration
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", segments[0].Seq)
+	if discontinuitySeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySeq)
+	}
+	for _, s := range segments {
+		if s.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s/hls/%d.%s\n", s.Duration.Seconds(), h.mount.Name, s.Seq, h.extension())
+	}
+	return b.Bytes()
+}
+
+func (h *hlsSegmenter) segment(seq int) *hlsSegment {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	for _, s := range h.segments {
+		if s.Seq == seq {
+			return s
+		}
+	}
+	return nil
+}
+
+// id3Tag - ID3v2.4 tag with apple transport stream timestamp (PRIV) and title (TIT2)
+func id3Tag(pts uint64, title string) []byte {
+	var frames bytes.Buffer
+
+	priv := make([]byte, 0, 53)
+	priv = append(priv, "com.apple.streaming.transportStreamTimestamp\x00"...)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], pts&0x1FFFFFFFF)
+	priv = append(priv, ts[:]...)
+	writeID3Frame(&frames, "PRIV", priv)
+
+	if title > "" {
+		text := append([]byte{0x03}, title...)
+		writeID3Frame(&frames, "TIT2", append(text, 0))
+	}
+
+	tag := make([]byte, 10, 10+frames.Len())
+	copy(tag, "ID3\x04\x00\x00")
+	putSyncSafe(tag[6:], frames.Len())
+	return append(tag, frames.Bytes()...)
+}
+
+func writeID3Frame(b *bytes.Buffer, id string, data []byte) {
+	var header [10]byte
+	copy(header[:], id)
+	putSyncSafe(header[4:], len(data))
+	b.Write(header[:])
+	b.Write(data)
+}
+
+func putSyncSafe(b []byte, size int) {
+	b[0] = byte(size>>21) & 0x7F
+	b[1] = byte(size>>14) & 0x7F
+	b[2] = byte(size>>7) & 0x7F
+	b[3] = byte(size) & 0x7F
+}
+
+//***************************************
+
+// hlsPlaylistHandler - /{mount}.m3u8
+func (m *mount) hlsPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	playlist := m.hls.playlist()
+	if playlist == nil {
+		http.Error(w, "Stream is not available", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_, _ = w.Write(playlist)
+}
+
+// hlsSegmentHandler - /{mount}/hls/{seq}.{ext}
+func (m *mount) hlsSegmentHandler(w http.ResponseWriter, r *http.Request) {
+	seq, err := strconv.Atoi(mux.Vars(r)["seq"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	s := m.hls.segment(seq)
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if mux.Vars(r)["ext"] == "aac" {
+		w.Header().Set("Content-Type", "audio/aac")
+	} else {
+		w.Header().Set("Content-Type", "audio/mpeg")
+	}
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(m.hls.target.Seconds())*m.hls.window))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+	_, _ = w.Write(s.data)
+}
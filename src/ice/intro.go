@@ -0,0 +1,162 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Intro: station ID or pre-roll, which is sent to every new listener before the live stream.
+// Several files are rotated in order or randomly. The intro is sent by whole frames and the live
+// stream continues from the frame boundary, icy metadata goes through both of them.
+// Files are read once and reloaded, when they are changed (see clipCache)
+
+// introRotation - intro files of the mount
+type introRotation struct {
+	files   []string
+	shuffle bool
+	next    uint32
+}
+
+// initIntro - check intro files of the mount, they should match the mount format
+func (m *mount) initIntro() error {
+	files := m.IntroFiles
+	if m.IntroFile > "" {
+		files = append([]string{m.IntroFile}, files...)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	for _, name := range files {
+		isWAV := strings.EqualFold(name[strings.LastIndex(name, ".")+1:], "wav")
+		switch c := codecByExtension(name); {
+		case m.PCM != nil && !isWAV:
+			return errors.New("mount " + m.Name + ": intro of the PCM mount should be WAV file " + name)
+		case m.PCM == nil && c != codecMP3 && c != codecAAC:
+			return errors.New("mount " + m.Name + ": intro should be MP3 or AAC file " + name)
+		}
+	}
+	m.intros = &introRotation{files: files, shuffle: m.IntroShuffle}
+	return nil
+}
+
+// intro - audio of the next intro for the listener, nil if there is no intro of the mount format
+func (m *mount) intro() []byte {
+	if m.intros == nil {
+		return nil
+	}
+	name := m.intros.pick()
+	if m.PCM == nil {
+		m.mux.Lock()
+		mountCodec := codecByContentType(m.ContentType)
+		m.mux.Unlock()
+		if c := codecByExtension(name); c != mountCodec {
+			m.logger.Warning("Intro %s of mount %s: %s file on %s stream", name, m.Name, c.String(), mountCodec.String())
+			return nil
+		}
+	}
+	f, err := m.clips.load(name)
+	if err != nil {
+		m.logger.Error("Intro of mount %s: %s", m.Name, err.Error())
+		return nil
+	}
+	return f.data
+}
+
+// pick - name of the next intro file
+func (r *introRotation) pick() string {
+	if r.shuffle {
+		return r.files[rand.Intn(len(r.files))]
+	}
+	return r.files[int((atomic.AddUint32(&r.next, 1)-1)%uint32(len(r.files)))]
+}
+
+// wholeFrames - data from the first to the last complete frame
+func (c codec) wholeFrames(b []byte) []byte {
+	start := c.frameBoundary(b)
+	if start < 0 {
+		return nil
+	}
+	end := start
+	for end < len(b) {
+		f, ok := c.parseFrame(b[end:])
+		if !ok || f.Size <= 0 || end+f.Size > len(b) {
+			break
+		}
+		end += f.Size
+	}
+	return b[start:end]
+}
+
+// clipFile - cached audio of the intro or spot
+type clipFile struct {
+	data     []byte
+	duration time.Duration
+	modTime  time.Time
+	size     int64
+}
+
+// clipCache - intro and spot files of the mount, as whole frames of the mount format
+type clipCache struct {
+	mount *mount
+	mux   sync.Mutex
+	files map[string]*clipFile
+}
+
+// load - audio of the file, it's read again only if changed
+func (cc *clipCache) load(name string) (*clipFile, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	cc.mux.Lock()
+	defer cc.mux.Unlock()
+	if f := cc.files[name]; f != nil && f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+		return f, nil
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	f := &clipFile{modTime: info.ModTime(), size: info.Size()}
+	if pcm := cc.mount.PCM; pcm != nil {
+		data = data[wavDataOffset(data):]
+		f.data = data[:len(data)-len(data)%pcm.blockAlign()]
+		f.duration = time.Duration(len(f.data)/pcm.blockAlign()) * time.Second / time.Duration(pcm.SampleRate)
+	} else {
+		c := codecByExtension(name)
+		f.data = c.wholeFrames(audioData(c, data))
+		f.duration = c.framesDuration(f.data)
+	}
+	if len(f.data) == 0 {
+		return nil, errors.New(name + " has no audio")
+	}
+	if cc.files == nil {
+		cc.files = make(map[string]*clipFile)
+	}
+	cc.files[name] = f
+	return f, nil
+}
+
+// framesDuration - playing time of the whole frames
+func (c codec) framesDuration(b []byte) time.Duration {
+	var d time.Duration
+	for pos := 0; pos < len(b); {
+		f, ok := c.parseFrame(b[pos:])
+		if !ok || f.Size <= 0 {
+			break
+		}
+		d += f.Duration()
+		pos += f.Size
+	}
+	return d
+}
@@ -10,6 +10,8 @@ type Logger interface {
 	Warning(format string, v ...interface{})
 
 	Access(format string, v ...interface{})
+	Audit(format string, v ...interface{})
+	Impression(format string, v ...interface{})
 	Stat(format string, v ...interface{})
 	Log(format string, v ...interface{})
 
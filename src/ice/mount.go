@@ -4,7 +4,6 @@
 package ice
 
 import (
-	"bufio"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -14,7 +13,7 @@ import (
 	"math"
 	"net"
 	"net/http"
-	"os"
+	"net/textproto"
 	"regexp"
 	"strconv"
 	"strings"
@@ -33,6 +32,13 @@ type metaData struct {
 	metaSizeByte int
 }
 
+type playedTrack struct {
+	Title  string
+	Played time.Time
+}
+
+const cHistorySize = 20
+
 type mountInfo struct {
 	Name      string
 	Listeners int32
@@ -50,9 +56,26 @@ type mount struct {
 	BurstSize    int    `yaml:"BurstSize"`
 	DumpFile     string `yaml:"DumpFile"`
 	MaxListeners int    `yaml:"MaxListeners"`
+	SID          int    `yaml:"SID,omitempty"`
+
+	IntroFile    string   `yaml:"IntroFile,omitempty"`
+	IntroFiles   []string `yaml:"IntroFiles,omitempty"`
+	IntroShuffle bool     `yaml:"IntroShuffle,omitempty"`
+	GracePeriod  int      `yaml:"GracePeriod,omitempty"`
+
+	RTP       *rtpOutput `yaml:"RTP,omitempty"`
+	RTPSource *rtpInput  `yaml:"RTPSource,omitempty"`
+	PCM       *pcmFormat `yaml:"PCM,omitempty"`
+	AutoDJ    *autoDJ    `yaml:"AutoDJ,omitempty"`
+	Schedule  *schedule  `yaml:"Schedule,omitempty"`
+	Failover  *failover  `yaml:"Failover,omitempty"`
+	Record    *recording `yaml:"Record,omitempty"`
+	Archive   *archive   `yaml:"Archive,omitempty"`
+	Podcast   *podcast   `yaml:"Podcast,omitempty"`
 
 	ContentType string
 	StreamURL   string
+	StreamName  string `yaml:"-"`
 
 	Server *Server
 	logger Logger
@@ -62,38 +85,129 @@ type mount struct {
 		StartedTime time.Time
 		MetaInfo    metaData
 		Listeners   int32
+		Peak        int32
+		Hits        int32
+		History     []playedTrack
 	}
 
 	mux      sync.Mutex
 	buffer   bufferQueue
-	dumpFile *os.File
+	dump     *recorder
+	record   *recorder
+	archiver *archiver
+	hls      *hlsSegmenter
+	dash     *dashSegmenter
+
+	// the current source, see claimSource
+	source     int64
+	sourceKind sourceKind
+	sourceSeq  int64
+	sourceIdle bool
+	// connected sources of the failover mount, see claimLive
+	liveSources map[int64]*liveSource
+	// priority input, which replaces the source stream
+	override *override
+	intros   *introRotation
+	clips    clipCache
+	// the latest cue of spot insertion and the title it came with, titles are repeated by some sources
+	cue      *cue
+	cueTitle string
+	// listeners of the archive, who could jump to live
+	timeshifts map[int64]*timeshift
 }
 
 //Init ...
 func (m *mount) Init(srv *Server, logger Logger, poolManager PoolManager) error {
+	if m.PCM != nil {
+		if err := m.PCM.validate(); err != nil {
+			return errors.New("mount " + m.Name + ": " + err.Error())
+		}
+		m.BitRate = m.PCM.bitRate()
+	}
 	m.State.MetaInfo.MetaInt = m.BitRate * 1024 / 8 * 10
 	m.Server = srv
 	m.logger = logger
+	m.clips.mount = m
 	m.Clear()
+	if err := m.initIntro(); err != nil {
+		return err
+	}
 
-	if m.DumpFile > "" {
-		var err error
-		m.dumpFile, err = os.OpenFile(m.DumpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
-		if err != nil {
-			return err
-		}
+	if err := m.initRecording(); err != nil {
+		return err
+	}
+	if err := m.initArchive(); err != nil {
+		return err
+	}
+	if err := m.initPodcast(); err != nil {
+		return err
 	}
 
 	p := poolManager.Init(m.BitRate * 1024 / 8)
 	m.buffer.Init(m.BurstSize/(m.BitRate*1024/8)+2, p)
+
+	if srv.Options.HLS.Enabled {
+		m.hls = newHLSSegmenter(m, srv.Options.HLS.SegmentDuration, srv.Options.HLS.Window)
+		go m.hls.run()
+	}
+	if srv.Options.DASH.Enabled {
+		o := &srv.Options.DASH
+		m.dash = newDASHSegmenter(m, o.SegmentDuration, o.Window, o.LowLatency, o.ChunkDuration)
+		go m.dash.run()
+	}
+	if m.RTP != nil {
+		if err := m.RTP.open(m); err != nil {
+			return err
+		}
+		go m.RTP.run()
+	}
+	if m.RTPSource != nil {
+		if err := m.RTPSource.open(m); err != nil {
+			return err
+		}
+		go m.RTPSource.run()
+	}
+	if m.AutoDJ != nil {
+		if err := m.AutoDJ.init(m); err != nil {
+			return err
+		}
+		go m.AutoDJ.run()
+	}
+	if m.Schedule != nil {
+		if err := m.Schedule.init(m); err != nil {
+			return err
+		}
+		go m.Schedule.run()
+	}
 	return nil
 }
 
 //Close ...
 func (m *mount) Close() {
-	if m.dumpFile != nil {
-		_ = m.dumpFile.Close()
+	if m.hls != nil {
+		m.hls.Close()
 	}
+	if m.dash != nil {
+		m.dash.Close()
+	}
+	if m.RTP != nil {
+		m.RTP.Close()
+	}
+	if m.RTPSource != nil {
+		m.RTPSource.Close()
+	}
+	if m.AutoDJ != nil {
+		m.AutoDJ.Close()
+	}
+	if m.Schedule != nil {
+		m.Schedule.Close()
+	}
+	if o := m.currentOverride(); o != nil {
+		m.endOverride(o, "server is stopped")
+	}
+	m.dump.Close()
+	m.record.Close()
+	m.archiver.Close()
 }
 
 //Clear ...
@@ -107,8 +221,123 @@ func (m *mount) Clear() {
 	m.StreamURL = fmt.Sprintf("/%s", m.Name)
 }
 
+// sourceKind - the live source replaces the auto-DJ, scheduled fallback (it's checked by the schedule)
+// and silence of the grace period, the scheduled programme replaces anyone
+type sourceKind int
+
+const (
+	sourceNone sourceKind = iota
+	sourceAutoDJ
+	sourceLive
+	sourceScheduled
+	sourceGrace
+)
+
+var (
+	errSourceConnected    = errors.New("SOURCE already connected")
+	errSourceNotScheduled = errors.New("live source is not scheduled now")
+)
+
+// sourceAllowed - whether the source could take the mount, m.mux should be locked
+func (m *mount) sourceAllowed(kind sourceKind) error {
+	if kind == sourceLive && m.Schedule != nil && !m.Schedule.liveAllowed(time.Now()) {
+		return errSourceNotScheduled
+	}
+	if !m.State.Started || kind == sourceScheduled || kind == sourceLive && m.sourceKind != sourceLive {
+		return nil
+	}
+	// the source of the failover mount is active or standby
+	if kind == sourceLive && m.Failover != nil {
+		return nil
+	}
+	// the lost source is not detected yet, but the encoder is reconnected
+	if kind == sourceLive && m.sourceIdle && m.gracePeriod() > 0 {
+		return nil
+	}
+	return errSourceConnected
+}
+
+// claimSource - take the mount for the source, m.mux should be locked. The replaced source
+// stops at its next page, since it's not the owner anymore
+func (m *mount) claimSource(kind sourceKind) (int64, error) {
+	if err := m.sourceAllowed(kind); err != nil {
+		return 0, err
+	}
+	m.sourceSeq++
+	m.setSource(m.sourceSeq, kind)
+	return m.source, nil
+}
+
+// setSource - the source takes the mount, m.mux should be locked. Live sources of the failover
+// mount are stopped by any other source
+func (m *mount) setSource(id int64, kind sourceKind) {
+	reconnected := kind == sourceLive && (m.sourceKind == sourceGrace || m.sourceKind == sourceLive)
+	switch {
+	case reconnected:
+		m.logger.Info("Source of mount %s is reconnected", m.Name)
+	case m.State.Started:
+		m.logger.Info("Source of mount %s is replaced", m.Name)
+	}
+	if kind != sourceLive {
+		m.liveSources = nil
+	}
+	m.record.session()
+	m.archiver.session()
+	m.source = id
+	m.sourceKind = kind
+	m.sourceIdle = false
+	if !reconnected {
+		m.State.StartedTime = time.Now()
+	}
+	m.State.Started = true
+}
+
+// isSource - whether the source still owns the mount
+func (m *mount) isSource(id int64) bool {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.source == id
+}
+
+// releaseSource - free the mount, if the source still owns it. The lost live source leaves the mount
+// to the standby source of the failover or to silence of the grace period
+func (m *mount) releaseSource(id int64) {
+	m.mux.Lock()
+	delete(m.liveSources, id)
+	if m.source != id {
+		m.mux.Unlock()
+		return
+	}
+	lost := m.sourceKind == sourceLive
+	if lost && m.promoteStandby() {
+		m.mux.Unlock()
+		return
+	}
+	m.source = 0
+	m.sourceKind = sourceNone
+	m.sourceIdle = false
+	if period := m.gracePeriod(); lost && period > 0 && atomic.LoadInt32(&m.Server.Started) == 1 {
+		m.sourceSeq++
+		m.source = m.sourceSeq
+		m.sourceKind = sourceGrace
+		m.mux.Unlock()
+		go m.grace(m.sourceSeq, period)
+		return
+	}
+	m.mux.Unlock()
+	m.record.end()
+	m.Clear()
+}
+
 func (m *mount) incListeners() {
-	atomic.AddInt32(&m.State.Listeners, 1)
+	listeners := atomic.AddInt32(&m.State.Listeners, 1)
+	atomic.AddInt32(&m.State.Hits, 1)
+	for {
+		peak := atomic.LoadInt32(&m.State.Peak)
+		if listeners <= peak || atomic.CompareAndSwapInt32(&m.State.Peak, peak, listeners) {
+			break
+		}
+	}
 	m.Server.incListeners()
 }
 
@@ -123,40 +352,56 @@ func (m *mount) zeroListeners() {
 	atomic.StoreInt32(&m.State.Listeners, 0)
 }
 
-func (m *mount) auth(w http.ResponseWriter, r *http.Request) error {
+// auth - authenticate the source, returns its priority
+func (m *mount) auth(w http.ResponseWriter, r *http.Request) (int, error) {
 	strAuth := r.Header.Get("authorization")
 
 	if strAuth == "" {
-		m.saySourceHello(w)
-		return errors.New("no authorization field")
+		m.saySourceHello(w, r)
+		return 0, errors.New("no authorization field")
 	}
 
 	s := strings.SplitN(strAuth, " ", 2)
 	if len(s) != 2 {
 		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return errors.New("not authorized")
+		return 0, errors.New("not authorized")
 	}
 
 	b, err := base64.StdEncoding.DecodeString(s[1])
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
-		return err
+		return 0, err
 	}
 
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
 		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return errors.New("not authorized")
+		return 0, errors.New("not authorized")
 	}
 
-	if m.Password != pair[1] && m.User != pair[0] {
+	priority := m.checkCredentials(pair[0], pair[1])
+	if priority == 0 {
 		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return errors.New("wrong user or password")
+		return 0, errors.New("wrong user or password")
 	}
 
-	m.saySourceHello(w)
+	m.saySourceHello(w, r)
 
-	return nil
+	return priority, nil
+}
+
+// checkCredentials - priority of the source by user and password, 0 if they are wrong
+func (m *mount) checkCredentials(user, password string) int {
+	return m.sourcePriority(func(u, p string) bool {
+		return u == user && p == password
+	})
+}
+
+// checkPassword - single secret of SHOUTcast and RTMP sources: password or user:password
+func (m *mount) checkPassword(pass string) int {
+	return m.sourcePriority(func(u, p string) bool {
+		return pass == p || pass == u+":"+p
+	})
 }
 
 func (m *mount) getParams(paramStr string) map[string]string {
@@ -171,45 +416,33 @@ func (m *mount) getParams(paramStr string) map[string]string {
 	return params
 }
 
-func (m *mount) sayHello(w *bufio.ReadWriter, icyMeta bool) {
-	_, _ = w.WriteString("HTTP/1.1 200 OK\r\n")
-	_, _ = w.WriteString("Server: ")
-	_, _ = w.WriteString(m.Server.serverName)
-	_, _ = w.WriteString(" ")
-	_, _ = w.WriteString(m.Server.version)
-	_, _ = w.WriteString("\r\n")
-	_, _ = w.WriteString("Content-Type: ")
-	_, _ = w.WriteString(m.ContentType)
-	_, _ = w.WriteString("\r\nConnection: Keep-Alive\r\n")
-	_, _ = w.WriteString("X-Audiocast-Bitrate: ")
-	_, _ = w.WriteString(strconv.Itoa(m.BitRate))
-	_, _ = w.WriteString("\r\nX-Audiocast-Name: ")
-	_, _ = w.WriteString(m.Name)
-	_, _ = w.WriteString("\r\nX-Audiocast-Genre: ")
-	_, _ = w.WriteString(m.Genre)
-	_, _ = w.WriteString("\r\nX-Audiocast-Url: ")
-	_, _ = w.WriteString(m.StreamURL)
-	_, _ = w.WriteString("\r\nX-Audiocast-Public: 0\r\n")
-	_, _ = w.WriteString("X-Audiocast-Description: ")
-	_, _ = w.WriteString(m.Description)
-	_, _ = w.WriteString("\r\n")
+func (m *mount) sayHello(w streamWriter, icyMeta bool, contentType string) error {
+	h := http.Header{}
+	h.Set("Server", m.Server.serverName+" "+m.Server.version)
+	h.Set("Content-Type", contentType)
+	h.Set("Connection", "Keep-Alive")
+	h.Set("X-Audiocast-Bitrate", strconv.Itoa(m.BitRate))
+	h.Set("X-Audiocast-Name", m.Name)
+	h.Set("X-Audiocast-Genre", m.Genre)
+	h.Set("X-Audiocast-Url", m.StreamURL)
+	h.Set("X-Audiocast-Public", "0")
+	h.Set("X-Audiocast-Description", m.Description)
 	if icyMeta {
-		_, _ = w.WriteString("Icy-Metaint: ")
-		_, _ = w.WriteString(strconv.Itoa(m.State.MetaInfo.MetaInt))
-		_, _ = w.WriteString("\r\n")
+		h.Set("Icy-Metaint", strconv.Itoa(m.State.MetaInfo.MetaInt))
 	}
-	_, _ = w.WriteString("\r\n")
-	w.Flush()
+	return w.writeHeaders(h)
 }
 
-func (m *mount) saySourceHello(w http.ResponseWriter) {
+func (m *mount) saySourceHello(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", m.Server.serverName+"/"+m.Server.version)
 	w.Header().Set("Connection", "Keep-Alive")
 	w.Header().Set("Allow", "GET, SOURCE")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Pragma", "no-cache")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Transfer-Encoding", "chunked")
+	if r.ProtoMajor == 1 {
+		w.Header().Set("Transfer-Encoding", "chunked")
+	}
 	w.WriteHeader(http.StatusOK)
 
 	flusher, _ := w.(http.Flusher)
@@ -235,16 +468,53 @@ func (m *mount) writeICEHeaders(r *http.Request) {
 	m.Genre = r.Header.Get("ice-genre")
 	m.ContentType = r.Header.Get("content-type")
 	m.Description = r.Header.Get("ice-description")
+	m.StreamName = r.Header.Get("ice-name")
+}
+
+// writeICYHeaders - SHOUTcast flavour of writeICEHeaders
+func (m *mount) writeICYHeaders(h textproto.MIMEHeader) {
+	bRate, err := strconv.Atoi(h.Get("icy-br"))
+	if err == nil {
+		m.BitRate = bRate
+	}
+
+	m.Genre = h.Get("icy-genre")
+	m.StreamName = h.Get("icy-name")
+	m.ContentType = h.Get("content-type")
+	if m.ContentType == "" {
+		m.ContentType = "audio/mpeg"
+	}
 }
 
 func (m *mount) meta(w http.ResponseWriter, r *http.Request) {
-	if m.auth(w, r) != nil {
+	priority, err := m.auth(w, r)
+	if err != nil || !m.isActivePriority(priority) {
 		return
 	}
 
-	var metaSize byte
+	m.setStreamTitle(r.URL.Query().Get("song"))
+}
+
+// setStreamTitle - decode song title and prepare icy metadata block. While the mount is overridden,
+// the title of the source is kept until the end of the override. The cue title inserts spots instead
+func (m *mount) setStreamTitle(song string) {
+	if spots, ok := m.Server.cueTitle(song); ok {
+		m.titleCue(song, spots)
+		return
+	}
+	m.mux.Lock()
+	m.cueTitle = ""
+	if m.override != nil {
+		m.override.resumeTitle = song
+		m.mux.Unlock()
+		return
+	}
+	m.mux.Unlock()
+	m.updateStreamTitle(song)
+}
+
+func (m *mount) updateStreamTitle(song string) {
 	var mStr string
-	song := r.URL.Query().Get("song")
 	songReader := strings.NewReader(song)
 	enc, _, _ := charset.DetermineEncoding(([]byte)(song), "")
 	utf8Reader := transform.NewReader(songReader, enc.NewDecoder())
@@ -259,6 +529,7 @@ func (m *mount) meta(w http.ResponseWriter, r *http.Request) {
 
 	m.mux.Lock()
 	m.State.MetaInfo.StreamTitle = string(result[:])
+	m.addToHistory(m.State.MetaInfo.StreamTitle)
 
 	if m.State.MetaInfo.StreamTitle > "" {
 		mStr = "StreamTitle='" + m.State.MetaInfo.StreamTitle + "';"
@@ -266,15 +537,39 @@ func (m *mount) meta(w http.ResponseWriter, r *http.Request) {
 		mStr += "StreamTitle='" + m.Description + "';"
 	}
 
-	metaSize = byte(math.Ceil(float64(len(mStr)) / 16.0))
-	m.State.MetaInfo.metaSizeByte = int(metaSize)*16 + 1
-	m.State.MetaInfo.meta = make([]byte, m.State.MetaInfo.metaSizeByte)
-	m.State.MetaInfo.meta[0] = metaSize
+	m.State.MetaInfo.meta = icyMetaBlock(mStr)
+	m.State.MetaInfo.metaSizeByte = len(m.State.MetaInfo.meta)
+	title := m.State.MetaInfo.StreamTitle
+	m.mux.Unlock()
+	m.record.setTitle(title)
+	m.archiver.setTitle(title)
+}
 
-	for idx := 0; idx < len(mStr); idx++ {
-		m.State.MetaInfo.meta[idx+1] = mStr[idx]
+// icyMetaBlock - metadata block: length byte (in 16 bytes) and zero padded metadata
+func icyMetaBlock(mStr string) []byte {
+	metaSize := byte(math.Ceil(float64(len(mStr)) / 16.0))
+	meta := make([]byte, int(metaSize)*16+1)
+	meta[0] = metaSize
+	copy(meta[1:], mStr)
+	return meta
+}
+
+// addToHistory - remember played track, the most recent one goes first
+func (m *mount) addToHistory(title string) {
+	if title == "" || (len(m.State.History) > 0 && m.State.History[0].Title == title) {
+		return
 	}
-	m.mux.Unlock()
+	m.State.History = append([]playedTrack{{Title: title, Played: time.Now()}}, m.State.History...)
+	if len(m.State.History) > cHistorySize {
+		m.State.History = m.State.History[:cHistorySize]
+	}
+}
+
+// getHistory - copy of played tracks
+func (m *mount) getHistory() []playedTrack {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]playedTrack(nil), m.State.History...)
 }
 
 func fmtDuration(d time.Duration) string {
@@ -307,6 +602,19 @@ func (m *mount) getIcyMeta() ([]byte, int) {
 	return m.State.MetaInfo.meta, m.State.MetaInfo.metaSizeByte
 }
 
+func (m *mount) getContentType() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.ContentType
+}
+
+// getStreamTitle - current song title
+func (m *mount) getStreamTitle() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.State.MetaInfo.StreamTitle
+}
+
 /*
 	write
 	Authenticate SOURCE and write stream from it to appropriate mount buffer
@@ -318,50 +626,63 @@ func (m *mount) write(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !m.State.Started {
-		m.mux.Lock()
-		err := m.auth(w, r)
-		if err != nil {
-			m.mux.Unlock()
-			m.logger.Error(err.Error())
-			return
-		}
-		m.writeICEHeaders(r)
-		m.State.Started = true
-		m.State.StartedTime = time.Now()
+	if err := m.Server.prepareSource(w, r); err != nil {
+		m.logger.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.mux.Lock()
+	if err := m.sourceAllowed(sourceLive); err != nil {
 		m.mux.Unlock()
-	} else {
-		m.logger.Error("SOURCE already connected")
-		http.Error(w, "SOURCE already connected", 403)
+		m.logger.Error(err.Error())
+		http.Error(w, err.Error(), 403)
+		return
+	}
+	priority, err := m.auth(w, r)
+	if err != nil {
+		m.mux.Unlock()
+		m.logger.Error(err.Error())
 		return
 	}
+	id, _ := m.claimLive(priority)
+	if m.source == id {
+		m.writeICEHeaders(r)
+	}
+	m.mux.Unlock()
+	defer m.releaseSource(id)
 
 	bytesSent := 0
-	idle := 0
-	read := 0
-	var err error
 	start := time.Now()
 
 	m.logger.Info("writeMount %s", m.Name)
 	defer m.close(true, &bytesSent, start, r)
 
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		m.logger.Error("webServer doesn't support hijacking")
-		http.Error(w, "webServer doesn't support hijacking", http.StatusInternalServerError)
-		return
-	}
-
-	conn, _, err := hj.Hijack()
+	bufRW, err := m.Server.newSourceReader(w, r, 1024*m.BitRate/8)
 	if err != nil {
+		m.logger.Error(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer conn.Close()
+	defer bufRW.Close()
+
+	m.ingest(id, bufRW, &bytesSent)
+}
 
-	bufRW := bufio.NewReaderSize(conn, 1024*m.BitRate/8)
+// ingest - read the stream from the source and append it to the mount buffer, while the source owns the mount
+func (m *mount) ingest(id int64, reader io.Reader, bytesSent *int) {
+	var err error
+	var silence *silenceFiller
+	idle := 0
+	read := 0
 
 	m.Server.incSources()
+	if m.PCM != nil {
+		reader = m.PCM.newSourceReader(reader)
+		m.mux.Lock()
+		m.ContentType = cPCMContentType
+		m.mux.Unlock()
+	}
 	// max bytes per second according to bitrate
 	buff := make([]byte, m.BitRate*1024/8)
 
@@ -371,7 +692,12 @@ func (m *mount) write(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
-		read, err = bufRW.Read(buff)
+		read, err = reader.Read(buff)
+		state := m.checkSource(id, read > 0)
+		if state == sourceStopped {
+			m.logger.Info("Source of mount %s is stopped", m.Name)
+			break
+		}
 		if err != nil {
 			if err == io.EOF {
 				idle++
@@ -384,22 +710,50 @@ func (m *mount) write(w http.ResponseWriter, r *http.Request) {
 		} else {
 			idle = 0
 		}
-		// append to the buffer's queue based on actual read bytes
-		m.buffer.Append(buff, read)
-		bytesSent += read
-		m.logger.Debug("writeMount %d", read)
-
-		if m.dumpFile != nil {
-			m.dumpFile.Write(m.buffer.Last().buffer)
+		*bytesSent += read
+		if state == sourceStandby {
+			// the standby source is drained, until the failover makes it active
+			time.Sleep(1000 * time.Millisecond)
+			continue
 		}
+		m.setSourceIdle(id, idle > 0)
+		if idle > 0 && read == 0 && silence == nil && m.gracePeriod() > 0 {
+			silence, _ = m.newSilenceFiller()
+		}
+		if idle > 0 && read == 0 && silence != nil {
+			// silence keeps the listeners, while the lost source is detected
+			m.appendSilence(silence, time.Second)
+		} else if state == sourceSwitched {
+			m.appendBuffer(m.switchPage(buff[:read]))
+		} else {
+			// append to the buffer's queue based on actual read bytes
+			m.appendBuffer(buff[:read])
+		}
+		m.logger.Debug("writeMount %d", read)
 
 		time.Sleep(1000 * time.Millisecond)
+	}
+}
 
-		//check if max buffer size reached and truncate it
-		m.buffer.checkAndTruncate()
+// appendBuffer - append the source page, it's dropped while the mount is overridden
+func (m *mount) appendBuffer(page []byte) {
+	m.mux.Lock()
+	overridden := m.override != nil
+	m.mux.Unlock()
+	if !overridden {
+		m.writeBuffer(page)
 	}
 }
 
+// writeBuffer - append the page to the buffer, record it and truncate the buffer, if max size is reached
+func (m *mount) writeBuffer(page []byte) {
+	m.buffer.Append(page, len(page))
+	m.dump.write(page)
+	m.record.write(page)
+	m.archiver.write(page)
+	m.buffer.checkAndTruncate()
+}
+
 /*
 	read
 	Send stream from requested mount to client
@@ -411,41 +765,47 @@ func (m *mount) read(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Number of listeners exceeded", 403)
 		return
 	}
-	if r.Header.Get("icy-metadata") == "1" {
+	if r.Header.Get("icy-metadata") == "1" && m.PCM == nil {
 		icyMeta = true
 	}
 
-	var meta []byte
 	var err error
 	var beginIteration time.Time
 	var pack, nextPack *bufElement
 
 	bytesSent := 0
+	introSent := 0
 	write := 0
+	skip := 0
 	idle := 0
 	idleTimeOut := m.Server.Options.Limits.EmptyBufferIdleTimeOut * 1000
 	writeTimeOut := time.Second * time.Duration(m.Server.Options.Limits.WriteTimeOut)
-	offset := 0
-	noMetaBytes := 0
-	partWrite := 0
-	noMetaTmp := 0
-	delta := 0
-	metaLen := 0
-	n := 0
-
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		m.logger.Error("webServer doesn't support hijacking")
-		http.Error(w, "webServer doesn't support hijacking", http.StatusInternalServerError)
+
+	tsStart, err := m.timeshiftStart(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	conn, bufRW, err := hj.Hijack()
+	var ts *timeshift
+	if !tsStart.IsZero() {
+		if ts, err = m.newTimeshift(tsStart); err != nil {
+			m.logger.Error(err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer m.removeTimeshift(ts)
+	}
+
+	out, err := m.Server.newStreamWriter(w, r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer conn.Close()
+	defer out.Close()
+	if ts != nil {
+		out = &timeshiftHeaders{streamWriter: out, ts: ts}
+	}
 
 	start := time.Now()
 
@@ -455,71 +815,105 @@ func (m *mount) read(w http.ResponseWriter, r *http.Request) {
 	//try to maximize unused buffer pages from beginning
 	pack = m.buffer.Start(m.BurstSize)
 
-	if pack == nil {
+	contentType := m.ContentType
+	archived := false
+	if ts != nil {
+		var s archiveSegment
+		if s, archived = m.archiver.segmentAt(ts.start); archived {
+			contentType = m.segmentContentType(s)
+		}
+	}
+	// the time-shift listener needs the live stream only to jump to it
+	if pack == nil && !archived {
 		m.logger.Error("readMount Empty buffer")
 		return
 	}
-
-	m.sayHello(bufRW, icyMeta)
+	if m.PCM != nil {
+		if wantsLPCM(r) {
+			contentType = m.PCM.lpcmContentType()
+			out = &lpcmWriter{streamWriter: out, sampleSize: m.PCM.BitDepth / 8}
+		} else {
+			contentType = cPCMContentType
+		}
+	}
+	if err = m.sayHello(out, icyMeta, contentType); err != nil {
+		m.logger.Error(err.Error())
+		return
+	}
+	if m.PCM != nil && contentType == cPCMContentType {
+		if _, err = out.Write(m.PCM.wavHeader()); err != nil {
+			m.logger.Error(err.Error())
+			return
+		}
+	}
 	m.incListeners()
 
+	var audio io.Writer = out
+	var icy *icyWriter
+	if icyMeta {
+		icy = &icyWriter{streamWriter: out, metaInt: m.State.MetaInfo.MetaInt, meta: m.getIcyMeta}
+		audio = icy
+		defer func() { bytesSent += icy.metaSent }()
+	}
+	spots := m.newSpotPlayer(r, icy)
+
+	if intro := m.intro(); intro != nil {
+		_ = out.SetWriteDeadline(time.Now().Add(writeTimeOut))
+		introSent, err = audio.Write(intro)
+		if err == nil {
+			err = out.Flush()
+		}
+		bytesSent += introSent
+		if err != nil {
+			m.logger.Error(err.Error())
+			return
+		}
+		if ts == nil {
+			if pack, skip = m.liveStart(); pack == nil {
+				m.logger.Error("readMount Empty buffer")
+				return
+			}
+		}
+	}
+
+	if ts != nil {
+		var n int
+		n, err = m.playArchive(ts, out, audio, icy)
+		bytesSent += n
+		introSent += n
+		if err != nil {
+			m.logger.Error(err.Error())
+			return
+		}
+		if pack, skip = m.liveStart(); pack == nil {
+			m.logger.Error("readMount Empty buffer")
+			return
+		}
+	}
+
 OuterLoop:
 	for {
 		beginIteration = time.Now()
-		conn.SetWriteDeadline(time.Now().Add(writeTimeOut))
+		_ = out.SetWriteDeadline(time.Now().Add(writeTimeOut))
 		//check, if server has to be stopped
 		if atomic.LoadInt32(&m.Server.Started) == 0 {
 			break
 		}
 
-		n++
 		pack.Lock()
-		if icyMeta {
-			meta, metaLen = m.getIcyMeta()
-
-			if noMetaBytes+pack.len+delta > m.State.MetaInfo.MetaInt {
-				offset = m.State.MetaInfo.MetaInt - noMetaBytes - delta
-
-				//log.Printf("*** write block with meta ***")
-				//log.Printf("   offset = %d - %d(nometabytes) - %d (delta) = %d", mount.State.MetaInfo.MetaInt, nometabytes, delta, offset)
-
-				if offset < 0 || offset >= pack.len {
-					m.logger.Warning("Bad meta-info offset %d", offset)
-					log.Printf("!!! Bad metainfo offset %d ***", offset)
-					offset = 0
-				}
-
-				partWrite, err = bufRW.Write(pack.buffer[:offset])
-				if err != nil {
-					m.closeAndUnlock(pack, err)
-					break
-				}
-				write += partWrite
-				partWrite, err = bufRW.Write(meta)
-				if err != nil {
-					m.closeAndUnlock(pack, err)
-					break
-				}
-				write += partWrite
-				partWrite, err = bufRW.Write(pack.buffer[offset:])
-				if err != nil {
-					m.closeAndUnlock(pack, err)
-					break
-				}
-				write += partWrite
-
-				delta = write - offset - metaLen
-				noMetaBytes = 0
-				noMetaTmp = 0
-
-				//log.Printf("   delta = %d(writed) - %d(offset) - %d(metalen) = %d", writed, offset, metalen, delta)
-			} else {
-				write = 0
-				noMetaTmp, err = bufRW.Write(pack.buffer)
-				noMetaBytes += noMetaTmp
+		before, spot, after := spots.page(pack, skip)
+		skip = 0
+		write, err = audio.Write(before)
+		if err == nil && spot != nil {
+			var n int
+			if n, err = spots.play(audio, spot); err == nil {
+				write += n
+				n, err = audio.Write(after)
 			}
-		} else {
-			write, err = bufRW.Write(pack.buffer)
+			write += n
+		}
+		if err == nil {
+			err = out.Flush()
 		}
 
 		if err != nil {
@@ -527,10 +921,10 @@ OuterLoop:
 			break
 		}
 
-		bytesSent += write + noMetaTmp
+		bytesSent += write
 
 		// send burst data without waiting
-		if bytesSent >= m.BurstSize {
+		if bytesSent-introSent >= m.BurstSize {
 			if time.Since(beginIteration) < time.Second {
 				time.Sleep(time.Second - time.Since(beginIteration))
 			}
@@ -553,6 +947,18 @@ OuterLoop:
 	}
 }
 
+// liveStart - the burst of this moment, where the listener joins the live stream after the intro
+// or the archive, and the offset of its first frame
+func (m *mount) liveStart() (*bufElement, int) {
+	pack := m.buffer.Start(m.BurstSize)
+	if pack == nil {
+		return nil, 0
+	}
+	pack.Lock()
+	defer pack.UnLock()
+	return pack, m.frameAt(pack.buffer, 0)
+}
+
 func (m *mount) closeAndUnlock(pack *bufElement, err error) {
 	if te, ok := err.(net.Error); ok && te.Timeout() {
 		log.Println("Write timeout " + te.Error())
@@ -564,13 +970,16 @@ func (m *mount) closeAndUnlock(pack *bufElement, err error) {
 }
 
 func (m *mount) close(isSource bool, bytesSend *int, start time.Time, r *http.Request) {
+	m.closeConn(isSource, bytesSend, start, m.Server.getHost(r.RemoteAddr), r.Method+" "+r.RequestURI+" "+r.Proto, r.Referer(), r.UserAgent())
+}
+
+func (m *mount) closeConn(isSource bool, bytesSend *int, start time.Time, host, request, refer, userAgent string) {
 	if isSource {
 		m.Server.decSources()
-		m.Clear()
 	} else {
 		m.decListeners()
 	}
 	t := time.Now()
 	elapsed := t.Sub(start)
-	m.Server.writeAccessLog(m.Server.getHost(r.RemoteAddr), start, r.Method+" "+r.RequestURI+" "+r.Proto, *bytesSend, r.Referer(), r.UserAgent(), int(elapsed.Seconds()))
+	m.Server.writeAccessLog(host, start, request, *bytesSend, refer, userAgent, int(elapsed.Seconds()))
 }
@@ -0,0 +1,387 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Emergency override: the priority input cuts into the mounts at once. The source stream is dropped,
+// but the source stays connected, so the programme resumes, when the override ends or is cleared.
+// The input is a pre-configured alert (its file of the mount format is chosen), uploaded file
+// or another mount. Every start, clear and end is written to audit.log
+
+const (
+	// MB
+	cOverrideMaxUpload = 20
+	cOverrideTitle     = "Emergency alert"
+)
+
+// emergencyAlert - pre-configured alert, one file per stream format
+type emergencyAlert struct {
+	Name  string   `yaml:"Name"`
+	Title string   `yaml:"Title,omitempty"`
+	Files []string `yaml:"Files"`
+}
+
+// overrideInput - audio of the override
+type overrideInput struct {
+	alert  *emergencyAlert
+	data   []byte
+	codec  codec
+	source *mount
+	title  string
+}
+
+// override - the active override of the mount
+type override struct {
+	ID      int64
+	Mount   string
+	Input   string
+	Started time.Time
+	By      string
+
+	resumeTitle string
+	stop        chan struct{}
+	once        sync.Once
+	ended       bool
+}
+
+func (in *overrideInput) String() string {
+	switch {
+	case in.alert != nil:
+		return "alert " + in.alert.Name
+	case in.source != nil:
+		return "mount " + in.source.Name
+	}
+	return "upload " + in.codec.String() + ", " + strconv.Itoa(len(in.data)) + " bytes"
+}
+
+// checkAdmin - basic authorization of the administrator: admin and Auth.AdminPassword.
+// The admin API is closed, when the password is empty
+func (i *Server) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	admin := i.Options.Auth.AdminPassword
+	if ok && admin > "" && user == "admin" &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(admin)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="PenguinCast"`)
+	http.Error(w, "Not authorized", http.StatusUnauthorized)
+	return false
+}
+
+/*
+	overrideHandler
+	/admin/override?mount=name|*: GET - active overrides, POST - start, DELETE - clear.
+	POST takes alert=name, source=mount or the audio file in the body, title and reason are optional
+*/
+func (i *Server) overrideHandler(w http.ResponseWriter, r *http.Request) {
+	if !i.checkAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	mounts, err := i.overrideMounts(q["mount"], r.Method == "GET")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	by := i.getHost(r.RemoteAddr)
+	names := make([]string, 0, len(mounts))
+	for _, m := range mounts {
+		names = append(names, m.Name)
+	}
+
+	switch r.Method {
+	case "POST":
+		in, err := i.overrideInput(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the source mount is not overridden by itself
+		for idx, m := range mounts {
+			if m == in.source {
+				mounts = append(mounts[:idx:idx], mounts[idx+1:]...)
+				names = append(names[:idx:idx], names[idx+1:]...)
+				break
+			}
+		}
+		id := atomic.AddInt64(&i.overrides, 1)
+		i.logger.Audit("override #%d start: mounts=%s input=%q title=%q by=%s reason=%q", id,
+			strings.Join(names, ","), in.String(), in.title, by, q.Get("reason"))
+		for _, m := range mounts {
+			m.startOverride(id, in, by)
+		}
+	case "DELETE":
+		i.logger.Audit("override clear: mounts=%s by=%s reason=%q", strings.Join(names, ","), by, q.Get("reason"))
+		for _, m := range mounts {
+			if o := m.currentOverride(); o != nil {
+				m.endOverride(o, "cleared by "+by)
+			}
+		}
+	}
+
+	active := []*override{}
+	for _, m := range mounts {
+		if o := m.currentOverride(); o != nil {
+			active = append(active, o)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(active)
+}
+
+// overrideMounts - mounts by names, * or nothing (when it's allowed) means all mounts
+func (i *Server) overrideMounts(names []string, all bool) ([]*mount, error) {
+	if len(names) == 0 && !all {
+		return nil, errors.New("mount is not set")
+	}
+	if len(names) == 0 || len(names) == 1 && names[0] == "*" {
+		return i.Options.Mounts, nil
+	}
+	var mounts []*mount
+	for _, name := range names {
+		m := i.findMount(name)
+		if m == nil {
+			return nil, errors.New("unknown mount " + name)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+func (i *Server) overrideInput(r *http.Request) (*overrideInput, error) {
+	q := r.URL.Query()
+	in := &overrideInput{title: q.Get("title")}
+
+	switch {
+	case q.Get("alert") > "":
+		for _, a := range i.Options.Emergency.Alerts {
+			if a.Name == q.Get("alert") {
+				in.alert = a
+			}
+		}
+		if in.alert == nil || len(in.alert.Files) == 0 {
+			return nil, errors.New("unknown alert " + q.Get("alert"))
+		}
+		if in.title == "" {
+			in.title = in.alert.Title
+		}
+	case q.Get("source") > "":
+		if in.source = i.findMount(q.Get("source")); in.source == nil {
+			return nil, errors.New("unknown mount " + q.Get("source"))
+		}
+	default:
+		maxUpload := i.Options.Emergency.MaxUpload
+		if maxUpload <= 0 {
+			maxUpload = cOverrideMaxUpload
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxUpload)<<20+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return nil, errors.New("alert, source or audio file is expected")
+		}
+		if len(data) > maxUpload<<20 {
+			return nil, errors.New("file is too large")
+		}
+		in.data = data
+		if in.codec = codecByContentType(r.Header.Get("Content-Type")); in.codec == codecUnknown {
+			in.codec = codecByExtension("." + q.Get("format"))
+		}
+		if in.codec == codecUnknown {
+			return nil, errors.New("unknown audio format, set Content-Type or format=mp3|aac|ogg")
+		}
+	}
+	if in.title == "" {
+		in.title = cOverrideTitle
+	}
+	return in, nil
+}
+
+// currentOverride - the active override or nil
+func (m *mount) currentOverride() *override {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.override
+}
+
+// OverrideStatus - the active override for the status pages
+func (m *mount) OverrideStatus() string {
+	o := m.currentOverride()
+	if o == nil {
+		return ""
+	}
+	return "#" + strconv.FormatInt(o.ID, 10) + " " + o.Input + " since " + o.Started.Format("15:04:05")
+}
+
+// startOverride - cut into the mount, the previous override is replaced
+func (m *mount) startOverride(id int64, in *overrideInput, by string) {
+	o := &override{ID: id, Mount: m.Name, Input: in.String(), Started: time.Now(), By: by, stop: make(chan struct{})}
+
+	m.mux.Lock()
+	previous := m.override
+	o.resumeTitle = m.State.MetaInfo.StreamTitle
+	if previous != nil {
+		o.resumeTitle = previous.resumeTitle
+	}
+	m.override = o
+	m.mux.Unlock()
+	if previous != nil {
+		m.endOverride(previous, "replaced by #"+strconv.FormatInt(id, 10))
+	}
+
+	m.updateStreamTitle(in.title)
+	m.logger.Info("Override #%d of mount %s: %s", id, m.Name, o.Input)
+	go m.runOverride(o, in)
+}
+
+// runOverride - send the input to the mount buffer, until it ends or the override is stopped
+func (m *mount) runOverride(o *override, in *overrideInput) {
+	p := &pacer{mount: m, done: o.stop}
+	p.write = func(page []byte) bool {
+		m.mux.Lock()
+		active := m.override == o
+		m.mux.Unlock()
+		if active {
+			m.writeBuffer(page)
+		}
+		return active
+	}
+
+	var err error
+	if in.source != nil {
+		err = p.relayMount(in.source)
+	} else {
+		data, c := in.data, in.codec
+		if in.alert != nil {
+			data, c, err = m.alertFile(in.alert)
+		}
+		if err == nil {
+			m.checkOverrideFormat(c)
+			_, err = p.send(c, bytes.NewReader(audioData(c, data)))
+		}
+	}
+
+	reason := "finished"
+	if err != nil && err != errAutoDJStopped {
+		reason = err.Error()
+	}
+	m.endOverride(o, reason)
+}
+
+// endOverride - stop the override and return the mount to its source, only the first call has effect
+func (m *mount) endOverride(o *override, reason string) {
+	m.mux.Lock()
+	if o.ended {
+		m.mux.Unlock()
+		return
+	}
+	o.ended = true
+	current := m.override == o
+	if current {
+		m.override = nil
+	}
+	m.mux.Unlock()
+	o.once.Do(func() { close(o.stop) })
+	if current {
+		m.updateStreamTitle(o.resumeTitle)
+	}
+	m.logger.Info("Override #%d of mount %s is ended: %s", o.ID, m.Name, reason)
+	m.Server.logger.Audit("override #%d end: mount=%s reason=%q duration=%s", o.ID, m.Name, reason,
+		fmtDuration(time.Since(o.Started)))
+}
+
+// alertFile - the alert file of the mount format, the first one for the mount without stream
+func (m *mount) alertFile(a *emergencyAlert) ([]byte, codec, error) {
+	m.mux.Lock()
+	mountCodec := codecByContentType(m.ContentType)
+	m.mux.Unlock()
+
+	name := a.Files[0]
+	for _, file := range a.Files {
+		if codecByExtension(file) == mountCodec {
+			name = file
+			break
+		}
+	}
+	data, err := ioutil.ReadFile(name)
+	return data, codecByExtension(name), err
+}
+
+// checkOverrideFormat - the input is sent anyway, but listeners may fail on the other format
+func (m *mount) checkOverrideFormat(c codec) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	mountCodec := codecByContentType(m.ContentType)
+	switch {
+	case mountCodec == codecUnknown:
+		m.ContentType = c.contentType()
+	case mountCodec != c:
+		m.logger.Warning("Override of mount %s: %s input on %s stream", m.Name, c.String(), mountCodec.String())
+	}
+}
+
+// audioData - file without ID3 tags
+func audioData(c codec, data []byte) []byte {
+	if c == codecOgg {
+		return data
+	}
+	if len(data) > 128 && bytes.HasPrefix(data[len(data)-128:], []byte("TAG")) {
+		data = data[:len(data)-128]
+	}
+	_, skip := fileTags(c, data)
+	if skip > len(data) {
+		skip = len(data)
+	}
+	return data[skip:]
+}
+
+// relayMount - send frames of the other mount, until it has no stream for Limits.SourceIdleTimeOut
+func (p *pacer) relayMount(source *mount) error {
+	reader := source.newFrameReader()
+	defer reader.Close()
+	ogg := &oggDuration{}
+	formatChecked := false
+	idle := 0
+	for {
+		frame, f, c := reader.Next(time.Second)
+		if frame == nil {
+			select {
+			case <-p.done:
+				return nil
+			default:
+			}
+			if idle++; idle >= p.mount.Server.Options.Limits.SourceIdleTimeOut {
+				return errors.New("mount " + source.Name + " has no stream")
+			}
+			continue
+		}
+		idle = 0
+		if !formatChecked {
+			p.mount.checkOverrideFormat(c)
+			formatChecked = true
+		}
+		dur := f.Duration()
+		if c == codecOgg {
+			dur = ogg.page(frame)
+		}
+		if !p.add(frame, dur) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckAdmin(t *testing.T) {
+	tests := []struct {
+		name     string
+		admin    string
+		user     string
+		password string
+		auth     bool
+		ok       bool
+	}{
+		{"admin", "secret", "admin", "secret", true, true},
+		{"wrong password", "secret", "admin", "secre", true, false},
+		{"wrong user", "secret", "root", "secret", true, false},
+		{"no authorization", "secret", "", "", false, false},
+		{"empty password", "", "admin", "", true, false},
+		{"no authorization and empty password", "", "", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{}
+			srv.Options.Auth.AdminPassword = tt.admin
+			r := httptest.NewRequest("GET", "/admin/override?mount=*", nil)
+			if tt.auth {
+				r.SetBasicAuth(tt.user, tt.password)
+			}
+			w := httptest.NewRecorder()
+			if ok := srv.checkAdmin(w, r); ok != tt.ok {
+				t.Fatalf("authorized %v, want %v", ok, tt.ok)
+			}
+			if !tt.ok && w.Code != http.StatusUnauthorized {
+				t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
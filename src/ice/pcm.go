@@ -0,0 +1,149 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PCM mounts carry raw little-endian PCM. Source may send raw samples or WAV, the header is dropped.
+// Buffer pages always contain whole sample frames, so every listener starts on the frame boundary.
+// Listeners get streaming WAV header before the data, or big-endian audio/L16 (L8, L24)
+// with ?format=lpcm or Accept: audio/L16
+
+const cPCMContentType = "audio/wav"
+
+// pcmFormat - format of the PCM mount
+type pcmFormat struct {
+	SampleRate int `yaml:"SampleRate"`
+	Channels   int `yaml:"Channels"`
+	BitDepth   int `yaml:"BitDepth"`
+}
+
+func (f *pcmFormat) validate() error {
+	if f.SampleRate <= 0 || f.Channels <= 0 || f.Channels > 8 {
+		return errors.New("PCM format needs SampleRate and Channels (1-8)")
+	}
+	switch f.BitDepth {
+	case 8, 16, 24:
+	case 0:
+		f.BitDepth = 16
+	default:
+		return errors.New("PCM BitDepth should be 8, 16 or 24")
+	}
+	return nil
+}
+
+// blockAlign - size of the sample frame
+func (f *pcmFormat) blockAlign() int {
+	return f.Channels * f.BitDepth / 8
+}
+
+// bitRate - kbit/s
+func (f *pcmFormat) bitRate() int {
+	return f.SampleRate * f.blockAlign() * 8 / 1000
+}
+
+// wavHeader - WAV header of the endless stream, sizes are set to maximum
+func (f *pcmFormat) wavHeader() []byte {
+	h := make([]byte, 44)
+	copy(h, "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], 0xFFFFFFFF)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1)
+	binary.LittleEndian.PutUint16(h[22:], uint16(f.Channels))
+	binary.LittleEndian.PutUint32(h[24:], uint32(f.SampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(f.SampleRate*f.blockAlign()))
+	binary.LittleEndian.PutUint16(h[32:], uint16(f.blockAlign()))
+	binary.LittleEndian.PutUint16(h[34:], uint16(f.BitDepth))
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], 0xFFFFFFFF)
+	return h
+}
+
+// lpcmContentType - RFC 2586/3190 media type
+func (f *pcmFormat) lpcmContentType() string {
+	return "audio/L" + strconv.Itoa(f.BitDepth) + ";rate=" + strconv.Itoa(f.SampleRate) +
+		";channels=" + strconv.Itoa(f.Channels)
+}
+
+// wantsLPCM - listener asks for audio/L16 instead of WAV
+func wantsLPCM(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format > "" {
+		return strings.EqualFold(format, "lpcm")
+	}
+	accept := strings.ToLower(r.Header.Get("Accept"))
+	return strings.Contains(accept, "audio/l8") || strings.Contains(accept, "audio/l16") ||
+		strings.Contains(accept, "audio/l24")
+}
+
+// pcmSourceReader - drops WAV header of the source and returns whole sample frames only
+type pcmSourceReader struct {
+	r       io.Reader
+	align   int
+	left    []byte
+	started bool
+}
+
+func (f *pcmFormat) newSourceReader(r io.Reader) *pcmSourceReader {
+	return &pcmSourceReader{r: r, align: f.blockAlign()}
+}
+
+func (s *pcmSourceReader) Read(p []byte) (int, error) {
+	n := copy(p, s.left)
+	read, err := s.r.Read(p[n:])
+	n += read
+
+	if !s.started && n > 0 {
+		s.started = true
+		if skip := wavDataOffset(p[:n]); skip > 0 {
+			n = copy(p, p[skip:n])
+		}
+	}
+
+	rest := n % s.align
+	s.left = append(s.left[:0], p[n-rest:n]...)
+	return n - rest, err
+}
+
+// wavDataOffset - offset of the samples, if the stream starts with WAV header
+func wavDataOffset(b []byte) int {
+	if len(b) < 12 || !bytes.Equal(b[:4], []byte("RIFF")) || !bytes.Equal(b[8:12], []byte("WAVE")) {
+		return 0
+	}
+	for pos := 12; pos+8 <= len(b); {
+		size := int(binary.LittleEndian.Uint32(b[pos+4:]))
+		if bytes.Equal(b[pos:pos+4], []byte("data")) {
+			return pos + 8
+		}
+		pos += 8 + size + size&1
+	}
+	return 0
+}
+
+// lpcmWriter - converts little-endian samples to network byte order
+type lpcmWriter struct {
+	streamWriter
+	sampleSize int
+	buf        []byte
+}
+
+func (w *lpcmWriter) Write(p []byte) (int, error) {
+	if w.sampleSize == 1 {
+		return w.streamWriter.Write(p)
+	}
+	w.buf = append(w.buf[:0], p...)
+	for idx := 0; idx+w.sampleSize <= len(w.buf); idx += w.sampleSize {
+		sample := w.buf[idx : idx+w.sampleSize]
+		sample[0], sample[w.sampleSize-1] = sample[w.sampleSize-1], sample[0]
+	}
+	return w.streamWriter.Write(w.buf)
+}
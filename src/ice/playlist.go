@@ -0,0 +1,181 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Playlist files (.m3u, .pls, .xspf) pointing to the mount on every listen socket, which serves listeners
+
+type xspfTrack struct {
+	Location   []string `xml:"location"`
+	Title      string   `xml:"title"`
+	Annotation string   `xml:"annotation,omitempty"`
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version int         `xml:"version,attr"`
+	Title   string      `xml:"title"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isPrivate - loopback, private or link-local address, it's useless for clients out of that network
+func isPrivate(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// i2pHost - I2P host name of the server
+func (i *Server) i2pHost() string {
+	if strings.HasSuffix(i.Options.Host, ".i2p") {
+		return i.Options.Host
+	}
+	b32, err := ioutil.ReadFile(i.Options.Host + ".i2p.public.txt")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b32))
+}
+
+// streamURLs - mount URLs, the one requested by the client goes first
+func (i *Server) streamURLs(r *http.Request, m *mount) []string {
+	var urls []string
+	add := func(u string) {
+		for _, s := range urls {
+			if s == u {
+				return
+			}
+		}
+		urls = append(urls, u)
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	requestHost := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		requestHost = h
+	}
+	requestHost = strings.Trim(requestHost, "[]")
+	if strings.HasSuffix(requestHost, ".i2p") {
+		requestHost = ""
+	}
+	if requestHost > "" {
+		add(scheme + "://" + r.Host + m.StreamURL)
+	}
+
+	if !i.Options.DisableClearnet && requestHost > "" {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		for _, s := range i.sockets {
+			if s.Unix > "" || s.NoListeners {
+				continue
+			}
+			host := requestHost
+			if address := strings.Trim(s.Address, "[]"); address > "" && address != "0.0.0.0" && address != "::" {
+				// private addresses are given only to the clients of private networks
+				if isLoopback(address) && !isLoopback(client) || isPrivate(address) && !isPrivate(client) {
+					continue
+				}
+				host = address
+			}
+			scheme := "http"
+			if s.TLS {
+				scheme = "https"
+			}
+			add(scheme + "://" + net.JoinHostPort(host, strconv.Itoa(s.Port)) + m.StreamURL)
+		}
+	}
+	if i.Options.UsesI2P {
+		if host := i.i2pHost(); host > "" {
+			add("http://" + host + m.StreamURL)
+		}
+	}
+	return urls
+}
+
+func (m *mount) playlistTitle() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	title := m.Name
+	if m.StreamName > "" {
+		title = m.StreamName
+	}
+	if m.Description > "" {
+		title += " - " + m.Description
+	}
+	return title
+}
+
+func setPlaylistHeaders(w http.ResponseWriter, contentType, fileName string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "inline; filename=\""+fileName+"\"")
+	w.Header().Set("Cache-Control", "no-cache")
+}
+
+// m3uHandler - /{mount}.m3u
+func (m *mount) m3uHandler(w http.ResponseWriter, r *http.Request) {
+	title := m.playlistTitle()
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	for _, u := range m.Server.streamURLs(r, m) {
+		fmt.Fprintf(&b, "#EXTINF:-1,%s\n%s\n", title, u)
+	}
+	setPlaylistHeaders(w, "audio/x-mpegurl", m.Name+".m3u")
+	_, _ = w.Write(b.Bytes())
+}
+
+// plsHandler - /{mount}.pls
+func (m *mount) plsHandler(w http.ResponseWriter, r *http.Request) {
+	title := m.playlistTitle()
+	urls := m.Server.streamURLs(r, m)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[playlist]\nNumberOfEntries=%d\n", len(urls))
+	for idx, u := range urls {
+		fmt.Fprintf(&b, "File%d=%s\nTitle%d=%s\nLength%d=-1\n", idx+1, u, idx+1, title, idx+1)
+	}
+	b.WriteString("Version=2\n")
+	setPlaylistHeaders(w, "audio/x-scpls", m.Name+".pls")
+	_, _ = w.Write(b.Bytes())
+}
+
+// xspfHandler - /{mount}.xspf, one track with alternative locations
+func (m *mount) xspfHandler(w http.ResponseWriter, r *http.Request) {
+	m.mux.Lock()
+	track := xspfTrack{Title: m.Name, Annotation: m.Description}
+	if m.StreamName > "" {
+		track.Title = m.StreamName
+	}
+	m.mux.Unlock()
+	track.Location = m.Server.streamURLs(r, m)
+
+	setPlaylistHeaders(w, "application/xspf+xml", m.Name+".xspf")
+	_, _ = w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	_ = enc.Encode(xspfPlaylist{Version: 1, Title: m.Server.Options.Name, Tracks: []xspfTrack{track}})
+}
@@ -0,0 +1,578 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Podcast: the recordings of the mount are published as RSS (with iTunes tags) and Atom feeds,
+// /mount.rss and /mount.atom, ?show= leaves the episodes of one scheduled show. With Schedule the
+// recording is split at slot boundaries, so every episode is one show, it's titled by the slot name.
+// Duration and tracks are taken from the CUE sheet, which the recorder completes, when the file is
+// closed, the duration of earlier recordings is estimated by the bitrate. Enclosures are
+// served by /mount/recordings/{file} with Range support, the file being recorded isn't published
+
+const (
+	cPodcastEpisodes = 50
+	cITunesNamespace = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+	cAtomNamespace   = "http://www.w3.org/2005/Atom"
+)
+
+// podcast - feed settings of the mount
+type podcast struct {
+	Title       string `yaml:"Title,omitempty"`
+	Description string `yaml:"Description,omitempty"`
+	Author      string `yaml:"Author,omitempty"`
+	Image       string `yaml:"Image,omitempty"`
+	Language    string `yaml:"Language,omitempty"`
+	Category    string `yaml:"Category,omitempty"`
+	Explicit    bool   `yaml:"Explicit,omitempty"`
+	// the newest episodes in the feed
+	Episodes int `yaml:"Episodes,omitempty"`
+	// seconds, shorter recordings are skipped
+	MinDuration int `yaml:"MinDuration,omitempty"`
+
+	mux      sync.Mutex
+	episodes map[string]*episode
+}
+
+// episode - recording in the feed, it's scanned once while its size and time are the same
+type episode struct {
+	name     string
+	path     string
+	size     int64
+	modTime  time.Time
+	started  time.Time
+	duration time.Duration
+	show     string
+	tracks   []*cueTrack
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	ITunes  string     `xml:"xmlns:itunes,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string          `xml:"title"`
+	Link        string          `xml:"link"`
+	Self        atomLink        `xml:"atom:link"`
+	Description string          `xml:"description"`
+	Language    string          `xml:"language,omitempty"`
+	BuildDate   string          `xml:"lastBuildDate"`
+	Author      string          `xml:"itunes:author,omitempty"`
+	Image       *itunesImage    `xml:"itunes:image,omitempty"`
+	Category    *itunesCategory `xml:"itunes:category,omitempty"`
+	Explicit    string          `xml:"itunes:explicit"`
+	Items       []rssItem       `xml:"item"`
+}
+
+type itunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type itunesCategory struct {
+	Text string `xml:"text,attr"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Description string       `xml:"description,omitempty"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+	Duration    string       `xml:"itunes:duration"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	ID       string      `xml:"id"`
+	Updated  string      `xml:"updated"`
+	Author   *atomPerson `xml:"author"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Summary   string     `xml:"summary,omitempty"`
+	Links     []atomLink `xml:"link"`
+}
+
+func (m *mount) initPodcast() error {
+	if m.Podcast == nil {
+		return nil
+	}
+	if m.Record == nil {
+		return errors.New("mount " + m.Name + ": podcast needs Record")
+	}
+	m.Podcast.episodes = make(map[string]*episode)
+	return nil
+}
+
+// recordingsDir - the directory of the pattern, which contains all the recordings
+func (r *recorder) recordingsDir() string {
+	path := strings.Replace(r.conf.Path, "{mount}", r.mount.Name, -1)
+	if idx := strings.IndexAny(path, "{%"); idx >= 0 {
+		path = path[:idx]
+		if !strings.HasSuffix(path, string(filepath.Separator)) {
+			path = filepath.Dir(path)
+		}
+	} else {
+		path = filepath.Dir(path)
+	}
+	return filepath.Clean(path)
+}
+
+// recordings - finished recordings of the mount, path relative to recordingsDir => file name
+func (r *recorder) recordings() (map[string]string, error) {
+	names, err := filepath.Glob(r.recordingPattern())
+	if err != nil {
+		return nil, err
+	}
+	dir := r.recordingsDir()
+	current := r.getStatus().File
+	files := make(map[string]string)
+	for _, name := range names {
+		if name == current || strings.EqualFold(filepath.Ext(name), ".cue") {
+			continue
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		files[filepath.ToSlash(rel)] = name
+	}
+	return files, nil
+}
+
+// slotChanged - the recording of the podcast is split at the boundaries of scheduled shows
+func (m *mount) slotChanged(slot *scheduleSlot, t time.Time) bool {
+	return m.Podcast != nil && m.slotAt(t) != slot
+}
+
+func (m *mount) slotAt(t time.Time) *scheduleSlot {
+	if m.Schedule == nil || m.Schedule.location == nil {
+		return nil
+	}
+	return m.Schedule.slotAt(t)
+}
+
+// recordingContentType - MIME type of the recording by its extension
+func recordingContentType(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp3":
+		return "audio/mpeg"
+	case ".aac":
+		return "audio/aac"
+	case ".ogg":
+		return "audio/ogg"
+	case ".wav":
+		return "audio/wav"
+	}
+	return "application/octet-stream"
+}
+
+// estimateDuration - playing time of the recording without the duration in the CUE sheet:
+// WAV by the sample rate, compressed formats by the bitrate of the mount
+func (m *mount) estimateDuration(size int64) time.Duration {
+	if m.PCM != nil {
+		rate := int64(m.PCM.SampleRate * m.PCM.blockAlign())
+		if rate == 0 || size < 44 {
+			return 0
+		}
+		return time.Duration(size-44) * time.Second / time.Duration(rate)
+	}
+	if m.BitRate <= 0 {
+		return 0
+	}
+	return time.Duration(size) * time.Second / time.Duration(m.BitRate*1024/8)
+}
+
+// readCueSheet - tracks of the recording, its start time and duration by the CUE sheet written by the recorder
+func readCueSheet(name string) ([]*cueTrack, time.Time, time.Duration, error) {
+	f, err := os.Open(cueSheetName(name))
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	defer f.Close()
+	var tracks []*cueTrack
+	var started time.Time
+	var duration time.Duration
+	var performer string
+	flush := func() {
+		if len(tracks) > 0 && performer > "" {
+			t := tracks[len(tracks)-1]
+			t.Title = strings.TrimPrefix(performer+" - "+t.Title, " - ")
+		}
+		performer = ""
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "REM DURATION ") {
+			duration, _ = time.ParseDuration(line[len("REM DURATION "):])
+			continue
+		}
+		if strings.HasPrefix(line, "TRACK ") {
+			flush()
+			tracks = append(tracks, &cueTrack{})
+			continue
+		}
+		if len(tracks) == 0 {
+			continue
+		}
+		t := tracks[len(tracks)-1]
+		switch {
+		case strings.HasPrefix(line, "TITLE "):
+			t.Title = strings.Trim(line[len("TITLE "):], "\"")
+		case strings.HasPrefix(line, "PERFORMER "):
+			performer = strings.Trim(line[len("PERFORMER "):], "\"")
+		case strings.HasPrefix(line, "REM OFFSET "):
+			t.Offset, _ = strconv.ParseInt(line[len("REM OFFSET "):], 10, 64)
+		case strings.HasPrefix(line, "REM AIRED "):
+			if aired, err := time.Parse(time.RFC3339, line[len("REM AIRED "):]); err == nil && len(tracks) == 1 {
+				started = aired
+			}
+		case strings.HasPrefix(line, "INDEX 01 "):
+			var mm, ss, ff int64
+			if _, err := fmt.Sscanf(line[len("INDEX 01 "):], "%d:%d:%d", &mm, &ss, &ff); err == nil {
+				t.Time = time.Duration((mm*60+ss)*cCueFrames+ff) * time.Second / cCueFrames
+			}
+		}
+	}
+	flush()
+	if len(tracks) > 0 && !started.IsZero() {
+		started = started.Add(-tracks[0].Time)
+	}
+	return tracks, started, duration, scanner.Err()
+}
+
+// episodes - the recordings, newest first, the unchanged ones are taken from the cache
+func (m *mount) episodes() ([]*episode, error) {
+	p := m.Podcast
+	files, err := m.record.recordings()
+	if err != nil {
+		return nil, err
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	var list []*episode
+	cache := make(map[string]*episode)
+	for path, name := range files {
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		e := p.episodes[name]
+		if e == nil || e.size != info.Size() || !e.modTime.Equal(info.ModTime()) {
+			if e, err = m.newEpisode(name, info); err != nil {
+				m.logger.Error("Podcast of mount %s: %s", m.Name, err.Error())
+				continue
+			}
+		}
+		e.path = path
+		cache[name] = e
+		if e.duration >= time.Duration(p.MinDuration)*time.Second {
+			list = append(list, e)
+		}
+	}
+	p.episodes = cache
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].started.After(list[j].started)
+	})
+	return list, nil
+}
+
+func (m *mount) newEpisode(name string, info os.FileInfo) (*episode, error) {
+	e := &episode{name: name, size: info.Size(), modTime: info.ModTime()}
+	tracks, started, duration, err := readCueSheet(name)
+	if err == nil {
+		e.tracks = tracks
+	}
+	e.started = started
+	e.duration = duration
+	if e.duration == 0 {
+		e.duration = m.estimateDuration(e.size)
+	}
+	if e.started.IsZero() {
+		// the last write is the end of the recording
+		e.started = e.modTime.Add(-e.duration)
+	}
+	if slot := m.slotAt(e.started.Add(e.duration / 2)); slot != nil {
+		e.show = slot.Name
+	}
+	return e, nil
+}
+
+// episodeTitle - the show and its date, the track of the split recording, or the first title and the date
+func (m *mount) episodeTitle(e *episode) string {
+	location := time.Local
+	if m.Schedule != nil && m.Schedule.location != nil {
+		location = m.Schedule.location
+	}
+	date := e.started.In(location).Format("2006-01-02 15:04")
+	switch {
+	case e.show > "":
+		return e.show + " " + date
+	case len(e.tracks) > 0 && e.tracks[0].Title > "":
+		if m.Record.SplitTracks {
+			return e.tracks[0].Title
+		}
+		return e.tracks[0].Title + " " + date
+	}
+	return m.podcastTitle() + " " + date
+}
+
+// episodeDescription - the track list of the recording
+func episodeDescription(e *episode) string {
+	var lines []string
+	for _, t := range e.tracks {
+		if t.Title > "" {
+			lines = append(lines, fmtDuration(t.Time)+" "+t.Title)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m *mount) podcastTitle() string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	switch {
+	case m.Podcast.Title > "":
+		return m.Podcast.Title
+	case m.StreamName > "":
+		return m.StreamName
+	}
+	return m.Name
+}
+
+// feedEpisodes - episodes of the feed request: the show and the number of them
+func (m *mount) feedEpisodes(w http.ResponseWriter, r *http.Request) (string, []*episode, bool) {
+	list, err := m.episodes()
+	if err != nil {
+		m.logger.Error("Podcast of mount %s: %s", m.Name, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", nil, false
+	}
+	show := r.URL.Query().Get("show")
+	if show > "" {
+		var shown []*episode
+		for _, e := range list {
+			if strings.EqualFold(e.show, show) {
+				shown = append(shown, e)
+			}
+		}
+		list = shown
+	}
+	max := m.Podcast.Episodes
+	if max <= 0 {
+		max = cPodcastEpisodes
+	}
+	if len(list) > max {
+		list = list[:max]
+	}
+	return show, list, true
+}
+
+// feedBase - scheme and host of the request for the absolute links of the feed
+func feedBase(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func (m *mount) enclosureURL(base string, e *episode) string {
+	u := url.URL{Path: "/" + m.Name + "/recordings/" + e.path}
+	return base + u.EscapedPath()
+}
+
+/*
+	rssHandler
+	/mount.rss: podcast feed of the recordings, ?show= is one scheduled show
+*/
+func (m *mount) rssHandler(w http.ResponseWriter, r *http.Request) {
+	show, list, ok := m.feedEpisodes(w, r)
+	if !ok {
+		return
+	}
+	base := feedBase(r)
+	p := m.Podcast
+	title := m.podcastTitle()
+	if show > "" {
+		title += ": " + show
+	}
+	description := p.Description
+	if description == "" {
+		description = m.Description
+	}
+	channel := rssChannel{
+		Title:       title,
+		Link:        base + m.StreamURL,
+		Self:        atomLink{Href: base + r.URL.RequestURI(), Rel: "self", Type: "application/rss+xml"},
+		Description: description,
+		Language:    p.Language,
+		BuildDate:   time.Now().Format(time.RFC1123Z),
+		Author:      p.Author,
+		Explicit:    "false",
+	}
+	if p.Explicit {
+		channel.Explicit = "true"
+	}
+	if p.Image > "" {
+		channel.Image = &itunesImage{Href: p.Image}
+	}
+	if p.Category > "" {
+		channel.Category = &itunesCategory{Text: p.Category}
+	}
+	for _, e := range list {
+		link := m.enclosureURL(base, e)
+		channel.Items = append(channel.Items, rssItem{
+			Title:       m.episodeTitle(e),
+			Description: episodeDescription(e),
+			GUID:        rssGUID{Value: link},
+			PubDate:     e.started.Format(time.RFC1123Z),
+			Enclosure:   rssEnclosure{URL: link, Length: e.size, Type: recordingContentType(e.name)},
+			Duration:    fmtDuration(e.duration),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	_ = enc.Encode(rssFeed{Version: "2.0", ITunes: cITunesNamespace, Atom: cAtomNamespace, Channel: channel})
+}
+
+/*
+	atomHandler
+	/mount.atom: Atom feed of the recordings, ?show= is one scheduled show
+*/
+func (m *mount) atomHandler(w http.ResponseWriter, r *http.Request) {
+	show, list, ok := m.feedEpisodes(w, r)
+	if !ok {
+		return
+	}
+	base := feedBase(r)
+	p := m.Podcast
+	feed := atomFeed{
+		Title:    m.podcastTitle(),
+		Subtitle: p.Description,
+		ID:       base + r.URL.RequestURI(),
+		Updated:  time.Now().Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: base + r.URL.RequestURI(), Rel: "self", Type: "application/atom+xml"},
+			{Href: base + m.StreamURL, Rel: "alternate"},
+		},
+	}
+	if show > "" {
+		feed.Title += ": " + show
+	}
+	// the feed should have the author
+	feed.Author = &atomPerson{Name: p.Author}
+	if p.Author == "" {
+		feed.Author.Name = m.podcastTitle()
+	}
+	if len(list) > 0 {
+		feed.Updated = list[0].modTime.Format(time.RFC3339)
+	}
+	for _, e := range list {
+		link := m.enclosureURL(base, e)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:     m.episodeTitle(e),
+			ID:        link,
+			Published: e.started.Format(time.RFC3339),
+			Updated:   e.modTime.Format(time.RFC3339),
+			Summary:   episodeDescription(e),
+			Links: []atomLink{
+				{Href: link, Rel: "alternate"},
+				{Href: link, Rel: "enclosure", Type: recordingContentType(e.name), Length: e.size},
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	_, _ = w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	_ = enc.Encode(feed)
+}
+
+/*
+	recordingHandler
+	/mount/recordings/{file}: finished recording of the mount with Range requests
+*/
+func (m *mount) recordingHandler(w http.ResponseWriter, r *http.Request) {
+	files, err := m.record.recordings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// only the files of the pattern are served
+	name, ok := files[mux.Vars(r)["file"]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", recordingContentType(name))
+	http.ServeContent(w, r, filepath.Base(name), info.ModTime(), f)
+}
@@ -0,0 +1,651 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recording: everything, which is broadcast by the mount, is written to files. Every source session
+// (live source, auto-DJ, scheduled programme) starts a new file named by the time pattern. Files are
+// rotated by duration (aligned to the wall clock of the schedule time zone, local by default) and size
+// at the frame boundary, old recordings are removed by age, count and total size. Pages are written by
+// the goroutine of the recorder, the mount never waits for the disk: when the queue is full, pages are
+// dropped and counted. Control events (session, title, start and stop) are queued in order with pages
+// and never dropped.
+// DumpFile is the recording into one file, which is appended
+
+const (
+	// pages (about a second each) waiting for the disk
+	cRecordQueue = 120
+	cMB          = 1024 * 1024
+)
+
+// recording - recording settings of the mount
+type recording struct {
+	// file name pattern: {mount}, {title}, %Y, %m, %d, %H, %M, %S, the extension of the format is added, if it's omitted
+	Path string `yaml:"Path"`
+	// recording is started by the admin API only
+	Manual bool `yaml:"Manual,omitempty"`
+	// minutes
+	Rotate int `yaml:"Rotate,omitempty"`
+	// MB
+	RotateSize int `yaml:"RotateSize,omitempty"`
+	// days
+	MaxAge   int `yaml:"MaxAge,omitempty"`
+	MaxFiles int `yaml:"MaxFiles,omitempty"`
+	// MB
+	MaxSize int `yaml:"MaxSize,omitempty"`
+	// CUE sheet of the StreamTitle changes next to the recording
+	CueSheet bool `yaml:"CueSheet,omitempty"`
+	// every track is recorded to its own file
+	SplitTracks bool `yaml:"SplitTracks,omitempty"`
+}
+
+type recordEventKind int
+
+const (
+	recordPage recordEventKind = iota
+	// new source session, the next page starts a new file
+	recordSession
+	// the mount is released
+	recordEnd
+	recordStart
+	recordStop
+	// StreamTitle is changed from the next page
+	recordTitle
+)
+
+type recordEvent struct {
+	kind  recordEventKind
+	page  []byte
+	title string
+	// closed, when the event is handled
+	handled chan struct{}
+}
+
+// recordStatus - state of the recorder for /admin/record
+type recordStatus struct {
+	Mount     string
+	Recording bool
+	File      string     `json:",omitempty"`
+	Started   *time.Time `json:",omitempty"`
+	Bytes     int64
+	Dropped   int64
+}
+
+// recorder - writes pages of the mount into files
+type recorder struct {
+	mount *mount
+	conf  *recording
+	dump  bool
+	// the queue isn't empty
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+
+	mux    sync.Mutex
+	status recordStatus
+	queue  []recordEvent
+	// pages in the queue
+	pages int
+	// the queue was full, the drop is reported once
+	dropping bool
+
+	// state of the recorder goroutine
+	file     *os.File
+	wav      bool
+	rotateAt time.Time
+	// scheduled show of the file
+	slot *scheduleSlot
+	// the next page begins the source session, otherwise the file starts from the frame boundary
+	sessionStart bool
+	oggHeaders   []byte
+	// StreamTitle and tracks of the file
+	title    string
+	tracks   []*cueTrack
+	clock    *trackClock
+	splitDue bool
+}
+
+func newRecorder(m *mount, conf *recording, dump bool) *recorder {
+	r := &recorder{
+		mount: m,
+		conf:  conf,
+		dump:  dump,
+		wake:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	r.status.Mount = m.Name
+	r.status.Recording = dump || !conf.Manual
+	return r
+}
+
+// initRecording - recorders of DumpFile and Record settings
+func (m *mount) initRecording() error {
+	if m.DumpFile > "" {
+		m.dump = newRecorder(m, &recording{Path: m.DumpFile}, true)
+		go m.dump.run()
+	}
+	if m.Record != nil {
+		if m.Record.Path == "" {
+			return errors.New("mount " + m.Name + ": recording path is not set")
+		}
+		m.record = newRecorder(m, m.Record, false)
+		go m.record.run()
+	}
+	return nil
+}
+
+// send - queue the event, the mount is never blocked. Pages are dropped, when the queue is full,
+// control events are always queued
+func (r *recorder) send(e recordEvent) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	if e.kind == recordPage && r.pages >= cRecordQueue {
+		r.status.Dropped++
+		report := !r.dropping
+		r.dropping = true
+		r.mux.Unlock()
+		if report {
+			r.mount.logger.Warning("Recording of mount %s: the disk is too slow, pages are dropped", r.mount.Name)
+		}
+		return
+	}
+	if e.kind == recordPage {
+		r.pages++
+		r.dropping = false
+	}
+	r.queue = append(r.queue, e)
+	r.mux.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next - the first event of the queue
+func (r *recorder) next() (recordEvent, bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if len(r.queue) == 0 {
+		return recordEvent{}, false
+	}
+	e := r.queue[0]
+	r.queue[0] = recordEvent{}
+	r.queue = r.queue[1:]
+	if e.kind == recordPage {
+		r.pages--
+	}
+	return e, true
+}
+
+// command - start or stop recording, it returns when the recorder has handled the command
+func (r *recorder) command(kind recordEventKind) {
+	e := recordEvent{kind: kind, handled: make(chan struct{})}
+	r.send(e)
+	select {
+	case <-e.handled:
+	case <-r.done:
+	}
+}
+
+// write - record the page, it's copied since the buffer pages are reused
+func (r *recorder) write(page []byte) {
+	if r != nil && len(page) > 0 {
+		r.send(recordEvent{kind: recordPage, page: append([]byte(nil), page...)})
+	}
+}
+
+// session - the source takes the mount, DumpFile goes on
+func (r *recorder) session() {
+	if r != nil && !r.dump {
+		r.send(recordEvent{kind: recordSession})
+	}
+}
+
+// setTitle - the title is changed, it starts the new track of the recording
+func (r *recorder) setTitle(title string) {
+	if r != nil && !r.dump {
+		r.send(recordEvent{kind: recordTitle, title: title})
+	}
+}
+
+func (r *recorder) end() {
+	if r != nil && !r.dump {
+		r.send(recordEvent{kind: recordEnd})
+	}
+}
+
+func (r *recorder) Close() {
+	if r == nil {
+		return
+	}
+	close(r.quit)
+	<-r.done
+}
+
+func (r *recorder) getStatus() recordStatus {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.status
+}
+
+func (r *recorder) run() {
+	defer close(r.done)
+	defer r.closeFile()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-r.wake:
+		}
+		for e, ok := r.next(); ok; e, ok = r.next() {
+			r.handle(e)
+			select {
+			case <-r.quit:
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (r *recorder) handle(e recordEvent) {
+	if e.handled != nil {
+		defer close(e.handled)
+	}
+	switch e.kind {
+	case recordSession:
+		r.closeFile()
+		r.sessionStart = true
+		r.oggHeaders = nil
+	case recordEnd:
+		r.closeFile()
+		r.sessionStart = true
+	case recordStart:
+		r.mux.Lock()
+		r.status.Recording = true
+		r.mux.Unlock()
+	case recordStop:
+		r.mux.Lock()
+		r.status.Recording = false
+		r.mux.Unlock()
+		r.closeFile()
+	case recordTitle:
+		r.changeTitle(e.title)
+	case recordPage:
+		r.writePage(e.page)
+	}
+}
+
+// changeTitle - mark the track in the current file or split it at the next frame
+func (r *recorder) changeTitle(title string) {
+	if title == r.title {
+		return
+	}
+	r.title = title
+	switch {
+	case r.file == nil:
+	case r.conf.SplitTracks:
+		r.splitDue = true
+	case r.conf.CueSheet:
+		r.clock.mark(title)
+	}
+}
+
+func (r *recorder) writePage(page []byte) {
+	c := codecByContentType(r.mount.getContentType())
+	sessionStart := r.sessionStart
+	r.sessionStart = false
+	if sessionStart && c == codecOgg && r.mount.PCM == nil {
+		r.oggHeaders = oggHeaderPages(page)
+	}
+	r.mux.Lock()
+	recording := r.status.Recording
+	r.mux.Unlock()
+	if !recording {
+		return
+	}
+
+	if r.file != nil && (r.splitDue || r.rotationDue(len(page))) {
+		idx := r.mount.frameAt(page, 0)
+		r.writeAudio(page[:idx])
+		r.closeFile()
+		page = page[idx:]
+		sessionStart = false
+	} else if r.file == nil && !sessionStart && !r.dump {
+		// the recording starts in the middle of the stream
+		page = page[r.mount.frameAt(page, 0):]
+	}
+	if r.file == nil {
+		if err := r.openFile(c, sessionStart); err != nil {
+			r.mount.logger.Error("Recording of mount %s: %s", r.mount.Name, err.Error())
+			return
+		}
+	}
+	r.writeAudio(page)
+}
+
+// writeAudio - write the stream and count it for the tracks
+func (r *recorder) writeAudio(data []byte) {
+	r.writeFile(data)
+	if r.clock == nil || r.file == nil {
+		return
+	}
+	t := r.clock.add(data)
+	if t == nil {
+		return
+	}
+	// the title is changed again before any audio of the previous one
+	if last := r.tracks[len(r.tracks)-1]; last.Offset == t.Offset {
+		last.Title = t.Title
+	} else {
+		r.tracks = append(r.tracks, t)
+	}
+	r.writeCueSheet(0)
+}
+
+// cueSheet - the CUE sheet is written, it also keeps the duration of the podcast episode
+func (r *recorder) cueSheet() bool {
+	return r.conf.CueSheet || r.mount.Podcast != nil
+}
+
+// writeCueSheet - the duration is written, when the file is closed
+func (r *recorder) writeCueSheet(duration time.Duration) {
+	r.mux.Lock()
+	name, started := r.status.File, r.status.Started
+	r.mux.Unlock()
+	if name == "" || started == nil {
+		return
+	}
+	if err := writeCueSheet(name, r.mount.Name, *started, r.tracks, duration); err != nil {
+		r.mount.logger.Error("Recording of mount %s: %s", r.mount.Name, err.Error())
+	}
+}
+
+// rotationDue - the file is longer than Rotate minutes, the page makes it bigger than RotateSize,
+// or the scheduled show of the podcast is over
+func (r *recorder) rotationDue(next int) bool {
+	if r.dump {
+		return false
+	}
+	now := time.Now()
+	if !r.rotateAt.IsZero() && !now.Before(r.rotateAt) || r.mount.slotChanged(r.slot, now) {
+		return true
+	}
+	r.mux.Lock()
+	size := r.status.Bytes
+	r.mux.Unlock()
+	return r.conf.RotateSize > 0 && size+int64(next) > int64(r.conf.RotateSize)*cMB
+}
+
+// rotationTime - the next rotation after t. Periods are counted from the midnight of the schedule
+// time zone (local by default), so hourly files start at the hour of the wall clock, the day ends
+// with the shorter period
+func (r *recorder) rotationTime(t time.Time, period time.Duration) time.Time {
+	location := time.Local
+	if s := r.mount.Schedule; s != nil && s.location != nil {
+		location = s.location
+	}
+	t = t.In(location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	next := midnight.Add((t.Sub(midnight)/period + 1) * period)
+	if day := midnight.AddDate(0, 0, 1); next.After(day) {
+		next = day
+	}
+	return next
+}
+
+func (r *recorder) writeFile(data []byte) {
+	if r.file == nil || len(data) == 0 {
+		return
+	}
+	n, err := r.file.Write(data)
+	r.mux.Lock()
+	r.status.Bytes += int64(n)
+	r.mux.Unlock()
+	if err != nil {
+		r.mount.logger.Error("Recording of mount %s: %s", r.mount.Name, err.Error())
+		r.closeFile()
+	}
+}
+
+// openFile - new file of the recording, it starts with the header of the format, if it's needed
+func (r *recorder) openFile(c codec, sessionStart bool) error {
+	now := time.Now()
+	name := r.conf.Path
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !r.dump {
+		name = r.fileName(now, c, r.title)
+		flags = os.O_CREATE | os.O_WRONLY | os.O_EXCL
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, flags, 0666)
+	// several files in a second
+	for n := 1; os.IsExist(err) && n < 100; n++ {
+		ext := filepath.Ext(name)
+		f, err = os.OpenFile(strings.TrimSuffix(name, ext)+"-"+strconv.Itoa(n)+ext, flags, 0666)
+	}
+	if err != nil {
+		return err
+	}
+	r.file = f
+	r.wav = false
+	r.slot = r.mount.slotAt(now)
+	r.rotateAt = time.Time{}
+	if r.conf.Rotate > 0 {
+		r.rotateAt = r.rotationTime(now, time.Duration(r.conf.Rotate)*time.Minute)
+	}
+	r.mux.Lock()
+	r.status.File = f.Name()
+	r.status.Started = &now
+	r.status.Bytes = 0
+	r.mux.Unlock()
+	r.mount.logger.Info("Recording of mount %s to %s", r.mount.Name, f.Name())
+
+	if !r.dump {
+		if r.mount.PCM != nil {
+			r.wav = true
+			r.writeFile(r.mount.PCM.wavHeader())
+		}
+		r.mux.Lock()
+		base := r.status.Bytes
+		r.mux.Unlock()
+		r.splitDue = false
+		r.clock = newTrackClock(c, r.mount.PCM, base)
+		r.tracks = []*cueTrack{{Title: r.title, Offset: base}}
+		if r.cueSheet() {
+			r.writeCueSheet(0)
+		}
+		if c == codecOgg && !sessionStart {
+			r.writeAudio(r.oggHeaders)
+		}
+		go r.cleanup(f.Name())
+	}
+	return nil
+}
+
+// closeFile - close the current file, WAV header gets the actual sizes
+func (r *recorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+	if r.wav {
+		if info, err := r.file.Stat(); err == nil && info.Size() <= 0xFFFFFFFF {
+			sizes := make([]byte, 4)
+			binary.LittleEndian.PutUint32(sizes, uint32(info.Size()-8))
+			_, _ = r.file.WriteAt(sizes, 4)
+			binary.LittleEndian.PutUint32(sizes, uint32(info.Size()-44))
+			_, _ = r.file.WriteAt(sizes, 40)
+		}
+	}
+	if err := r.file.Close(); err != nil {
+		r.mount.logger.Error("Recording of mount %s: %s", r.mount.Name, err.Error())
+	}
+	if r.clock != nil && r.cueSheet() {
+		r.writeCueSheet(r.clock.dur)
+	}
+	r.file = nil
+	r.clock = nil
+	r.mux.Lock()
+	r.status.File = ""
+	r.status.Started = nil
+	r.status.Bytes = 0
+	r.mux.Unlock()
+}
+
+// fileName - name of the new file by the pattern
+func (r *recorder) fileName(t time.Time, c codec, title string) string {
+	name := strings.NewReplacer("{mount}", r.mount.Name, "{title}", titleFileName(title), "%Y", t.Format("2006"), "%m", t.Format("01"),
+		"%d", t.Format("02"), "%H", t.Format("15"), "%M", t.Format("04"), "%S", t.Format("05")).Replace(r.conf.Path)
+	if filepath.Ext(name) == "" {
+		switch {
+		case r.mount.PCM != nil:
+			name += ".wav"
+		case c != codecUnknown:
+			name += "." + c.String()
+		default:
+			name += ".bin"
+		}
+	}
+	return name
+}
+
+// recordingPattern - glob pattern of the recordings of the mount
+func (r *recorder) recordingPattern() string {
+	pattern := strings.NewReplacer("{mount}", r.mount.Name, "{title}", "*", "%Y", "*", "%m", "*", "%d", "*", "%H", "*",
+		"%M", "*", "%S", "*").Replace(r.conf.Path)
+	if filepath.Ext(pattern) == "" {
+		pattern += "*"
+	}
+	return pattern
+}
+
+// cleanup - remove old recordings of the pattern by age, count and total size, the current file is kept
+func (r *recorder) cleanup(current string) {
+	conf := r.conf
+	if conf.MaxAge == 0 && conf.MaxFiles == 0 && conf.MaxSize == 0 {
+		return
+	}
+	names, err := filepath.Glob(r.recordingPattern())
+	if err != nil {
+		r.mount.logger.Error("Recording of mount %s: %s", r.mount.Name, err.Error())
+		return
+	}
+	var files []os.FileInfo
+	paths := make(map[os.FileInfo]string)
+	var total int64
+	for _, name := range names {
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() || name == current || strings.EqualFold(filepath.Ext(name), ".cue") {
+			continue
+		}
+		files = append(files, info)
+		paths[info] = name
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	count := len(files) + 1
+	for _, info := range files {
+		old := conf.MaxAge > 0 && time.Since(info.ModTime()) > time.Duration(conf.MaxAge)*24*time.Hour
+		if !old && (conf.MaxFiles == 0 || count <= conf.MaxFiles) && (conf.MaxSize == 0 || total <= int64(conf.MaxSize)*cMB) {
+			continue
+		}
+		if err := os.Remove(paths[info]); err != nil {
+			r.mount.logger.Error("Recording of mount %s: %s", r.mount.Name, err.Error())
+			continue
+		}
+		// CUE sheet goes with its recording
+		_ = os.Remove(cueSheetName(paths[info]))
+		r.mount.logger.Info("Recording %s is removed", paths[info])
+		count--
+		total -= info.Size()
+	}
+}
+
+// oggHeaderPages - header pages (granule position 0) at the beginning of the Ogg stream
+func oggHeaderPages(data []byte) []byte {
+	pos := 0
+	for pos+27 <= len(data) && string(data[pos:pos+4]) == "OggS" && binary.LittleEndian.Uint64(data[pos+6:]) == 0 {
+		segments := int(data[pos+26])
+		if pos+27+segments > len(data) {
+			break
+		}
+		size := 27 + segments
+		for _, s := range data[pos+27 : pos+27+segments] {
+			size += int(s)
+		}
+		if pos+size > len(data) {
+			break
+		}
+		pos += size
+	}
+	return append([]byte(nil), data[:pos]...)
+}
+
+/*
+	recordHandler
+	/admin/record?mount=name|*: GET - state of the recorders, POST - start, DELETE - stop recording
+*/
+func (i *Server) recordHandler(w http.ResponseWriter, r *http.Request) {
+	if !i.checkAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	mounts, err := i.overrideMounts(q["mount"], r.Method == "GET")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var recorders []*recorder
+	var names []string
+	for _, m := range mounts {
+		if m.record != nil {
+			recorders = append(recorders, m.record)
+			names = append(names, m.Name)
+		} else if len(mounts) == 1 {
+			http.Error(w, "mount "+m.Name+" has no recording", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch r.Method {
+	case "POST":
+		i.logger.Audit("record start: mounts=%s by=%s", strings.Join(names, ","), i.getHost(r.RemoteAddr))
+		for _, rec := range recorders {
+			rec.command(recordStart)
+		}
+	case "DELETE":
+		i.logger.Audit("record stop: mounts=%s by=%s", strings.Join(names, ","), i.getHost(r.RemoteAddr))
+		for _, rec := range recorders {
+			rec.command(recordStop)
+		}
+	}
+
+	states := []recordStatus{}
+	for _, rec := range recorders {
+		states = append(states, rec.getStatus())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(states)
+}
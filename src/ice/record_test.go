@@ -0,0 +1,79 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"testing"
+	"time"
+)
+
+// nopLogger - logger of tests
+type nopLogger struct{}
+
+func (nopLogger) Error(format string, v ...interface{})      {}
+func (nopLogger) Debug(format string, v ...interface{})      {}
+func (nopLogger) Info(format string, v ...interface{})       {}
+func (nopLogger) Warning(format string, v ...interface{})    {}
+func (nopLogger) Access(format string, v ...interface{})     {}
+func (nopLogger) Audit(format string, v ...interface{})      {}
+func (nopLogger) Impression(format string, v ...interface{}) {}
+func (nopLogger) Stat(format string, v ...interface{})       {}
+func (nopLogger) Log(format string, v ...interface{})        {}
+func (nopLogger) Close()                                     {}
+
+// TestRecorderQueue - pages are dropped, when the queue is full, control events are kept in order
+func TestRecorderQueue(t *testing.T) {
+	r := newRecorder(&mount{Name: "Test", logger: nopLogger{}}, &recording{Path: "test"}, false)
+
+	for idx := 0; idx < cRecordQueue+10; idx++ {
+		r.write([]byte{byte(idx)})
+	}
+	r.setTitle("title")
+	r.write([]byte{1})
+	r.end()
+
+	if st := r.getStatus(); st.Dropped != 11 {
+		t.Errorf("dropped %d pages, want 11", st.Dropped)
+	}
+	var kinds []recordEventKind
+	for e, ok := r.next(); ok; e, ok = r.next() {
+		kinds = append(kinds, e.kind)
+	}
+	if len(kinds) != cRecordQueue+2 || kinds[cRecordQueue] != recordTitle || kinds[cRecordQueue+1] != recordEnd {
+		t.Errorf("%d events, the last ones %v, want %d, title and end", len(kinds), kinds[len(kinds)-2:], cRecordQueue+2)
+	}
+	r.write([]byte{1})
+	if _, ok := r.next(); !ok {
+		t.Error("the page isn't queued after the queue is drained")
+	}
+}
+
+func TestRotationTime(t *testing.T) {
+	zone := time.FixedZone("UTC+5:30", 5*3600+1800)
+	at := func(hour, min int) time.Time {
+		return time.Date(2020, 3, 10, hour, min, 0, 0, zone)
+	}
+	tests := []struct {
+		name   string
+		now    time.Time
+		period time.Duration
+		next   time.Time
+	}{
+		{"hour", at(10, 20), time.Hour, at(11, 0)},
+		{"at the hour", at(10, 0), time.Hour, at(11, 0)},
+		{"15 minutes", at(10, 20), 15 * time.Minute, at(10, 30)},
+		{"day", at(10, 20), 24 * time.Hour, at(24, 0)},
+		{"7 hours", at(22, 0), 7 * time.Hour, at(24, 0)},
+		{"the other zone", time.Date(2020, 3, 10, 4, 50, 0, 0, time.UTC), time.Hour, at(11, 0)},
+	}
+	s := &schedule{location: zone}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{mount: &mount{Schedule: s}}
+			if next := r.rotationTime(tt.now, tt.period); !next.Equal(tt.next) {
+				t.Errorf("next rotation %v, want %v", next, tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Relay pulls the stream of the other server by HTTP. Icy metadata is requested,
+// it's stripped from the audio and StreamTitle is applied to the mount
+
+const cRelayConnectTimeOut = 10 * time.Second
+
+// relay - reads the remote stream into the mount, until stop is closed or the source is replaced
+func (m *mount) relay(id int64, url string, stop chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Icy-MetaData", "1")
+	req.Header.Set("User-Agent", "PenguinCast relay")
+
+	timer := time.AfterFunc(cRelayConnectTimeOut, cancel)
+	resp, err := http.DefaultClient.Do(req)
+	timer.Stop()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(url + ": " + resp.Status)
+	}
+
+	m.mux.Lock()
+	if ct := resp.Header.Get("Content-Type"); ct > "" && m.PCM == nil {
+		m.ContentType = ct
+	}
+	m.mux.Unlock()
+
+	reader := &icyReader{r: resp.Body, m: m, id: id}
+	reader.metaInt, _ = strconv.Atoi(resp.Header.Get("Icy-Metaint"))
+	reader.left = reader.metaInt
+
+	bytesSent := 0
+	start := time.Now()
+	m.logger.Info("writeMount %s (relay %s)", m.Name, url)
+	m.ingest(id, reader, &bytesSent)
+	m.closeConn(true, &bytesSent, start, req.URL.Host, "SOURCE /"+m.Name+" relay", "-", "-")
+	return nil
+}
+
+// icyReader - audio of the stream with icy metadata, the broken connection is returned as EOF
+type icyReader struct {
+	r       io.Reader
+	m       *mount
+	id      int64
+	metaInt int
+	// audio bytes before the next metadata block
+	left int
+}
+
+func (r *icyReader) Read(p []byte) (int, error) {
+	if r.metaInt > 0 && r.left == 0 {
+		if err := r.readMeta(); err != nil {
+			return 0, io.EOF
+		}
+		r.left = r.metaInt
+	}
+	if r.metaInt > 0 && len(p) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= n
+	if err != nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *icyReader) readMeta() error {
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(r.r, size); err != nil {
+		return err
+	}
+	if size[0] == 0 {
+		return nil
+	}
+	meta := make([]byte, int(size[0])*16)
+	if _, err := io.ReadFull(r.r, meta); err != nil {
+		return err
+	}
+	// metadata is repeated, until the title is changed
+	title := uvoxIcyTitle.FindSubmatch(meta)
+	if title != nil && string(title[1]) != r.m.getStreamTitle() && r.m.isSource(r.id) {
+		r.m.setStreamTitle(string(title[1]))
+	}
+	return nil
+}
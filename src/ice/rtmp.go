@@ -0,0 +1,265 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ssetin/PenguinCast/src/rtmp"
+)
+
+// RTMP ingest: encoders publish to rtmp://host/live/{mount}?key=password, the audio track
+// (AAC or MP3) is written to the mount buffer as ADTS or MP3 stream
+
+const (
+	cRTMPApp              = "live"
+	cRTMPHandshakeTimeOut = 10 * time.Second
+)
+
+// rtmpSocket - RTMP publishing socket
+type rtmpSocket struct {
+	Address string `yaml:"Address,omitempty"`
+	Port    int    `yaml:"Port"`
+	App     string `yaml:"App,omitempty"`
+
+	listener net.Listener
+}
+
+func (s *rtmpSocket) addr() string {
+	return net.JoinHostPort(strings.Trim(s.Address, "[]"), strconv.Itoa(s.Port))
+}
+
+func (s *rtmpSocket) app() string {
+	if s.App == "" {
+		return cRTMPApp
+	}
+	return s.App
+}
+
+// serveRTMP - accept RTMP publishers
+func (i *Server) serveRTMP(s *rtmpSocket) {
+	var err error
+	s.listener, err = net.Listen("tcp", s.addr())
+	if err != nil {
+		panic(err)
+	}
+	i.logger.Log("Started RTMP socket on %s", s.addr())
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			i.logger.Error(err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go i.acceptRTMP(s, conn)
+	}
+}
+
+// acceptRTMP - handshake, connect and publish commands, then the mount is chosen by the stream name
+func (i *Server) acceptRTMP(s *rtmpSocket, conn net.Conn) {
+	defer conn.Close()
+	host := i.getHost(conn.RemoteAddr().String())
+
+	_ = conn.SetDeadline(time.Now().Add(cRTMPHandshakeTimeOut))
+	c := rtmp.NewConn(conn)
+	if err := c.Handshake(); err != nil {
+		i.logger.Error("RTMP source %s: %s", host, err.Error())
+		return
+	}
+	if err := c.ReadPublish(); err != nil {
+		i.logger.Error("RTMP source %s: %s", host, err.Error())
+		return
+	}
+
+	// some encoders put the key to the application name
+	app, query := c.App, c.Query
+	if idx := strings.Index(app, "?"); idx >= 0 {
+		if q, err := url.ParseQuery(app[idx+1:]); err == nil && query.Get("key") == "" {
+			query = q
+		}
+		app = app[:idx]
+	}
+
+	reject := func(reason string) {
+		i.logger.Error("RTMP source %s: %s", host, reason)
+		_ = c.RejectPublish(reason)
+	}
+
+	if strings.Trim(app, "/") != s.app() {
+		reject("unknown application " + app)
+		return
+	}
+	m := i.findMount(c.Name)
+	if m == nil {
+		reject("unknown mount " + c.Name)
+		return
+	}
+	priority := m.checkPassword(query.Get("key"))
+	if priority == 0 {
+		reject("wrong key")
+		return
+	}
+	if !i.checkSources() {
+		reject("Number of sources exceeded")
+		return
+	}
+
+	m.mux.Lock()
+	id, err := m.claimLive(priority)
+	m.mux.Unlock()
+	if err != nil {
+		reject(err.Error())
+		return
+	}
+	defer m.releaseSource(id)
+
+	if err := c.AcceptPublish(); err != nil {
+		i.logger.Error(err.Error())
+		return
+	}
+
+	// metadata is usually sent before the audio, bitrate is needed to start ingest
+	audio := &flvAudio{}
+	pipe := newSourcePipe(m.BitRate, false)
+	defer pipe.Close()
+	for audio.contentType == "" {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			i.logger.Error("RTMP source %s: %s", host, err.Error())
+			return
+		}
+		if err = m.rtmpMessage(id, msg, audio, pipe); err != nil {
+			i.logger.Error("RTMP source %s: %s", host, err.Error())
+			return
+		}
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	m.mux.Lock()
+	if m.source == id {
+		m.ContentType = audio.contentType
+	}
+	m.mux.Unlock()
+
+	bytesSent := 0
+	start := time.Now()
+
+	m.logger.Info("writeMount %s (RTMP)", m.Name)
+	defer m.closeConn(true, &bytesSent, start, host, "SOURCE /"+m.Name+" RTMP", "-", "-")
+
+	go m.rtmpReceive(id, conn, c, audio, pipe)
+	m.ingest(id, pipe, &bytesSent)
+}
+
+// rtmpReceive - read messages of the published stream into the pipe
+func (m *mount) rtmpReceive(id int64, conn net.Conn, c *rtmp.Conn, audio *flvAudio, pipe *sourcePipe) {
+	idleTimeOut := time.Second * time.Duration(m.Server.Options.Limits.SourceIdleTimeOut)
+	defer pipe.CloseWrite()
+
+	for atomic.LoadInt32(&m.Server.Started) == 1 {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeOut))
+		msg, err := c.ReadMessage()
+		if err != nil {
+			if err != rtmp.ErrUnpublished {
+				m.logger.Error(err.Error())
+			}
+			return
+		}
+		if err = m.rtmpMessage(id, msg, audio, pipe); err != nil {
+			if err != io.ErrClosedPipe {
+				m.logger.Error(err.Error())
+			}
+			return
+		}
+	}
+}
+
+func (m *mount) rtmpMessage(id int64, msg *rtmp.Message, audio *flvAudio, pipe *sourcePipe) error {
+	switch msg.Type {
+	case rtmp.TypeAudio:
+		data, err := audio.packet(msg.Data)
+		if err != nil {
+			return err
+		}
+		if _, err = pipe.Write(data); err != nil {
+			return err
+		}
+	case rtmp.TypeDataAMF0:
+		m.rtmpMetadata(id, msg.Data)
+	}
+	return nil
+}
+
+// rtmpMetadata - @setDataFrame/onMetaData: audiodatarate and title, they are ignored for the standby source
+func (m *mount) rtmpMetadata(id int64, data []byte) {
+	values, _ := rtmp.DecodeAMF0(data)
+	if len(values) > 0 && values[0] == "@setDataFrame" {
+		values = values[1:]
+	}
+	if len(values) < 2 || values[0] != "onMetaData" {
+		return
+	}
+	meta, ok := values[1].(rtmp.Object)
+	if !ok || !m.isSource(id) {
+		return
+	}
+	if rate, ok := meta["audiodatarate"].(float64); ok && rate > 0 {
+		m.mux.Lock()
+		m.BitRate = int(rate)
+		m.mux.Unlock()
+	}
+	if title, ok := meta["title"].(string); ok && title > "" {
+		m.setStreamTitle(title)
+	}
+}
+
+// flvAudio - FLV audio tags to ADTS (AAC) or MP3 stream
+type flvAudio struct {
+	asc         []byte
+	contentType string
+}
+
+const (
+	flvSoundMP3    = 2
+	flvSoundAAC    = 10
+	flvSoundMP3Low = 14
+)
+
+func (a *flvAudio) packet(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, nil
+	}
+	switch data[0] >> 4 {
+	case flvSoundAAC:
+		if data[1] == 0 {
+			// sequence header: AudioSpecificConfig
+			if len(data) < 4 {
+				return nil, errors.New("bad AAC sequence header")
+			}
+			a.asc = append([]byte(nil), data[2:4]...)
+			return nil, nil
+		}
+		if a.asc == nil {
+			return nil, nil
+		}
+		a.contentType = "audio/aac"
+		frame := data[2:]
+		return append(adtsHeader(a.asc, len(frame)), frame...), nil
+	case flvSoundMP3, flvSoundMP3Low:
+		a.contentType = "audio/mpeg"
+		return data[1:], nil
+	}
+	return nil, errors.New("unsupported RTMP audio format " + strconv.Itoa(int(data[0]>>4)))
+}
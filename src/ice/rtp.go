@@ -0,0 +1,322 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// RTP output of the mount to unicast or multicast address, paced in real time:
+// MP3 as MPA payload (RFC 2250), AAC as mpeg4-generic AAC-hbr (RFC 3640)
+
+const (
+	cRTPVersion    = 2
+	cRTPPayloadMPA = 14
+	cRTPPayloadAAC = 96
+	cRTPMPAClock   = 90000
+	cRTPMaxPayload = 1400
+	// playout delay and the lag, after which the sender clock is reset
+	cRTPDelay  = time.Second
+	cRTPMaxLag = time.Second
+)
+
+// rtpOutput - RTP sender of the mount
+type rtpOutput struct {
+	Address   string `yaml:"Address"`
+	Port      int    `yaml:"Port"`
+	TTL       int    `yaml:"TTL,omitempty"`
+	Interface string `yaml:"Interface,omitempty"`
+
+	mount  *mount
+	conn   *net.UDPConn
+	dst    *net.UDPAddr
+	origin net.IP
+	done   chan struct{}
+
+	ssrc      uint32
+	seq       uint16
+	timestamp uint32
+	started   time.Time
+
+	// stream parameters for SDP
+	mux        sync.Mutex
+	codec      codec
+	asc        []byte
+	sampleRate int
+	channels   int
+}
+
+func (o *rtpOutput) addr() string {
+	return net.JoinHostPort(o.Address, strconv.Itoa(o.Port))
+}
+
+// open - connect UDP socket, TTL and interface are applied to multicast groups
+func (o *rtpOutput) open(m *mount) error {
+	if o.Address == "" || o.Port <= 0 {
+		return errors.New("RTP output of mount " + m.Name + " needs Address and Port")
+	}
+	addr, err := net.ResolveUDPAddr("udp", o.addr())
+	if err != nil {
+		return err
+	}
+	// SSRC, sequence and timestamp start from random values (RFC 3550), which aren't predictable
+	// by the third party injecting packets to the session
+	random := make([]byte, 10)
+	if _, err = rand.Read(random); err != nil {
+		return err
+	}
+	// the socket is not connected, so ICMP errors don't break sending when nobody listens.
+	// Local address of the route to the destination is used as the SDP origin
+	if probe, err := net.DialUDP("udp", nil, addr); err == nil {
+		o.origin = probe.LocalAddr().(*net.UDPAddr).IP
+		probe.Close()
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+
+	var ifi *net.Interface
+	if o.Interface > "" {
+		if ifi, err = net.InterfaceByName(o.Interface); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if addr.IP.IsMulticast() {
+		if addr.IP.To4() != nil {
+			p := ipv4.NewPacketConn(conn)
+			if o.TTL > 0 {
+				err = p.SetMulticastTTL(o.TTL)
+			}
+			if err == nil && ifi != nil {
+				err = p.SetMulticastInterface(ifi)
+			}
+		} else {
+			p := ipv6.NewPacketConn(conn)
+			if o.TTL > 0 {
+				err = p.SetMulticastHopLimit(o.TTL)
+			}
+			if err == nil && ifi != nil {
+				err = p.SetMulticastInterface(ifi)
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	o.mount = m
+	o.conn = conn
+	o.dst = addr
+	o.done = make(chan struct{})
+	o.ssrc = binary.BigEndian.Uint32(random)
+	o.seq = binary.BigEndian.Uint16(random[4:])
+	o.timestamp = binary.BigEndian.Uint32(random[6:])
+	o.started = time.Now()
+	return nil
+}
+
+// Close - stop sending
+func (o *rtpOutput) Close() {
+	if o.done != nil {
+		close(o.done)
+	}
+}
+
+// run - read mount buffer by frames and send them in real time
+func (o *rtpOutput) run() {
+	reader := o.mount.newFrameReader()
+	defer reader.Close()
+	defer o.conn.Close()
+
+	// send time of the next frame is clock + sent
+	var clock time.Time
+	var sent time.Duration
+
+	for {
+		select {
+		case <-o.done:
+			return
+		default:
+		}
+
+		frame, f, c := reader.Next(time.Second)
+		if frame == nil {
+			continue
+		}
+		if c != codecMP3 && c != codecAAC {
+			continue
+		}
+		o.setStream(c, frame, f)
+
+		// frames come from the buffer once per second, so they are sent with the delay
+		// of one buffer page and spread over time. Clock is reset after the source gap
+		now := time.Now()
+		marker := false
+		if clock.IsZero() || now.Sub(clock.Add(sent)) > cRTPMaxLag {
+			start := now.Add(cRTPDelay)
+			if !clock.IsZero() {
+				o.timestamp += uint32(start.Sub(clock.Add(sent)).Seconds() * float64(o.clockRate(c, f)))
+			}
+			clock, sent = start, 0
+			marker = true
+		}
+		if wait := clock.Add(sent).Sub(now); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		if err := o.send(c, frame, marker); err != nil {
+			o.mount.logger.Error("RTP %s: %s", o.addr(), err.Error())
+		}
+		sent += f.Duration()
+		o.timestamp += uint32(f.Samples * o.clockRate(c, f) / f.SampleRate)
+	}
+}
+
+func (o *rtpOutput) clockRate(c codec, f audioFrame) int {
+	if c == codecMP3 {
+		return cRTPMPAClock
+	}
+	return f.SampleRate
+}
+
+func (o *rtpOutput) setStream(c codec, frame []byte, f audioFrame) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.codec = c
+	o.sampleRate = f.SampleRate
+	o.channels = f.Channels
+	if c == codecAAC {
+		o.asc, _ = adtsConfig(frame)
+	}
+}
+
+func (o *rtpOutput) header(payloadType int, marker bool) []byte {
+	h := make([]byte, 12, 12+cRTPMaxPayload)
+	h[0] = cRTPVersion << 6
+	h[1] = byte(payloadType)
+	if marker {
+		h[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(h[2:], o.seq)
+	binary.BigEndian.PutUint32(h[4:], o.timestamp)
+	binary.BigEndian.PutUint32(h[8:], o.ssrc)
+	o.seq++
+	return h
+}
+
+// send - one frame in one or several (fragmented) packets
+func (o *rtpOutput) send(c codec, frame []byte, marker bool) error {
+	if c == codecAAC {
+		_, headerLen := adtsConfig(frame)
+		frame = frame[headerLen:]
+	}
+	for offset := 0; offset < len(frame); offset += cRTPMaxPayload {
+		end := offset + cRTPMaxPayload
+		if end > len(frame) {
+			end = len(frame)
+		}
+		var p []byte
+		if c == codecMP3 {
+			// MBZ and fragmentation offset
+			p = o.header(cRTPPayloadMPA, marker && offset == 0)
+			p = append(p, 0, 0, byte(offset>>8), byte(offset))
+		} else {
+			// AU-headers-length in bits, AU-size (13 bits) and AU-index (3 bits).
+			// Marker is set on the last fragment of the access unit
+			p = o.header(cRTPPayloadAAC, end == len(frame))
+			p = append(p, 0, 16, byte(len(frame)>>5), byte(len(frame)<<3))
+		}
+		p = append(p, frame[offset:end]...)
+		if _, err := o.conn.WriteToUDP(p, o.dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sdp - session description of the stream, empty when the codec is not known yet
+func (o *rtpOutput) sdp() string {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	if o.codec == codecUnknown {
+		return ""
+	}
+
+	ip := net.ParseIP(o.Address)
+	family := "IP4"
+	if ip != nil && ip.To4() == nil {
+		family = "IP6"
+	}
+	origin, originFamily := "0.0.0.0", "IP4"
+	if o.origin != nil {
+		origin = o.origin.String()
+		if o.origin.To4() == nil {
+			originFamily = "IP6"
+		}
+	}
+	connection := o.Address
+	if ip != nil && ip.IsMulticast() && family == "IP4" {
+		ttl := o.TTL
+		if ttl <= 0 {
+			ttl = 1
+		}
+		connection += "/" + strconv.Itoa(ttl)
+	}
+
+	o.mount.mux.Lock()
+	name := o.mount.Name
+	if o.mount.StreamName > "" {
+		name = o.mount.StreamName
+	}
+	description := o.mount.Description
+	o.mount.mux.Unlock()
+
+	s := "v=0\r\n"
+	s += fmt.Sprintf("o=- %d 1 IN %s %s\r\n", o.started.Unix(), originFamily, origin)
+	s += "s=" + name + "\r\n"
+	if description > "" {
+		s += "i=" + description + "\r\n"
+	}
+	s += fmt.Sprintf("c=IN %s %s\r\n", family, connection)
+	s += "t=0 0\r\n"
+	if o.codec == codecMP3 {
+		s += fmt.Sprintf("m=audio %d RTP/AVP %d\r\n", o.Port, cRTPPayloadMPA)
+		s += fmt.Sprintf("a=rtpmap:%d MPA/%d\r\n", cRTPPayloadMPA, cRTPMPAClock)
+	} else {
+		s += fmt.Sprintf("m=audio %d RTP/AVP %d\r\n", o.Port, cRTPPayloadAAC)
+		s += fmt.Sprintf("a=rtpmap:%d mpeg4-generic/%d/%d\r\n", cRTPPayloadAAC, o.sampleRate, o.channels)
+		s += fmt.Sprintf("a=fmtp:%d streamtype=5; profile-level-id=15; mode=AAC-hbr; config=%s; "+
+			"sizeLength=13; indexLength=3; indexDeltaLength=3\r\n", cRTPPayloadAAC, hex.EncodeToString(o.asc))
+	}
+	s += "a=recvonly\r\n"
+	return s
+}
+
+// sdpHandler - /{mount}.sdp
+func (m *mount) sdpHandler(w http.ResponseWriter, r *http.Request) {
+	sdp := m.RTP.sdp()
+	if sdp == "" {
+		http.Error(w, "Stream is not available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Content-Disposition", "inline; filename=\""+m.Name+".sdp\"")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(sdp))
+}
@@ -0,0 +1,448 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RTP input of the mount from unicast or multicast socket: MPA (RFC 2250) or AAC
+// mpeg4-generic (RFC 3640). Packets are reordered in the jitter buffer, missing ones are
+// skipped after Latency. Mount is taken by the first packet and released by the source idle timeout.
+// The source is locked to the SSRC of the first packet, until it's silent for the idle timeout
+
+const (
+	cRTPSourceLatency = 200
+	cRTPSourceTick    = 10 * time.Millisecond
+	cRTPMaxPacket     = 65536
+	// sequence jump, which is treated as the sender restart
+	cRTPMaxDropout = 3000
+	// received sequence numbers, which are remembered to tell duplicates from late packets
+	cRTPHistory = 1024
+)
+
+type rtpPacket struct {
+	payloadType byte
+	marker      bool
+	seq         uint16
+	timestamp   uint32
+	ssrc        uint32
+	payload     []byte
+	arrived     time.Time
+}
+
+// rtpStats - packet accounting of the current RTP source
+type rtpStats struct {
+	Received   int
+	Lost       int
+	Late       int
+	Duplicates int
+	Reordered  int
+	// the source is faster than the bitrate
+	Dropped int
+	// packets of other senders and SSRCs
+	Rejected int
+}
+
+// rtpInput - RTP source of the mount
+type rtpInput struct {
+	Address   string `yaml:"Address,omitempty"`
+	Port      int    `yaml:"Port"`
+	Interface string `yaml:"Interface,omitempty"`
+	Latency   int    `yaml:"Latency,omitempty"`
+	Config    string `yaml:"Config,omitempty"`
+	// Senders - addresses and networks (CIDR) packets are accepted from, any by default
+	Senders []string `yaml:"Senders,omitempty"`
+
+	mount   *mount
+	conn    *net.UDPConn
+	asc     []byte
+	senders []*net.IPNet
+
+	// SSRC of the current sender and its last packet
+	ssrc     uint32
+	locked   bool
+	lastSeen time.Time
+
+	// jitter buffer
+	packets map[uint16]*rtpPacket
+	next    uint16
+	highest uint16
+	synced  bool
+	au      []byte
+	history [cRTPHistory]int32
+
+	mux    sync.Mutex
+	stats  rtpStats
+	pipe   *sourcePipe
+	active bool
+}
+
+func (s *rtpInput) addr() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.Port))
+}
+
+func (s *rtpInput) latency() time.Duration {
+	if s.Latency <= 0 {
+		return cRTPSourceLatency * time.Millisecond
+	}
+	return time.Duration(s.Latency) * time.Millisecond
+}
+
+// allowed - whether the packet of the host is accepted
+func (s *rtpInput) allowed(ip net.IP) bool {
+	if len(s.senders) == 0 {
+		return true
+	}
+	for _, n := range s.senders {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSenders - single addresses are treated as networks of one host
+func parseSenders(senders []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, sender := range senders {
+		if _, n, err := net.ParseCIDR(sender); err == nil {
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(sender)
+		if ip == nil {
+			return nil, errors.New("bad sender " + sender)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// open - bind the socket, multicast group is joined on the given or default interface
+func (s *rtpInput) open(m *mount) error {
+	if s.Port <= 0 {
+		return errors.New("RTP source of mount " + m.Name + " has no port")
+	}
+	if s.Config > "" {
+		asc, err := hex.DecodeString(s.Config)
+		if err != nil || len(asc) < 2 {
+			return errors.New("RTP source of mount " + m.Name + " has bad AAC config")
+		}
+		s.asc = asc
+	}
+	senders, err := parseSenders(s.Senders)
+	if err != nil {
+		return errors.New("RTP source of mount " + m.Name + ": " + err.Error())
+	}
+	s.senders = senders
+	addr, err := net.ResolveUDPAddr("udp", s.addr())
+	if err != nil {
+		return err
+	}
+
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if s.Interface > "" {
+			if ifi, err = net.InterfaceByName(s.Interface); err != nil {
+				return err
+			}
+		}
+		s.conn, err = net.ListenMulticastUDP("udp", ifi, addr)
+	} else {
+		s.conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	_ = s.conn.SetReadBuffer(1 << 20)
+
+	s.mount = m
+	s.packets = make(map[uint16]*rtpPacket)
+	return nil
+}
+
+// Close - stop receiving
+func (s *rtpInput) Close() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+// Stats - packet accounting for the status page
+func (s *rtpInput) Stats() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	st := s.stats
+	loss := 0.0
+	if st.Received+st.Lost > 0 {
+		loss = float64(st.Lost) * 100 / float64(st.Received+st.Lost)
+	}
+	return fmt.Sprintf("received %d, lost %d (%.2f%%), late %d, duplicates %d, reordered %d, dropped %d, rejected %d",
+		st.Received, st.Lost, loss, st.Late, st.Duplicates, st.Reordered, st.Dropped, st.Rejected)
+}
+
+func parseRTPPacket(b []byte) (*rtpPacket, bool) {
+	if len(b) < 12 || b[0]>>6 != cRTPVersion {
+		return nil, false
+	}
+	p := &rtpPacket{
+		payloadType: b[1] & 0x7F,
+		marker:      b[1]&0x80 != 0,
+		seq:         binary.BigEndian.Uint16(b[2:]),
+		timestamp:   binary.BigEndian.Uint32(b[4:]),
+		ssrc:        binary.BigEndian.Uint32(b[8:]),
+	}
+	start := 12 + 4*int(b[0]&0x0F)
+	end := len(b)
+	if b[0]&0x20 != 0 {
+		// padding
+		end -= int(b[end-1])
+	}
+	if b[0]&0x10 != 0 {
+		// header extension
+		if len(b) < start+4 {
+			return nil, false
+		}
+		start += 4 + 4*int(binary.BigEndian.Uint16(b[start+2:]))
+	}
+	if start > end {
+		return nil, false
+	}
+	p.payload = append([]byte(nil), b[start:end]...)
+	return p, true
+}
+
+// run - receive packets and release them from the jitter buffer in sequence order
+func (s *rtpInput) run() {
+	b := make([]byte, cRTPMaxPacket)
+	defer func() {
+		s.mux.Lock()
+		if s.pipe != nil {
+			s.pipe.CloseWrite()
+		}
+		s.mux.Unlock()
+	}()
+
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(cRTPSourceTick))
+		n, from, err := s.conn.ReadFromUDP(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+				s.mount.logger.Error("RTP source %s: %s", s.addr(), err.Error())
+				time.Sleep(time.Second)
+			}
+		} else if !s.allowed(from.IP) {
+			s.mux.Lock()
+			s.stats.Rejected++
+			s.mux.Unlock()
+		} else if p, ok := parseRTPPacket(b[:n]); ok {
+			p.arrived = time.Now()
+			s.add(p)
+		}
+		s.release()
+	}
+}
+
+// seqDiff - signed distance between sequence numbers
+func seqDiff(a, b uint16) int {
+	return int(int16(a - b))
+}
+
+func (s *rtpInput) add(p *rtpPacket) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.locked && p.ssrc != s.ssrc {
+		idle := time.Second * time.Duration(s.mount.Server.Options.Limits.SourceIdleTimeOut)
+		if p.arrived.Sub(s.lastSeen) < idle {
+			s.stats.Rejected++
+			return
+		}
+		s.locked = false
+	}
+	if !s.locked {
+		s.ssrc, s.locked, s.synced = p.ssrc, true, false
+	}
+	s.lastSeen = p.arrived
+
+	if !s.synced || abs(seqDiff(p.seq, s.next)) > cRTPMaxDropout {
+		// the first packet or the sender restart
+		s.packets = make(map[uint16]*rtpPacket)
+		s.next, s.highest, s.synced = p.seq, p.seq, true
+		s.au = nil
+		s.history = [cRTPHistory]int32{}
+	}
+	seen := s.history[p.seq%cRTPHistory] == int32(p.seq)+1
+	switch {
+	case seen:
+		s.stats.Duplicates++
+		return
+	case seqDiff(p.seq, s.next) < 0:
+		s.stats.Late++
+		return
+	}
+	s.history[p.seq%cRTPHistory] = int32(p.seq) + 1
+	if seqDiff(p.seq, s.highest) < 0 {
+		s.stats.Reordered++
+	} else {
+		s.highest = p.seq
+	}
+	s.stats.Received++
+	s.packets[p.seq] = p
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// release - pass the packets in order, the gap is skipped when the packet after it waits longer than latency
+func (s *rtpInput) release() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for len(s.packets) > 0 {
+		p := s.packets[s.next]
+		if p == nil {
+			// the earliest packet after the gap
+			var first *rtpPacket
+			for _, q := range s.packets {
+				if first == nil || seqDiff(q.seq, first.seq) < 0 {
+					first = q
+				}
+			}
+			if time.Since(first.arrived) < s.latency() {
+				return
+			}
+			s.stats.Lost += seqDiff(first.seq, s.next)
+			s.au = nil
+			p = first
+		}
+		delete(s.packets, p.seq)
+		s.next = p.seq + 1
+		s.depacketize(p)
+	}
+}
+
+// depacketize - write audio of the packet to the mount
+func (s *rtpInput) depacketize(p *rtpPacket) {
+	var data []byte
+	var contentType string
+
+	switch {
+	case p.payloadType == cRTPPayloadMPA:
+		// MBZ and fragmentation offset
+		if len(p.payload) <= 4 {
+			return
+		}
+		data, contentType = p.payload[4:], "audio/mpeg"
+	case s.asc != nil:
+		data, contentType = s.aacFrames(p), "audio/aac"
+	default:
+		return
+	}
+	if len(data) == 0 || !s.acquire(contentType) {
+		return
+	}
+	if _, err := s.pipe.Write(data); err == errSourceTooFast {
+		s.stats.Dropped++
+	}
+}
+
+// aacFrames - AAC-hbr access units of the packet as ADTS frames, fragments are collected until the marker
+func (s *rtpInput) aacFrames(p *rtpPacket) []byte {
+	if len(p.payload) < 2 {
+		return nil
+	}
+	headersLen := (int(binary.BigEndian.Uint16(p.payload)) + 7) / 8
+	if len(p.payload) < 2+headersLen {
+		return nil
+	}
+	headers, data := p.payload[2:2+headersLen], p.payload[2+headersLen:]
+
+	var out []byte
+	for idx := 0; idx+1 < len(headers); idx += 2 {
+		size := int(binary.BigEndian.Uint16(headers[idx:]) >> 3)
+		if size > len(data) {
+			// fragment of the access unit
+			s.au = append(s.au, data...)
+			if p.marker {
+				if len(s.au) == size {
+					out = append(out, adtsHeader(s.asc, size)...)
+					out = append(out, s.au...)
+				}
+				s.au = nil
+			}
+			break
+		}
+		out = append(out, adtsHeader(s.asc, size)...)
+		out = append(out, data[:size]...)
+		data = data[size:]
+	}
+	return out
+}
+
+// acquire - take the mount for the RTP source, if there is no other source
+func (s *rtpInput) acquire(contentType string) bool {
+	if s.active {
+		return true
+	}
+	m := s.mount
+	if atomic.LoadInt32(&m.Server.Started) == 0 {
+		return false
+	}
+	m.mux.Lock()
+	id, err := m.claimLive(cPrimaryPriority)
+	if err != nil {
+		m.mux.Unlock()
+		return false
+	}
+	if m.source == id {
+		m.ContentType = contentType
+	}
+	m.mux.Unlock()
+
+	s.active = true
+	s.pipe = newSourcePipe(m.BitRate, true)
+	go s.ingest(id, s.pipe)
+	return true
+}
+
+func (s *rtpInput) ingest(id int64, pipe *sourcePipe) {
+	m := s.mount
+	bytesSent := 0
+	start := time.Now()
+
+	m.logger.Info("writeMount %s (RTP %s)", m.Name, s.addr())
+	m.ingest(id, pipe, &bytesSent)
+	_ = pipe.Close()
+	m.logger.Info("RTP source %s of mount %s: %s", s.addr(), m.Name, s.Stats())
+	m.closeConn(true, &bytesSent, start, s.addr(), "SOURCE /"+m.Name+" RTP", "-", "-")
+	m.releaseSource(id)
+
+	s.mux.Lock()
+	s.active = false
+	s.pipe = nil
+	s.locked = false
+	s.stats = rtpStats{}
+	s.mux.Unlock()
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRTPSenders(t *testing.T) {
+	tests := []struct {
+		name    string
+		senders []string
+		ip      string
+		allowed bool
+		err     bool
+	}{
+		{"any", nil, "192.0.2.1", true, false},
+		{"address", []string{"192.0.2.1"}, "192.0.2.1", true, false},
+		{"other address", []string{"192.0.2.1"}, "192.0.2.2", false, false},
+		{"network", []string{"192.0.2.0/24"}, "192.0.2.200", true, false},
+		{"other network", []string{"192.0.2.0/24"}, "198.51.100.1", false, false},
+		{"mapped address", []string{"192.0.2.1"}, "::ffff:192.0.2.1", true, false},
+		{"IPv6 address", []string{"2001:db8::1"}, "2001:db8::1", true, false},
+		{"other IPv6 address", []string{"2001:db8::1"}, "2001:db8::2", false, false},
+		{"bad sender", []string{"host"}, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			senders, err := parseSenders(tt.senders)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			s := &rtpInput{senders: senders}
+			if allowed := s.allowed(net.ParseIP(tt.ip)); allowed != tt.allowed {
+				t.Errorf("%s is allowed %v, want %v", tt.ip, allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+// TestRTPSSRCLock - packets of the other SSRC are rejected, until the sender is silent for the idle timeout
+func TestRTPSSRCLock(t *testing.T) {
+	srv := &Server{}
+	srv.Options.Limits.SourceIdleTimeOut = 10
+	s := &rtpInput{mount: &mount{Server: srv}, packets: make(map[uint16]*rtpPacket)}
+
+	start := time.Now()
+	s.add(&rtpPacket{ssrc: 1, seq: 100, arrived: start})
+	s.add(&rtpPacket{ssrc: 2, seq: 5000, arrived: start.Add(time.Second)})
+	s.add(&rtpPacket{ssrc: 1, seq: 101, arrived: start.Add(2 * time.Second)})
+	if s.stats.Received != 2 || s.stats.Rejected != 1 || s.ssrc != 1 {
+		t.Fatalf("received %d, rejected %d, SSRC %d, want 2, 1, 1", s.stats.Received, s.stats.Rejected, s.ssrc)
+	}
+
+	s.add(&rtpPacket{ssrc: 2, seq: 5000, arrived: start.Add(13 * time.Second)})
+	if s.stats.Received != 3 || s.ssrc != 2 || s.next != 5000 {
+		t.Errorf("received %d, SSRC %d, next %d after the timeout, want 3, 2, 5000", s.stats.Received, s.ssrc, s.next)
+	}
+}
@@ -0,0 +1,438 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Scheduler switches the mount by the weekly calendar: live source, playlist, relay or silence.
+// Live sources are accepted only in live slots and when there is no slot. When the live source
+// doesn't show up, or the programme fails, the slot Fallback is played, then the schedule Fallback.
+// The live source takes the mount back from the fallback, the failed programme is retried later
+
+const (
+	cProgrammeLive     = "live"
+	cProgrammePlaylist = "playlist"
+	cProgrammeRelay    = "relay"
+	cProgrammeSilence  = "silence"
+	// pause before the failed programme is started again
+	cScheduleRetry = 30 * time.Second
+	// silence page of the PCM mount
+	cSilencePCMDuration = 100 * time.Millisecond
+)
+
+var scheduleDays = []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// programme - what the mount plays
+type programme struct {
+	Name    string `yaml:"Name,omitempty"`
+	Type    string `yaml:"Type"`
+	Path    string `yaml:"Path,omitempty"`
+	Shuffle bool   `yaml:"Shuffle,omitempty"`
+	URL     string `yaml:"URL,omitempty"`
+}
+
+// scheduleSlot - weekly time slot of the programme, End before Start means the slot passes midnight
+type scheduleSlot struct {
+	programme `yaml:",inline"`
+	Days      []string   `yaml:"Days,omitempty"`
+	Start     string     `yaml:"Start"`
+	End       string     `yaml:"End"`
+	Fallback  *programme `yaml:"Fallback,omitempty"`
+
+	days       [7]bool
+	start, end int
+}
+
+// schedule - weekly calendar of the mount
+type schedule struct {
+	TimeZone string          `yaml:"TimeZone,omitempty"`
+	Slots    []*scheduleSlot `yaml:"Slots"`
+	Fallback *programme      `yaml:"Fallback,omitempty"`
+
+	mount    *mount
+	location *time.Location
+	done     chan struct{}
+
+	mux     sync.Mutex
+	running *programmeRun
+	retry   map[*programme]time.Time
+}
+
+// programmeRun - the programme, which is on air
+type programmeRun struct {
+	programme *programme
+	id        int64
+	stop      chan struct{}
+	done      chan struct{}
+	// finished by itself, not stopped or replaced
+	failed bool
+}
+
+func (p *programme) title() string {
+	if p.Name > "" {
+		return p.Name
+	}
+	return p.Type
+}
+
+func (p *programme) validate(live bool) error {
+	switch p.Type {
+	case cProgrammeLive:
+		if !live {
+			return errors.New("fallback can't be live")
+		}
+	case cProgrammePlaylist:
+		if p.Path == "" {
+			return errors.New("playlist programme has no Path")
+		}
+		if _, err := os.Stat(p.Path); err != nil {
+			return err
+		}
+	case cProgrammeRelay:
+		if p.URL == "" {
+			return errors.New("relay programme has no URL")
+		}
+	case cProgrammeSilence:
+	default:
+		return errors.New("unknown programme type " + p.Type)
+	}
+	return nil
+}
+
+// parseClock - minutes of the day from HH:MM, 24:00 is the end of the day
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		h, errH := strconv.Atoi(parts[0])
+		m, errM := strconv.Atoi(parts[1])
+		if errH == nil && errM == nil && h >= 0 && m >= 0 && m < 60 && h*60+m <= 24*60 {
+			return h*60 + m, nil
+		}
+	}
+	return 0, errors.New("bad time " + s + ", HH:MM is expected")
+}
+
+// parseDays - day names (Mon, tuesday) and ranges (Mon-Fri), empty list means every day
+func parseDays(names []string) ([7]bool, error) {
+	var days [7]bool
+	dayIndex := func(name string) int {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for idx, day := range scheduleDays {
+			if len(name) >= 3 && strings.HasPrefix(day, name) {
+				return idx
+			}
+		}
+		return -1
+	}
+	if len(names) == 0 {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+	for _, name := range names {
+		bounds := strings.SplitN(name, "-", 2)
+		from := dayIndex(bounds[0])
+		to := from
+		if len(bounds) == 2 {
+			to = dayIndex(bounds[1])
+		}
+		if from < 0 || to < 0 {
+			return days, errors.New("bad day " + name)
+		}
+		for idx := from; ; idx = (idx + 1) % 7 {
+			days[idx] = true
+			if idx == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func (s *schedule) init(m *mount) error {
+	fail := func(err error) error {
+		return errors.New("schedule of mount " + m.Name + ": " + err.Error())
+	}
+	s.location = time.Local
+	if s.TimeZone > "" {
+		location, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return fail(err)
+		}
+		s.location = location
+	}
+	for _, slot := range s.Slots {
+		var err error
+		if slot.days, err = parseDays(slot.Days); err != nil {
+			return fail(err)
+		}
+		if slot.start, err = parseClock(slot.Start); err != nil {
+			return fail(err)
+		}
+		if slot.end, err = parseClock(slot.End); err != nil {
+			return fail(err)
+		}
+		if err = slot.validate(true); err != nil {
+			return fail(err)
+		}
+		if slot.Fallback != nil {
+			if err = slot.Fallback.validate(false); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if s.Fallback != nil {
+		if err := s.Fallback.validate(false); err != nil {
+			return fail(err)
+		}
+	}
+	s.mount = m
+	s.done = make(chan struct{})
+	s.retry = make(map[*programme]time.Time)
+	return nil
+}
+
+// Close - stop the scheduler and its programme
+func (s *schedule) Close() {
+	if s.done != nil {
+		close(s.done)
+	}
+}
+
+// contains - whether the slot is on air at the time
+func (slot *scheduleSlot) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	if slot.start < slot.end {
+		return slot.days[day] && minute >= slot.start && minute < slot.end
+	}
+	// passes midnight
+	return slot.days[day] && minute >= slot.start || slot.days[(day+6)%7] && minute < slot.end
+}
+
+// slotAt - the first slot, which contains the time
+func (s *schedule) slotAt(t time.Time) *scheduleSlot {
+	t = t.In(s.location)
+	for _, slot := range s.Slots {
+		if slot.contains(t) {
+			return slot
+		}
+	}
+	return nil
+}
+
+// liveAllowed - live source is accepted in the live slot and out of slots
+func (s *schedule) liveAllowed(t time.Time) bool {
+	slot := s.slotAt(t)
+	return slot == nil || slot.Type == cProgrammeLive
+}
+
+// candidates - programmes of the slot by priority
+func (s *schedule) candidates(slot *scheduleSlot) []*programme {
+	var list []*programme
+	if slot != nil {
+		if slot.Type != cProgrammeLive {
+			list = append(list, &slot.programme)
+		}
+		if slot.Fallback != nil {
+			list = append(list, slot.Fallback)
+		}
+	}
+	if s.Fallback != nil {
+		list = append(list, s.Fallback)
+	}
+	return list
+}
+
+// programmeAt - the programme to play, nil when the live source is on air or there is nothing to play
+func (s *schedule) programmeAt(t time.Time) *programme {
+	slot := s.slotAt(t)
+	if slot == nil || slot.Type == cProgrammeLive {
+		m := s.mount
+		m.mux.Lock()
+		live := m.State.Started && (m.sourceKind == sourceLive || m.sourceKind == sourceGrace)
+		m.mux.Unlock()
+		if live {
+			return nil
+		}
+	}
+	for _, p := range s.candidates(slot) {
+		if t.After(s.retry[p]) {
+			return p
+		}
+	}
+	return nil
+}
+
+// run - check the calendar every second
+func (s *schedule) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			s.mux.Lock()
+			if s.running != nil {
+				s.running.Stop(s.mount)
+				s.running = nil
+			}
+			s.mux.Unlock()
+			return
+		case now := <-ticker.C:
+			if atomic.LoadInt32(&s.mount.Server.Started) == 1 {
+				s.tick(now)
+			}
+		}
+	}
+}
+
+func (s *schedule) tick(now time.Time) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.running != nil {
+		select {
+		case <-s.running.done:
+			if s.running.failed {
+				s.mount.logger.Error("Schedule of mount %s: %s is failed", s.mount.Name, s.running.programme.title())
+				s.retry[s.running.programme] = now.Add(cScheduleRetry)
+			}
+			s.running = nil
+		default:
+		}
+	}
+
+	want := s.programmeAt(now)
+	if s.running != nil && s.running.programme == want {
+		return
+	}
+	// the next programme takes the mount over from the previous one without a gap
+	previous := s.running
+	s.running = nil
+	if want != nil {
+		s.running = s.start(want)
+	}
+	if previous != nil {
+		previous.Stop(s.mount)
+	}
+}
+
+// start - take the mount and play the programme
+func (s *schedule) start(p *programme) *programmeRun {
+	m := s.mount
+	m.mux.Lock()
+	id, _ := m.claimSource(sourceScheduled)
+	m.mux.Unlock()
+	m.logger.Info("Schedule of mount %s: %s (%s)", m.Name, p.title(), p.Type)
+
+	r := &programmeRun{programme: p, id: id, stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		var err error
+		switch p.Type {
+		case cProgrammePlaylist:
+			s.playlist(r)
+		case cProgrammeRelay:
+			err = m.relay(r.id, p.URL, r.stop)
+		case cProgrammeSilence:
+			err = s.silence(r)
+		}
+		if err != nil {
+			m.logger.Error("Schedule of mount %s: %s", m.Name, err.Error())
+		}
+		select {
+		case <-r.stop:
+		default:
+			r.failed = m.isSource(r.id)
+		}
+		m.releaseSource(r.id)
+	}()
+	return r
+}
+
+// Stop - stop the programme, the mount is released, if nobody took it over
+func (r *programmeRun) Stop(m *mount) {
+	close(r.stop)
+	m.releaseSource(r.id)
+}
+
+// paced - auto-DJ, which is used to pace frames of the programme
+func (s *schedule) paced(r *programmeRun, path string) *autoDJ {
+	d := &autoDJ{Path: path, source: r.id}
+	d.pacer = pacer{mount: s.mount, done: r.stop, write: d.writeSource}
+	return d
+}
+
+func (s *schedule) playlist(r *programmeRun) {
+	m := s.mount
+	d := s.paced(r, r.programme.Path)
+	d.Shuffle = r.programme.Shuffle
+	start := time.Now()
+	m.Server.incSources()
+	m.logger.Info("writeMount %s (playlist %s)", m.Name, d.Path)
+	d.serve()
+	m.closeConn(true, &d.bytesSent, start, "-", "SOURCE /"+m.Name+" playlist", "-", "-")
+}
+
+// silence - silent frames in the format of the mount, MP3 when there was no stream yet
+func (s *schedule) silence(r *programmeRun) error {
+	m := s.mount
+	d := s.paced(r, "")
+	frame, dur, err := m.silence()
+	if err != nil {
+		return err
+	}
+	m.setStreamTitle(r.programme.Name)
+
+	start := time.Now()
+	m.Server.incSources()
+	m.logger.Info("writeMount %s (silence)", m.Name)
+	for d.add(frame, dur) {
+		// until stopped or replaced
+	}
+	m.closeConn(true, &d.bytesSent, start, "-", "SOURCE /"+m.Name+" silence", "-", "-")
+	return nil
+}
+
+// Current - the slot and the programme, which is on air
+func (s *schedule) Current() string {
+	slot := s.slotAt(time.Now())
+	current := "no programme"
+	if slot != nil {
+		current = slot.title()
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.running != nil && (slot == nil || s.running.programme != &slot.programme) {
+		current += ", on air: " + s.running.programme.title()
+	}
+	return current
+}
+
+// Next - the next slot and its start time within a week
+func (s *schedule) Next() string {
+	return s.nextAt(time.Now())
+}
+
+func (s *schedule) nextAt(now time.Time) string {
+	now = now.In(s.location)
+	current := s.slotAt(now)
+	t := now.Truncate(time.Minute)
+	for step := 0; step <= 7*24*60; step++ {
+		t = t.Add(time.Minute)
+		if slot := s.slotAt(t); slot != current {
+			if slot == nil {
+				return "no programme at " + t.Format("Mon 15:04")
+			}
+			return slot.title() + " at " + t.Format("Mon 15:04")
+		}
+	}
+	return ""
+}
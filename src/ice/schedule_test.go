@@ -0,0 +1,165 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDays(t *testing.T) {
+	all := [7]bool{true, true, true, true, true, true, true}
+	tests := []struct {
+		name string
+		days []string
+		want [7]bool
+		err  bool
+	}{
+		{"every day", nil, all, false},
+		{"one day", []string{"Mon"}, [7]bool{false, true}, false},
+		{"full names", []string{"tuesday", "Thursday"}, [7]bool{false, false, true, false, true}, false},
+		{"Mon-Fri", []string{"Mon-Fri"}, [7]bool{false, true, true, true, true, true, false}, false},
+		{"Sat-Mon", []string{"Sat-Mon"}, [7]bool{true, true, false, false, false, false, true}, false},
+		{"range and day", []string{"Mon-Tue", " Sun "}, [7]bool{true, true, true}, false},
+		{"Sun-Sat", []string{"Sun-Sat"}, all, false},
+		{"short name", []string{"Mo"}, [7]bool{}, true},
+		{"unknown day", []string{"Mon-Fry"}, [7]bool{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days, err := parseDays(tt.days)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if !tt.err && days != tt.want {
+				t.Errorf("days %v, want %v", days, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		clock  string
+		minute int
+		err    bool
+	}{
+		{"00:00", 0, false},
+		{"9:30", 570, false},
+		{"24:00", 1440, false},
+		{"24:01", 0, true},
+		{"12:60", 0, true},
+		{"-1:00", 0, true},
+		{"12", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.clock, func(t *testing.T) {
+			minute, err := parseClock(tt.clock)
+			if (err != nil) != tt.err || minute != tt.minute {
+				t.Errorf("parseClock(%s) = %d, %v, want %d, error %v", tt.clock, minute, err, tt.minute, tt.err)
+			}
+		})
+	}
+}
+
+// scheduleZone - fixed zone of the tests, 2020-03-09 is Monday
+var scheduleZone = time.FixedZone("UTC+3", 3*3600)
+
+func scheduleTime(day, hour, min int) time.Time {
+	return time.Date(2020, 3, 8+day, hour, min, 0, 0, scheduleZone)
+}
+
+func testSlot(t *testing.T, name string, days []string, start, end string) *scheduleSlot {
+	slot := &scheduleSlot{programme: programme{Name: name, Type: cProgrammeLive}, Days: days, Start: start, End: end}
+	var err error
+	if slot.days, err = parseDays(days); err != nil {
+		t.Fatal(err)
+	}
+	if slot.start, err = parseClock(start); err != nil {
+		t.Fatal(err)
+	}
+	if slot.end, err = parseClock(end); err != nil {
+		t.Fatal(err)
+	}
+	return slot
+}
+
+func TestScheduleSlotContains(t *testing.T) {
+	tests := []struct {
+		name       string
+		days       []string
+		start, end string
+		at         time.Time
+		contains   bool
+	}{
+		{"Mon-Fri inside", []string{"Mon-Fri"}, "09:00", "12:00", scheduleTime(5, 9, 0), true},
+		{"Mon-Fri at the end", []string{"Mon-Fri"}, "09:00", "12:00", scheduleTime(1, 12, 0), false},
+		{"Mon-Fri before the start", []string{"Mon-Fri"}, "09:00", "12:00", scheduleTime(1, 8, 59), false},
+		{"Mon-Fri on Saturday", []string{"Mon-Fri"}, "09:00", "12:00", scheduleTime(6, 10, 0), false},
+		{"Sat-Mon on Sunday", []string{"Sat-Mon"}, "09:00", "12:00", scheduleTime(0, 10, 0), true},
+		{"Sat-Mon on Monday", []string{"Sat-Mon"}, "09:00", "12:00", scheduleTime(1, 10, 0), true},
+		{"Sat-Mon on Tuesday", []string{"Sat-Mon"}, "09:00", "12:00", scheduleTime(2, 10, 0), false},
+		{"past midnight before it", []string{"Fri"}, "22:00", "02:00", scheduleTime(5, 23, 30), true},
+		{"past midnight after it", []string{"Fri"}, "22:00", "02:00", scheduleTime(6, 1, 59), true},
+		{"past midnight at the end", []string{"Fri"}, "22:00", "02:00", scheduleTime(6, 2, 0), false},
+		{"past midnight on the day", []string{"Fri"}, "22:00", "02:00", scheduleTime(5, 1, 0), false},
+		{"past midnight of Saturday", []string{"Sat"}, "22:00", "02:00", scheduleTime(7, 0, 30), true},
+		{"past midnight of Sunday", []string{"Sun"}, "22:00", "02:00", scheduleTime(1, 0, 30), true},
+		{"24:00 end", []string{"Mon"}, "22:00", "24:00", scheduleTime(1, 23, 59), true},
+		{"24:00 end next day", []string{"Mon"}, "22:00", "24:00", scheduleTime(2, 0, 0), false},
+		{"whole day", []string{"Mon"}, "00:00", "24:00", scheduleTime(1, 0, 0), true},
+		{"whole day next day", []string{"Mon"}, "00:00", "24:00", scheduleTime(2, 0, 0), false},
+		{"Start == End from the start", []string{"Mon"}, "10:00", "10:00", scheduleTime(1, 10, 0), true},
+		{"Start == End next day", []string{"Mon"}, "10:00", "10:00", scheduleTime(2, 9, 59), true},
+		{"Start == End at the end", []string{"Mon"}, "10:00", "10:00", scheduleTime(2, 10, 0), false},
+		{"Start == End before the start", []string{"Mon"}, "10:00", "10:00", scheduleTime(1, 9, 59), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slot := testSlot(t, tt.name, tt.days, tt.start, tt.end)
+			if contains := slot.contains(tt.at); contains != tt.contains {
+				t.Errorf("%s contains %v, want %v", tt.at.Format("Mon 15:04"), contains, tt.contains)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	night := testSlot(t, "Night", []string{"Fri"}, "22:00", "02:00")
+	night.Type = cProgrammeSilence
+	s := &schedule{location: scheduleZone, Slots: []*scheduleSlot{
+		testSlot(t, "Morning", []string{"Mon-Fri"}, "09:00", "12:00"),
+		night,
+	}}
+	tests := []struct {
+		name string
+		now  time.Time
+		next string
+	}{
+		{"before the slot", scheduleTime(1, 8, 0), "Morning at Mon 09:00"},
+		{"in the slot", scheduleTime(1, 10, 0), "no programme at Mon 12:00"},
+		{"the next day", scheduleTime(1, 13, 0), "Morning at Tue 09:00"},
+		{"before the night", scheduleTime(5, 12, 0), "Night at Fri 22:00"},
+		{"in the night", scheduleTime(5, 23, 0), "no programme at Sat 02:00"},
+		{"after the weekend", scheduleTime(6, 3, 0), "Morning at Mon 09:00"},
+		{"time of the other zone", time.Date(2020, 3, 9, 5, 30, 0, 0, time.UTC), "Morning at Mon 09:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if next := s.nextAt(tt.now); next != tt.next {
+				t.Errorf("next %q, want %q", next, tt.next)
+			}
+		})
+	}
+
+	if slot := s.slotAt(time.Date(2020, 3, 13, 20, 0, 0, 0, time.UTC)); slot == nil || slot.Name != "Night" {
+		t.Errorf("slot at Fri 23:00 UTC+3 %v, want Night", slot)
+	}
+	if !s.liveAllowed(scheduleTime(6, 12, 0)) || !s.liveAllowed(scheduleTime(1, 10, 0)) {
+		t.Error("live source isn't allowed out of slots or in the live slot")
+	}
+	if s.liveAllowed(scheduleTime(6, 1, 0)) {
+		t.Error("live source is allowed in the silence slot")
+	}
+}
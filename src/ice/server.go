@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -50,8 +49,12 @@ type Server struct {
 	memUsage int
 
 	srv         *http.Server
+	sockets     []*listenSocket
+	certs       *certStore
 	poolManager PoolManager
 	logger      Logger
+	overrides   int64
+	cues        int64
 }
 
 // Init - Load params from config.yaml
@@ -74,12 +77,25 @@ func NewServer() (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = srv.initSpots()
+	if err != nil {
+		return nil, err
+	}
 
 	srv.logger.Log("%s %s", srv.serverName, srv.version)
 
+	router := srv.configureRouter()
 	srv.srv = &http.Server{
 		Addr:    ":" + strconv.Itoa(srv.Options.Socket.Port),
-		Handler: srv.configureRouter(),
+		Handler: router,
+	}
+	err = srv.initSockets(router)
+	if err != nil {
+		return nil, err
+	}
+	err = srv.initShoutcast()
+	if err != nil {
+		return nil, err
 	}
 
 	if srv.Options.Logging.UseStat {
@@ -97,9 +113,41 @@ func (i *Server) configureRouter() *mux.Router {
 	for _, mnt := range i.Options.Mounts {
 		r.HandleFunc("/"+mnt.Name, mnt.write).Methods("SOURCE", "PUT")
 		r.HandleFunc("/"+mnt.Name, mnt.read).Methods("GET")
+		r.HandleFunc("/"+mnt.Name+"/live", mnt.liveHandler).Methods("GET", "POST")
+		r.HandleFunc("/ws/"+mnt.Name, mnt.wsRead).Methods("GET")
+		r.HandleFunc("/ws/source/"+mnt.Name, mnt.wsWrite).Methods("GET")
+		r.HandleFunc("/"+mnt.Name+".m3u", mnt.m3uHandler).Methods("GET")
+		r.HandleFunc("/"+mnt.Name+".pls", mnt.plsHandler).Methods("GET")
+		r.HandleFunc("/"+mnt.Name+".xspf", mnt.xspfHandler).Methods("GET")
 		r.Path("/admin/metadata").Queries("mode", "updinfo", "mount", "/"+mnt.Name).HandlerFunc(mnt.meta).Methods("GET")
+		if mnt.hls != nil {
+			r.HandleFunc("/"+mnt.Name+".m3u8", mnt.hlsPlaylistHandler).Methods("GET")
+			r.HandleFunc("/"+mnt.Name+"/hls/{seq:[0-9]+}.{ext}", mnt.hlsSegmentHandler).Methods("GET")
+		}
+		if mnt.dash != nil {
+			r.HandleFunc("/"+mnt.Name+".mpd", mnt.dashManifestHandler).Methods("GET")
+			r.HandleFunc("/"+mnt.Name+"/dash/init.mp4", mnt.dashInitHandler).Methods("GET")
+			r.HandleFunc("/"+mnt.Name+"/dash/{number:[0-9]+}.m4s", mnt.dashSegmentHandler).Methods("GET")
+		}
+		if mnt.RTP != nil {
+			r.HandleFunc("/"+mnt.Name+".sdp", mnt.sdpHandler).Methods("GET")
+		}
+		if mnt.Podcast != nil {
+			r.HandleFunc("/"+mnt.Name+".rss", mnt.rssHandler).Methods("GET")
+			r.HandleFunc("/"+mnt.Name+".atom", mnt.atomHandler).Methods("GET")
+			r.HandleFunc("/"+mnt.Name+"/recordings/{file:.+}", mnt.recordingHandler).Methods("GET", "HEAD")
+		}
 	}
 
+	if len(i.Options.ShoutCast) > 0 {
+		r.HandleFunc("/admin.cgi", i.shoutcastAdmin).Methods("GET")
+	}
+	i.configureDNASRouter(r)
+
+	r.HandleFunc("/admin/override", i.overrideHandler).Methods("GET", "POST", "DELETE")
+	r.HandleFunc("/admin/cue", i.cueHandler).Methods("GET", "POST")
+	r.HandleFunc("/admin/record", i.recordHandler).Methods("GET", "POST", "DELETE")
+
 	r.HandleFunc("/info", i.infoHandler).Methods("GET")
 	r.HandleFunc("/info.json", i.jsonHandler).Methods("GET")
 	if i.Options.Logging.UseMonitor {
@@ -161,6 +209,21 @@ func (i *Server) checkSources() bool {
 
 // Close - finish
 func (i *Server) Close() {
+	for _, s := range i.sockets {
+		if err := s.srv.Shutdown(context.Background()); err != nil {
+			i.logger.Error(err.Error())
+		}
+	}
+	for _, s := range i.Options.ShoutCast {
+		if s.listener != nil {
+			_ = s.listener.Close()
+		}
+	}
+	for _, s := range i.Options.RTMP {
+		if s.listener != nil {
+			_ = s.listener.Close()
+		}
+	}
 	if err := i.srv.Shutdown(context.Background()); err != nil {
 		i.logger.Error(err.Error())
 		i.logger.Log("Error: %s\n", err.Error())
@@ -202,7 +265,6 @@ func (i *Server) Start() {
 
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, os.Kill)
-	i.Options.Load()
 	if i.Options.Auth.AdminPassword == "admin" {
 		i.logger.Log("WARNING: Admin password is default password. Changing it by default. Please check config.yaml for new password.")
 		i.Options.Auth.AdminPassword = i.randomPassword()
@@ -223,7 +285,6 @@ func (i *Server) Start() {
 			i.logger.Log("Mount %s password: %s", mount.Name, i.Options.Mounts[index].Password)
 		}
 	}
-	//i.Options.Load()
 	go func() {
 		if i.Options.UsesI2P {
 			go func() {
@@ -269,24 +330,19 @@ func (i *Server) Start() {
 			}()
 		}
 		if !i.Options.DisableClearnet {
-			go func() {
-				i.mux.Lock()
-				i.StartedTime = time.Now()
-				i.mux.Unlock()
-				atomic.StoreInt32(&i.Started, 1)
-				for {
-					if listener, err := net.Listen("tcp", i.srv.Addr); err != nil {
-						panic(err)
-					} else {
-						i.logger.Log("Started on %s", i.srv.Addr)
-						if err := i.srv.Serve(listener); err != http.ErrServerClosed {
-							listener.Close()
-							time.Sleep(time.Second * 15)
-							continue
-						}
-					}
-				}
-			}()
+			i.mux.Lock()
+			i.StartedTime = time.Now()
+			i.mux.Unlock()
+			atomic.StoreInt32(&i.Started, 1)
+			for _, s := range i.sockets {
+				go i.serveSocket(s)
+			}
+			for _, s := range i.Options.ShoutCast {
+				go i.serveShoutcast(s)
+			}
+			for _, s := range i.Options.RTMP {
+				go i.serveRTMP(s)
+			}
 		} else {
 			go func() {
 				server := http.ServeMux{}
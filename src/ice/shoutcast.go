@@ -0,0 +1,194 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cShoutcastHandshakeTimeOut = 10 * time.Second
+
+// shoutcastSocket - SHOUTcast source socket, usually the port next to the listeners one.
+// SHOUTcast v1 sources feed the mount of the socket, v2 sources choose the mount by stream ID
+type shoutcastSocket struct {
+	Address string `yaml:"Address,omitempty"`
+	Port    int    `yaml:"Port"`
+	Mount   string `yaml:"Mount,omitempty"`
+
+	mnt      *mount
+	listener net.Listener
+}
+
+func (s *shoutcastSocket) addr() string {
+	return net.JoinHostPort(strings.Trim(s.Address, "[]"), strconv.Itoa(s.Port))
+}
+
+func (i *Server) findMount(name string) *mount {
+	name = strings.TrimPrefix(name, "/")
+	for _, m := range i.Options.Mounts {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (i *Server) initShoutcast() error {
+	for _, s := range i.Options.ShoutCast {
+		if s.Mount > "" {
+			s.mnt = i.findMount(s.Mount)
+			if s.mnt == nil {
+				return errors.New("SHOUTcast socket refers to unknown mount " + s.Mount)
+			}
+		}
+		if s.Port <= 0 {
+			return errors.New("SHOUTcast socket " + s.addr() + " has no port")
+		}
+	}
+	return nil
+}
+
+// serveShoutcast - accept SHOUTcast v1 sources
+func (i *Server) serveShoutcast(s *shoutcastSocket) {
+	var err error
+	s.listener, err = net.Listen("tcp", s.addr())
+	if err != nil {
+		panic(err)
+	}
+	i.logger.Log("Started SHOUTcast source socket on %s", s.addr())
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			i.logger.Error(err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		go i.acceptShoutcast(s, conn)
+	}
+}
+
+// acceptShoutcast - detect protocol of the source: SHOUTcast v2 (Ultravox 2.1) messages
+// start with sync byte, v1 sources send password line
+func (i *Server) acceptShoutcast(s *shoutcastSocket, conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(cShoutcastHandshakeTimeOut))
+	reader := bufio.NewReaderSize(conn, cUvoxMaxMessageSize*4)
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		i.logger.Error(err.Error())
+		return
+	}
+	if first[0] == cUvoxSync {
+		i.writeUltravox(conn, reader)
+		return
+	}
+	if s.mnt == nil {
+		i.logger.Error("SHOUTcast v1 source on %s: no mount configured", s.addr())
+		_, _ = conn.Write([]byte("invalid password\r\n"))
+		return
+	}
+	s.mnt.writeShoutcast(conn, reader)
+}
+
+/*
+	writeShoutcast
+	SHOUTcast v1 source: password line, OK2 reply, icy-* headers and then the stream
+*/
+func (m *mount) writeShoutcast(conn net.Conn, reader *bufio.Reader) {
+	host := m.Server.getHost(conn.RemoteAddr().String())
+
+	if !m.Server.checkSources() {
+		m.logger.Error("Number of sources exceeded")
+		_, _ = conn.Write([]byte("Number of sources exceeded\r\n"))
+		return
+	}
+
+	pass, err := reader.ReadString('\n')
+	if err != nil {
+		m.logger.Error(err.Error())
+		return
+	}
+	priority := m.checkPassword(strings.TrimRight(pass, "\r\n"))
+	if priority == 0 {
+		m.logger.Error("SHOUTcast source %s: wrong password", host)
+		_, _ = conn.Write([]byte("invalid password\r\n"))
+		return
+	}
+	m.mux.Lock()
+	err = m.sourceAllowed(sourceLive)
+	m.mux.Unlock()
+	if err != nil {
+		m.logger.Error(err.Error())
+		_, _ = conn.Write([]byte("Stream in use\r\n"))
+		return
+	}
+	if _, err = conn.Write([]byte("OK2\r\nicy-caps:11\r\n\r\n")); err != nil {
+		m.logger.Error(err.Error())
+		return
+	}
+
+	headers, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		m.logger.Error(err.Error())
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	m.mux.Lock()
+	id, err := m.claimLive(priority)
+	if err != nil {
+		m.mux.Unlock()
+		m.logger.Error(err.Error())
+		return
+	}
+	if m.source == id {
+		m.writeICYHeaders(headers)
+	}
+	m.mux.Unlock()
+	defer m.releaseSource(id)
+
+	bytesSent := 0
+	start := time.Now()
+
+	m.logger.Info("writeMount %s (SHOUTcast v1)", m.Name)
+	defer m.closeConn(true, &bytesSent, start, host, "SOURCE /"+m.Name+" ICY", "-", headers.Get("user-agent"))
+
+	m.ingest(id, reader, &bytesSent)
+}
+
+// shoutcastAdmin - metadata updates of SHOUTcast v1 sources:
+// /admin.cgi?pass=password&mode=updinfo&song=title
+func (i *Server) shoutcastAdmin(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("mode") != "updinfo" {
+		http.Error(w, "Unsupported mode", http.StatusBadRequest)
+		return
+	}
+	for _, s := range i.Options.ShoutCast {
+		if s.mnt == nil {
+			continue
+		}
+		if priority := s.mnt.checkPassword(q.Get("pass")); priority > 0 {
+			if s.mnt.isActivePriority(priority) {
+				s.mnt.setStreamTitle(q.Get("song"))
+			}
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<html><body>Update successful</body></html>"))
+			return
+		}
+	}
+	http.Error(w, "Invalid password", http.StatusUnauthorized)
+}
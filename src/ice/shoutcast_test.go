@@ -0,0 +1,43 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestShoutcastAdmin - sockets without mount (Ultravox only) are skipped
+func TestShoutcastAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		title  string
+	}{
+		{"password", "mode=updinfo&pass=pass&song=Song", http.StatusOK, "Song"},
+		{"user and password", "mode=updinfo&pass=src:pass&song=Song", http.StatusOK, "Song"},
+		{"wrong password", "mode=updinfo&pass=wrong&song=Song", http.StatusUnauthorized, ""},
+		{"no password", "mode=updinfo&song=Song", http.StatusUnauthorized, ""},
+		{"unsupported mode", "mode=viewxml&pass=pass", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{}
+			m := &mount{Name: "Rock", User: "src", Password: "pass", Server: srv, logger: nopLogger{}}
+			srv.Options.Mounts = []*mount{m}
+			srv.Options.ShoutCast = []*shoutcastSocket{{Port: 8001}, {Port: 8002, Mount: "Rock", mnt: m}}
+
+			w := httptest.NewRecorder()
+			srv.shoutcastAdmin(w, httptest.NewRequest("GET", "/admin.cgi?"+tt.query, nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if m.State.MetaInfo.StreamTitle != tt.title {
+				t.Errorf("title %q, want %q", m.State.MetaInfo.StreamTitle, tt.title)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenSocket - TCP (IPv4 or IPv6) or Unix domain socket, with its own access policy
+type listenSocket struct {
+	Address     string `yaml:"Address,omitempty"`
+	Port        int    `yaml:"Port,omitempty"`
+	Unix        string `yaml:"Unix,omitempty"`
+	TLS         bool   `yaml:"TLS,omitempty"`
+	AllowSource bool   `yaml:"AllowSource"`
+	AllowAdmin  bool   `yaml:"AllowAdmin"`
+	// source and administration socket, listeners are refused and it isn't advertised in playlists
+	NoListeners bool `yaml:"NoListeners,omitempty"`
+
+	srv     *http.Server
+	handler http.Handler
+}
+
+func (s *listenSocket) network() string {
+	if s.Unix > "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (s *listenSocket) addr() string {
+	if s.Unix > "" {
+		return s.Unix
+	}
+	return net.JoinHostPort(strings.Trim(s.Address, "[]"), strconv.Itoa(s.Port))
+}
+
+func (s *listenSocket) String() string {
+	str := s.network() + "://" + s.addr()
+	if s.TLS {
+		str += " (TLS)"
+	}
+	return str
+}
+
+func (s *listenSocket) listen() (net.Listener, error) {
+	if s.Unix > "" {
+		// remove socket file left by previous run
+		if info, err := os.Stat(s.Unix); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(s.Unix)
+		}
+	}
+	return net.Listen(s.network(), s.addr())
+}
+
+func isSourceRequest(r *http.Request) bool {
+	return r.Method == "SOURCE" || r.Method == "PUT" || r.URL.Path == "/admin.cgi" ||
+		strings.HasPrefix(r.URL.Path, "/ws/source/")
+}
+
+func isAdminRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/admin/")
+}
+
+// ServeHTTP - apply socket policy before routing the request
+func (s *listenSocket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.AllowSource && isSourceRequest(r) {
+		http.Error(w, "Sources are not allowed on this socket", http.StatusForbidden)
+		return
+	}
+	if !s.AllowAdmin && isAdminRequest(r) {
+		http.Error(w, "Administration is not allowed on this socket", http.StatusForbidden)
+		return
+	}
+	if s.NoListeners && !isSourceRequest(r) && !isAdminRequest(r) {
+		http.Error(w, "Listeners are not allowed on this socket", http.StatusForbidden)
+		return
+	}
+	s.handler.ServeHTTP(w, r)
+}
+
+// initSockets - collect listen sockets from config. Legacy Socket.Port and TLS.Port
+// are treated as sockets on all interfaces with everything allowed
+func (i *Server) initSockets(handler http.Handler) error {
+	i.sockets = i.sockets[:0]
+	if i.Options.Socket.Port > 0 {
+		i.sockets = append(i.sockets, &listenSocket{Port: i.Options.Socket.Port, AllowSource: true, AllowAdmin: true})
+	}
+	if i.Options.TLS.Port > 0 {
+		i.sockets = append(i.sockets, &listenSocket{Port: i.Options.TLS.Port, TLS: true, AllowSource: true, AllowAdmin: true})
+	}
+	i.sockets = append(i.sockets, i.Options.Sockets...)
+
+	for _, s := range i.sockets {
+		if s.Unix == "" && s.Port <= 0 {
+			return errors.New("listen socket without port or unix path")
+		}
+		if s.TLS && i.certs == nil {
+			var err error
+			i.certs, err = newCertStore(i.Options.TLS.Certificates, i.logger)
+			if err != nil {
+				return err
+			}
+			go i.certs.watch(i.Options.TLS.ReloadInterval)
+		}
+		s.handler = handler
+		s.srv = &http.Server{
+			Addr:    s.addr(),
+			Handler: s,
+		}
+		if s.TLS {
+			s.srv.TLSConfig = i.certs.tlsConfig()
+		}
+	}
+	return nil
+}
+
+// serveSocket - accept connections on the socket, HTTP/2 is negotiated by ALPN on TLS sockets
+func (i *Server) serveSocket(s *listenSocket) {
+	for {
+		listener, err := s.listen()
+		if err != nil {
+			panic(err)
+		}
+		i.logger.Log("Started on %s", s.String())
+		if s.TLS {
+			err = s.srv.ServeTLS(listener, "", "")
+		} else {
+			err = s.srv.Serve(listener)
+		}
+		if err == http.ErrServerClosed {
+			return
+		}
+		listener.Close()
+		time.Sleep(time.Second * 15)
+	}
+}
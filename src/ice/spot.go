@@ -0,0 +1,442 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Spot insertion: the cue marks the live position of the mount. It comes from the source as StreamTitle
+// with the cue prefix ("CUE:spot1,spot2") or from the admin API. Every HTTP listener, who reaches
+// the position, gets the first spot of the cue, which matches the listener's target (query parameter)
+// and geo class. The spot is spliced at the frame boundary and the live stream of the same duration
+// is skipped, so the listener returns to live with the same delay. HLS, DASH, RTP and WebSocket
+// outputs carry the live stream without spots. Impressions of every cue are written to impressions.log
+
+const (
+	cSpotTargetParam = "target"
+	cSpotCuePrefix   = "CUE:"
+	// listeners reach the cue position within the buffer length, then impressions are reported
+	cCueReportDelay = time.Minute
+)
+
+// spotClip - the spot, one file per stream format (WAV for PCM mounts)
+type spotClip struct {
+	Name    string   `yaml:"Name"`
+	Title   string   `yaml:"Title,omitempty"`
+	Files   []string `yaml:"Files"`
+	Targets []string `yaml:"Targets,omitempty"`
+	Geo     []string `yaml:"Geo,omitempty"`
+}
+
+// geoClass - listeners from the networks
+type geoClass struct {
+	Name     string   `yaml:"Name"`
+	Networks []string `yaml:"Networks"`
+
+	nets []*net.IPNet
+}
+
+type spotImpressions struct {
+	Started   int
+	Completed int
+}
+
+// cue - insertion point of the mount stream
+type cue struct {
+	ID          int64
+	Mount       string
+	Spots       []string
+	Time        time.Time
+	By          string
+	Impressions map[string]*spotImpressions
+
+	pos      int64
+	byteRate float64
+	clips    []*spotClip
+	mux      sync.Mutex
+}
+
+// initSpots - parse networks of the geo classes
+func (i *Server) initSpots() error {
+	for _, g := range i.Options.Spots.GeoClasses {
+		g.nets = g.nets[:0]
+		for _, network := range g.Networks {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				return errors.New("geo class " + g.Name + ": " + err.Error())
+			}
+			g.nets = append(g.nets, ipNet)
+		}
+	}
+	return nil
+}
+
+// cueSpots - configured spots by names
+func (i *Server) cueSpots(names []string) ([]*spotClip, error) {
+	var clips []*spotClip
+	for _, list := range names {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			var clip *spotClip
+			for _, s := range i.Options.Spots.Clips {
+				if s.Name == name {
+					clip = s
+				}
+			}
+			if clip == nil || len(clip.Files) == 0 {
+				return nil, errors.New("unknown spot " + name)
+			}
+			clips = append(clips, clip)
+		}
+	}
+	if len(clips) == 0 {
+		return nil, errors.New("spot is not set")
+	}
+	return clips, nil
+}
+
+// cueTitle - spot names, if the title is the cue
+func (i *Server) cueTitle(title string) (string, bool) {
+	prefix := i.Options.Spots.CuePrefix
+	if prefix == "" {
+		prefix = cSpotCuePrefix
+	}
+	if len(i.Options.Spots.Clips) == 0 || !strings.HasPrefix(title, prefix) {
+		return "", false
+	}
+	return title[len(prefix):], true
+}
+
+// geoClass - name of the listener's geo class
+func (i *Server) geoClass(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	for _, g := range i.Options.Spots.GeoClasses {
+		for _, n := range g.nets {
+			if n.Contains(ip) {
+				return g.Name
+			}
+		}
+	}
+	return ""
+}
+
+/*
+	cueHandler
+	/admin/cue?mount=name|*: GET - the latest cues with impressions, POST with spot=name[,name] - insert the spots
+*/
+func (i *Server) cueHandler(w http.ResponseWriter, r *http.Request) {
+	if !i.checkAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	mounts, err := i.overrideMounts(q["mount"], r.Method == "GET")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		clips, err := i.cueSpots(q["spot"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		by := i.getHost(r.RemoteAddr)
+		names := make([]string, 0, len(mounts))
+		spots := make([]string, 0, len(clips))
+		for _, m := range mounts {
+			names = append(names, m.Name)
+		}
+		for _, s := range clips {
+			spots = append(spots, s.Name)
+		}
+		i.logger.Audit("cue: mounts=%s spots=%s by=%s", strings.Join(names, ","), strings.Join(spots, ","), by)
+		for _, m := range mounts {
+			m.insertCue(clips, by)
+		}
+	}
+
+	cues := []*cue{}
+	for _, m := range mounts {
+		if c := m.latestCue(); c != nil {
+			cues = append(cues, c.snapshot())
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(cues)
+}
+
+// insertCue - mark the live position of the mount, listeners get the spots, when they reach it
+func (m *mount) insertCue(clips []*spotClip, by string) *cue {
+	if m.currentOverride() != nil {
+		m.logger.Warning("Cue of mount %s is ignored: the mount is overridden", m.Name)
+		return nil
+	}
+	var byteRate float64
+	if m.PCM != nil {
+		byteRate = float64(m.PCM.SampleRate * m.PCM.blockAlign())
+	} else {
+		c, f := m.streamFormat()
+		if c != codecMP3 && c != codecAAC || f.Duration() == 0 {
+			m.logger.Warning("Cue of mount %s is ignored: spots are inserted into MP3, AAC and PCM streams", m.Name)
+			return nil
+		}
+		byteRate = float64(f.Size) / f.Duration().Seconds()
+	}
+
+	cu := &cue{
+		ID:          atomic.AddInt64(&m.Server.cues, 1),
+		Mount:       m.Name,
+		Time:        time.Now(),
+		By:          by,
+		Impressions: make(map[string]*spotImpressions),
+		pos:         m.buffer.Written(),
+		byteRate:    byteRate,
+		clips:       clips,
+	}
+	for _, s := range clips {
+		cu.Spots = append(cu.Spots, s.Name)
+		cu.Impressions[s.Name] = &spotImpressions{}
+	}
+	m.mux.Lock()
+	m.cue = cu
+	m.mux.Unlock()
+
+	m.logger.Info("Cue #%d of mount %s: %s", cu.ID, m.Name, strings.Join(cu.Spots, ","))
+	time.AfterFunc(cCueReportDelay, cu.report(m.Server.logger))
+	return cu
+}
+
+// titleCue - the cue sent by the source as StreamTitle, the repeated title is ignored
+func (m *mount) titleCue(title, spots string) {
+	m.mux.Lock()
+	repeated := m.cueTitle == title
+	m.cueTitle = title
+	m.mux.Unlock()
+	if repeated {
+		return
+	}
+	clips, err := m.Server.cueSpots([]string{spots})
+	if err != nil {
+		m.logger.Error("Cue of mount %s: %s", m.Name, err.Error())
+		return
+	}
+	m.insertCue(clips, "source")
+}
+
+// latestCue - the last cue of the mount or nil
+func (m *mount) latestCue() *cue {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.cue
+}
+
+// snapshot - copy of the cue for the status
+func (c *cue) snapshot() *cue {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	s := &cue{ID: c.ID, Mount: c.Mount, Spots: c.Spots, Time: c.Time, By: c.By,
+		Impressions: make(map[string]*spotImpressions)}
+	for name, imp := range c.Impressions {
+		copied := *imp
+		s.Impressions[name] = &copied
+	}
+	return s
+}
+
+// report - write impressions of the cue
+func (c *cue) report(logger Logger) func() {
+	return func() {
+		c.mux.Lock()
+		defer c.mux.Unlock()
+		for _, name := range c.Spots {
+			imp := c.Impressions[name]
+			logger.Impression("cue #%d mount=%s time=%s by=%s spot=%s started=%d completed=%d", c.ID, c.Mount,
+				c.Time.Format(time.RFC3339), c.By, name, imp.Started, imp.Completed)
+		}
+	}
+}
+
+// frameAt - offset of the first frame, which starts at off or later, len(page) if there is no one
+func (m *mount) frameAt(page []byte, off int) int {
+	if off >= len(page) {
+		return len(page)
+	}
+	if m.PCM != nil {
+		align := m.PCM.blockAlign()
+		if off = (off + align - 1) / align * align; off > len(page) {
+			off = len(page)
+		}
+		return off
+	}
+	m.mux.Lock()
+	c := codecByContentType(m.ContentType)
+	m.mux.Unlock()
+	if idx := c.frameBoundary(page[off:]); idx >= 0 {
+		return off + idx
+	}
+	return len(page)
+}
+
+// spotPlayer - spot insertion into the stream of the listener
+type spotPlayer struct {
+	mount  *mount
+	icy    *icyWriter
+	target string
+	geo    string
+	// the last cue, which is reached by the listener
+	played int64
+	// stream position, where the listener returns to live after the spot
+	resume int64
+}
+
+// listenerSpot - the spot chosen for the listener
+type listenerSpot struct {
+	cue  *cue
+	clip *spotClip
+	file *clipFile
+}
+
+func (m *mount) newSpotPlayer(r *http.Request, icy *icyWriter) *spotPlayer {
+	p := &spotPlayer{mount: m, icy: icy}
+	if len(m.Server.Options.Spots.Clips) == 0 {
+		return p
+	}
+	param := m.Server.Options.Spots.TargetParam
+	if param == "" {
+		param = cSpotTargetParam
+	}
+	p.target = r.URL.Query().Get(param)
+	p.geo = m.Server.geoClass(r)
+	return p
+}
+
+// page - parts of the buffer page, which are sent before and after the spot. The spot is nil,
+// when there is no cue in the page. skip is the offset, where the page starts for the listener
+func (p *spotPlayer) page(pack *bufElement, skip int) ([]byte, *listenerSpot, []byte) {
+	page := pack.buffer
+	end := pack.pos + int64(len(page))
+	start := skip
+	if p.resume > 0 {
+		if p.resume >= end {
+			return nil, nil, nil
+		}
+		if off := int(p.resume - pack.pos); off > start {
+			start = p.mount.frameAt(page, off)
+		}
+		p.resume = 0
+	}
+
+	c := p.mount.latestCue()
+	if c == nil || c.ID == p.played || c.pos >= end {
+		return page[start:], nil, nil
+	}
+	p.played = c.ID
+	// the listener joined after the cue
+	if c.pos < pack.pos+int64(start) {
+		return page[start:], nil, nil
+	}
+	spot := p.choose(c)
+	if spot == nil {
+		return page[start:], nil, nil
+	}
+
+	cut := p.mount.frameAt(page, int(c.pos-pack.pos))
+	p.resume = pack.pos + int64(cut) + int64(spot.file.duration.Seconds()*c.byteRate)
+	var after []byte
+	if p.resume < end {
+		after = page[p.mount.frameAt(page, int(p.resume-pack.pos)):]
+		p.resume = 0
+	}
+	return page[start:cut], spot, after
+}
+
+// choose - the first spot of the cue for the listener
+func (p *spotPlayer) choose(c *cue) *listenerSpot {
+	for _, clip := range c.clips {
+		if len(clip.Targets) > 0 && !containsString(clip.Targets, p.target) ||
+			len(clip.Geo) > 0 && !containsString(clip.Geo, p.geo) {
+			continue
+		}
+		name := p.mount.spotFile(clip)
+		if name == "" {
+			continue
+		}
+		file, err := p.mount.clips.load(name)
+		if err != nil {
+			p.mount.logger.Error("Spot %s of mount %s: %s", clip.Name, p.mount.Name, err.Error())
+			continue
+		}
+		return &listenerSpot{cue: c, clip: clip, file: file}
+	}
+	return nil
+}
+
+// play - send the spot, the listener gets its title while the spot is playing
+func (p *spotPlayer) play(w io.Writer, spot *listenerSpot) (int, error) {
+	spot.cue.count(spot.clip.Name, false)
+	if p.icy != nil && spot.clip.Title > "" {
+		meta := icyMetaBlock("StreamTitle='" + spot.clip.Title + "';")
+		liveMeta := p.icy.meta
+		p.icy.meta = func() ([]byte, int) { return meta, len(meta) }
+		defer func() { p.icy.meta = liveMeta }()
+	}
+	n, err := w.Write(spot.file.data)
+	if err == nil {
+		spot.cue.count(spot.clip.Name, true)
+	}
+	return n, err
+}
+
+func (c *cue) count(spot string, completed bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if completed {
+		c.Impressions[spot].Completed++
+	} else {
+		c.Impressions[spot].Started++
+	}
+}
+
+// spotFile - the spot file of the mount format, empty if there is no one
+func (m *mount) spotFile(clip *spotClip) string {
+	m.mux.Lock()
+	mountCodec := codecByContentType(m.ContentType)
+	m.mux.Unlock()
+	for _, name := range clip.Files {
+		if m.PCM != nil && strings.EqualFold(name[strings.LastIndex(name, ".")+1:], "wav") ||
+			m.PCM == nil && codecByExtension(name) == mountCodec {
+			return name
+		}
+	}
+	return ""
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
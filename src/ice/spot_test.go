@@ -0,0 +1,148 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// spotMount - PCM mount of 100 Hz 16 bit stereo (4 bytes blocks, 400 bytes/s) with the spot of 0.1 s
+func spotMount(t *testing.T) (*mount, *spotClip) {
+	name := filepath.Join(t.TempDir(), "spot.wav")
+	if err := ioutil.WriteFile(name, make([]byte, 40), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &mount{Name: "Pcm", PCM: &pcmFormat{SampleRate: 100, Channels: 2, BitDepth: 16}, logger: nopLogger{}}
+	m.clips.mount = m
+	return m, &spotClip{Name: "spot", Files: []string{name}}
+}
+
+// spotBufPage - buffer page, every byte is the low byte of its stream position
+func spotBufPage(pos int64, size int) *bufElement {
+	page := make([]byte, size)
+	for idx := range page {
+		page[idx] = byte(pos + int64(idx))
+	}
+	return &bufElement{pos: pos, len: size, buffer: page}
+}
+
+func TestSpotPlayerPage(t *testing.T) {
+	type result struct {
+		pos  int64
+		size int
+		skip int
+		// sent part of the page before the spot, nil for -1
+		from, to int
+		spot     bool
+		// the page after the spot starts at, nil for -1
+		after int
+	}
+	tests := []struct {
+		name     string
+		cue      int64
+		byteRate float64
+		pages    []result
+	}{
+		{"cue inside the page", 30, 400, []result{
+			{0, 100, 0, 0, 32, true, 72},
+			{100, 100, 0, 0, 100, false, -1},
+		}},
+		{"cue in the next page", 130, 400, []result{
+			{0, 100, 0, 0, 100, false, -1},
+			{100, 100, 0, 0, 32, true, 72},
+		}},
+		{"spot spans to the next page", 80, 400, []result{
+			{0, 100, 0, 0, 80, true, -1},
+			{100, 100, 0, 20, 100, false, -1},
+			{200, 100, 0, 0, 100, false, -1},
+		}},
+		{"resume beyond the next page", 90, 400, []result{
+			{0, 100, 0, 0, 92, true, -1},
+			{100, 30, 0, -1, -1, false, -1},
+			{130, 100, 0, 4, 100, false, -1},
+		}},
+		{"resume at the page end", 60, 400, []result{
+			{0, 100, 0, 0, 60, true, -1},
+			{100, 100, 0, 0, 100, false, -1},
+		}},
+		{"listener joined after the cue", 30, 400, []result{
+			{0, 100, 50, 50, 100, false, -1},
+			{100, 100, 0, 0, 100, false, -1},
+		}},
+		{"listener joined at the cue", 30, 400, []result{
+			{0, 100, 30, 30, 32, true, 72},
+		}},
+		{"block alignment of the cut", 33, 400, []result{
+			{0, 100, 0, 0, 36, true, 76},
+		}},
+		{"block alignment of the resume", 30, 410, []result{
+			{0, 100, 0, 0, 32, true, 76},
+		}},
+		{"block alignment of the resume in the next page", 80, 410, []result{
+			{0, 100, 0, 0, 80, true, -1},
+			{100, 100, 0, 24, 100, false, -1},
+		}},
+		{"skip beyond the resume", 80, 400, []result{
+			{0, 100, 0, 0, 80, true, -1},
+			{100, 100, 40, 40, 100, false, -1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, clip := spotMount(t)
+			m.cue = &cue{ID: 1, pos: tt.cue, byteRate: tt.byteRate, clips: []*spotClip{clip},
+				Impressions: map[string]*spotImpressions{clip.Name: {}}}
+			p := &spotPlayer{mount: m}
+			for _, want := range tt.pages {
+				pack := spotBufPage(want.pos, want.size)
+				before, spot, after := p.page(pack, want.skip)
+				if want.from < 0 && before != nil || want.from >= 0 && !bytes.Equal(before, pack.buffer[want.from:want.to]) {
+					t.Errorf("page %d: before the spot %v, want [%d:%d]", want.pos, before, want.from, want.to)
+				}
+				if (spot != nil) != want.spot {
+					t.Errorf("page %d: spot %v, want %v", want.pos, spot != nil, want.spot)
+				}
+				if want.after < 0 && after != nil || want.after >= 0 && !bytes.Equal(after, pack.buffer[want.after:]) {
+					t.Errorf("page %d: after the spot %v, want [%d:]", want.pos, after, want.after)
+				}
+			}
+		})
+	}
+}
+
+// TestSpotPlayerListeners - every listener gets the cue once, the next cue is played again
+func TestSpotPlayerListeners(t *testing.T) {
+	m, clip := spotMount(t)
+	first := &spotPlayer{mount: m}
+	second := &spotPlayer{mount: m}
+	newCue := func(id, pos int64) {
+		m.cue = &cue{ID: id, pos: pos, byteRate: 400, clips: []*spotClip{clip},
+			Impressions: map[string]*spotImpressions{clip.Name: {}}}
+	}
+
+	newCue(1, 10)
+	if _, spot, _ := first.page(spotBufPage(0, 100), 0); spot == nil {
+		t.Error("the first listener didn't get the cue")
+	}
+	if _, spot, _ := first.page(spotBufPage(0, 100), 0); spot != nil {
+		t.Error("the first listener got the cue twice")
+	}
+	if _, spot, _ := second.page(spotBufPage(0, 100), 0); spot == nil {
+		t.Error("the second listener didn't get the cue played by the first one")
+	}
+	if first.played != 1 || second.played != 1 {
+		t.Errorf("played cues %d and %d, want 1", first.played, second.played)
+	}
+
+	newCue(2, 150)
+	if _, spot, _ := first.page(spotBufPage(100, 100), 0); spot == nil || spot.cue.ID != 2 {
+		t.Error("the first listener didn't get the next cue")
+	}
+	if _, spot, _ := second.page(spotBufPage(100, 100), 70); spot != nil || second.played != 2 {
+		t.Errorf("the second listener, who is after the cue, got the spot %v, played cue %d", spot != nil, second.played)
+	}
+}
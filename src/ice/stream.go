@@ -0,0 +1,302 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamModeHijack = "hijack"
+	streamModeFlush  = "flush"
+
+	// seconds of the stream in the source pipe and the minimal size of the pipe
+	cSourcePipeSeconds = 4
+	cSourcePipeMin     = 64 * 1024
+)
+
+var errSourceTooFast = errors.New("source is faster than the bitrate, data is dropped")
+
+// streamWriter - connection to the listener. Stream could be written directly to the
+// hijacked connection (HTTP/1.x only) or through http.ResponseWriter with flushing,
+// which also works over HTTP/2, TLS and reverse proxies
+type streamWriter interface {
+	io.Writer
+	writeHeaders(h http.Header) error
+	Flush() error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// hijackedStream - raw connection taken from http.Server
+type hijackedStream struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+func (s *hijackedStream) writeHeaders(h http.Header) error {
+	_, _ = s.rw.WriteString("HTTP/1.1 200 OK\r\n")
+	_ = h.Write(s.rw)
+	_, _ = s.rw.WriteString("\r\n")
+	return s.rw.Flush()
+}
+
+func (s *hijackedStream) Write(p []byte) (int, error) {
+	return s.rw.Write(p)
+}
+
+func (s *hijackedStream) Flush() error {
+	return s.rw.Flush()
+}
+
+func (s *hijackedStream) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+func (s *hijackedStream) Close() error {
+	return s.conn.Close()
+}
+
+// flushedStream - stream is sent as an ordinary response body, flushed after every page
+type flushedStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (s *flushedStream) writeHeaders(h http.Header) error {
+	for k, v := range h {
+		s.w.Header()[k] = v
+	}
+	// connection-specific headers are not allowed in HTTP/2 and make no sense behind proxies
+	s.w.Header().Del("Connection")
+	s.w.WriteHeader(http.StatusOK)
+	return s.Flush()
+}
+
+func (s *flushedStream) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func (s *flushedStream) Flush() error {
+	return s.rc.Flush()
+}
+
+func (s *flushedStream) SetWriteDeadline(t time.Time) error {
+	err := s.rc.SetWriteDeadline(t)
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+func (s *flushedStream) Close() error {
+	return nil
+}
+
+// icyWriter - inserts icy metadata block after every metaInt bytes of audio, whatever size of writes is.
+// Write returns the number of audio bytes, metadata bytes are counted in metaSent
+type icyWriter struct {
+	streamWriter
+	metaInt int
+	meta    func() ([]byte, int)
+	// audio bytes since the last metadata block
+	count    int
+	metaSent int
+}
+
+func (w *icyWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		part := w.metaInt - w.count
+		if part > len(p) {
+			part = len(p)
+		}
+		n, err := w.streamWriter.Write(p[:part])
+		written += n
+		w.count += n
+		if err != nil {
+			return written, err
+		}
+		p = p[part:]
+		if w.count < w.metaInt {
+			continue
+		}
+		meta, metaLen := w.meta()
+		if metaLen == 0 {
+			// no title yet, empty block
+			meta, metaLen = []byte{0}, 1
+		}
+		if _, err = w.streamWriter.Write(meta[:metaLen]); err != nil {
+			return written, err
+		}
+		w.metaSent += metaLen
+		w.count = 0
+	}
+	return written, nil
+}
+
+// useHijack - check if the connection of request r should be hijacked
+func (i *Server) useHijack(r *http.Request) bool {
+	if r.ProtoMajor != 1 || r.TLS != nil {
+		return false
+	}
+	return i.Options.Socket.StreamMode != streamModeFlush
+}
+
+// newStreamWriter - returns writer for sending stream to the listener according to the
+// configured stream mode and abilities of the connection
+func (i *Server) newStreamWriter(w http.ResponseWriter, r *http.Request) (streamWriter, error) {
+	if i.useHijack(r) {
+		if hj, ok := w.(http.Hijacker); ok {
+			conn, bufRW, err := hj.Hijack()
+			if err != nil {
+				return nil, err
+			}
+			return &hijackedStream{conn: conn, rw: bufRW}, nil
+		}
+	}
+	return &flushedStream{w: w, rc: http.NewResponseController(w)}, nil
+}
+
+// sourceUsesBody - check if the stream of the SOURCE should be read from the request body.
+// Legacy SOURCE method has no body framing, so its connection has to be hijacked,
+// PUT requests with chunked or sized body are read through request body
+func (i *Server) sourceUsesBody(r *http.Request) bool {
+	return !i.useHijack(r) && (r.ProtoMajor > 1 || r.ContentLength != 0)
+}
+
+// prepareSource - must be called before any response to the SOURCE is written,
+// otherwise http.Server consumes and closes the request body of HTTP/1.x connections
+func (i *Server) prepareSource(w http.ResponseWriter, r *http.Request) error {
+	if !i.sourceUsesBody(r) {
+		return nil
+	}
+	err := http.NewResponseController(w).EnableFullDuplex()
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	// answer "Expect: 100-continue" now, response headers written before the first read
+	// of the body cancel the continuation and close the body
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		_, _ = r.Body.Read(nil)
+	}
+	return nil
+}
+
+// newSourceReader - returns reader for the stream sent by the SOURCE
+func (i *Server) newSourceReader(w http.ResponseWriter, r *http.Request, bufSize int) (io.ReadCloser, error) {
+	if i.sourceUsesBody(r) {
+		return r.Body, nil
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("webServer doesn't support hijacking")
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	return &hijackedSource{Reader: bufio.NewReaderSize(conn, bufSize), conn: conn}, nil
+}
+
+type hijackedSource struct {
+	*bufio.Reader
+	conn net.Conn
+}
+
+func (s *hijackedSource) Close() error {
+	return s.conn.Close()
+}
+
+// sourcePipe - collects stream of message based sources (WebSocket, RTMP, RTP), so every Read
+// returns all received data. The pipe keeps up to cSourcePipeSeconds of the stream: the writer of
+// the source, which is faster than the bitrate, waits for ingest like TCP of HTTP sources, or its
+// data is dropped, if it can't wait (RTP)
+type sourcePipe struct {
+	mux  sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	// bytes, ingest reads a second of the stream every time
+	limit int
+	drop  bool
+	// the writer is gone
+	closed bool
+	// ingest is over
+	done bool
+}
+
+func newSourcePipe(bitRate int, drop bool) *sourcePipe {
+	s := &sourcePipe{limit: cSourcePipeSeconds * bitRate * 1024 / 8, drop: drop}
+	if s.limit < cSourcePipeMin {
+		s.limit = cSourcePipeMin
+	}
+	s.cond = sync.NewCond(&s.mux)
+	return s
+}
+
+func (s *sourcePipe) Write(p []byte) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for !s.drop && !s.done && len(s.buf) > 0 && len(s.buf)+len(p) > s.limit {
+		s.cond.Wait()
+	}
+	if s.done {
+		return 0, io.ErrClosedPipe
+	}
+	if len(s.buf) > 0 && len(s.buf)+len(p) > s.limit {
+		return 0, errSourceTooFast
+	}
+	s.buf = append(s.buf, p...)
+	return len(p), nil
+}
+
+// Close - ingest is over, the waiting writer gets io.ErrClosedPipe
+func (s *sourcePipe) Close() error {
+	s.mux.Lock()
+	s.done = true
+	s.buf = nil
+	s.mux.Unlock()
+	s.cond.Broadcast()
+	return nil
+}
+
+// CloseWrite - the source is gone, Read returns io.EOF without waiting
+func (s *sourcePipe) CloseWrite() {
+	s.mux.Lock()
+	s.closed = true
+	s.mux.Unlock()
+}
+
+// Read - returns collected data. As a listener's connection, it returns io.EOF, when there is no data
+// during a second, so the source idle timeout works
+func (s *sourcePipe) Read(p []byte) (int, error) {
+	for wait := 0; wait < 20; wait++ {
+		s.mux.Lock()
+		if len(s.buf) > 0 {
+			if limit := cSourcePipeSeconds * len(p); limit > cSourcePipeMin {
+				s.limit = limit
+			}
+			n := copy(p, s.buf)
+			s.buf = s.buf[:copy(s.buf, s.buf[n:])]
+			s.mux.Unlock()
+			s.cond.Broadcast()
+			return n, nil
+		}
+		closed := s.closed
+		s.mux.Unlock()
+		if closed {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestSourcePipeDrop(t *testing.T) {
+	pipe := newSourcePipe(0, true)
+	if _, err := pipe.Write(make([]byte, cSourcePipeMin)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipe.Write([]byte{1}); err != errSourceTooFast {
+		t.Fatalf("write to the full pipe: %v, want %v", err, errSourceTooFast)
+	}
+	if n, _ := pipe.Read(make([]byte, cSourcePipeMin)); n != cSourcePipeMin {
+		t.Fatalf("read %d bytes, want %d", n, cSourcePipeMin)
+	}
+	if _, err := pipe.Write([]byte{1}); err != nil {
+		t.Fatalf("write to the drained pipe: %v", err)
+	}
+}
+
+func TestSourcePipeWait(t *testing.T) {
+	pipe := newSourcePipe(0, false)
+	if _, err := pipe.Write(make([]byte, cSourcePipeMin)); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := pipe.Write([]byte{1})
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("write to the full pipe didn't wait: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := pipe.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the writer isn't released by the read")
+	}
+}
+
+func TestSourcePipeClose(t *testing.T) {
+	pipe := newSourcePipe(0, false)
+	if _, err := pipe.Write(make([]byte, cSourcePipeMin)); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := pipe.Write([]byte{1})
+		written <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_ = pipe.Close()
+	select {
+	case err := <-written:
+		if err != io.ErrClosedPipe {
+			t.Fatalf("write to the closed pipe: %v, want %v", err, io.ErrClosedPipe)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the writer isn't released by Close")
+	}
+}
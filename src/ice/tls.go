@@ -0,0 +1,165 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type certFiles struct {
+	Cert string `yaml:"Cert"`
+	Key  string `yaml:"Key"`
+}
+
+// certStore - set of certificates, which are selected by SNI and reloaded
+// when the files are changed or SIGHUP is received
+type certStore struct {
+	mux      sync.RWMutex
+	files    []certFiles
+	modTimes []time.Time
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	logger   Logger
+}
+
+func newCertStore(files []certFiles, logger Logger) (*certStore, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no TLS certificates configured")
+	}
+	s := &certStore{
+		files:  files,
+		logger: logger,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load - read all certificates, the store keeps previous ones if any of them is broken
+func (s *certStore) load() error {
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	byName := make(map[string]*tls.Certificate)
+	modTimes := make([]time.Time, 0, len(s.files))
+
+	for _, f := range s.files {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return err
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return err
+			}
+		}
+		certs = append(certs, &cert)
+		names := cert.Leaf.DNSNames
+		if cert.Leaf.Subject.CommonName != "" {
+			names = append(names, cert.Leaf.Subject.CommonName)
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+		modTimes = append(modTimes, s.modTime(f))
+	}
+
+	s.mux.Lock()
+	s.certs = certs
+	s.byName = byName
+	s.modTimes = modTimes
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *certStore) modTime(f certFiles) time.Time {
+	var t time.Time
+	for _, name := range []string{f.Cert, f.Key} {
+		if info, err := os.Stat(name); err == nil && info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return t
+}
+
+func (s *certStore) changed() bool {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for idx, f := range s.files {
+		if !s.modTime(f).Equal(s.modTimes[idx]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *certStore) reload() {
+	if err := s.load(); err != nil {
+		s.logger.Error("TLS certificates reload failed: %s", err.Error())
+		return
+	}
+	s.logger.Info("TLS certificates reloaded")
+}
+
+// watch - reload certificates on files change or SIGHUP
+func (s *certStore) watch(interval int) {
+	if interval <= 0 {
+		interval = 60
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	for {
+		select {
+		case <-hup:
+			s.reload()
+		case <-ticker.C:
+			if s.changed() {
+				s.reload()
+			}
+		}
+	}
+}
+
+// getCertificate - choose certificate by server name: exact match, then wildcard,
+// the first configured certificate is used by default
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		if cert, ok := s.byName[name]; ok {
+			return cert, nil
+		}
+		if idx := strings.Index(name, "."); idx > 0 {
+			if cert, ok := s.byName["*"+name[idx:]]; ok {
+				return cert, nil
+			}
+		}
+	}
+	if len(s.certs) == 0 {
+		return nil, errors.New("no TLS certificate")
+	}
+	return s.certs[0], nil
+}
+
+func (s *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
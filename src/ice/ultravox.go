@@ -0,0 +1,405 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ultravox 2.1 - framed protocol of SHOUTcast DNAS v2 sources
+const (
+	cUvoxSync           = 0x5A
+	cUvoxMaxMessageSize = 16384
+
+	uvoxAuth         = 0x1001
+	uvoxSetup        = 0x1002
+	uvoxPayloadSize  = 0x1003
+	uvoxStandby      = 0x1004
+	uvoxTerminate    = 0x1005
+	uvoxFlushMeta    = 0x1006
+	uvoxListenerAuth = 0x1007
+	uvoxBufferSize   = 0x1008
+	uvoxCipher       = 0x1009
+	uvoxIcyName      = 0x1100
+	uvoxIcyGenre     = 0x1101
+	uvoxIcyURL       = 0x1102
+	uvoxIcyPub       = 0x1103
+
+	uvoxClassBroadcaster = 0x1
+	uvoxClassMetadata    = 0x3
+	uvoxClassMP3Data     = 0x7
+	uvoxClassAACData     = 0x8
+	uvoxXMLMetadata      = 0x3901
+	uvoxXMLMetadataOther = 0x3902
+)
+
+type uvoxMessage struct {
+	typ     uint16
+	payload []byte
+}
+
+func (msg *uvoxMessage) class() uint16 {
+	return msg.typ >> 12
+}
+
+func readUvoxMessage(r *bufio.Reader) (*uvoxMessage, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != cUvoxSync {
+		return nil, errors.New("ultravox: bad sync byte")
+	}
+	msg := &uvoxMessage{typ: binary.BigEndian.Uint16(header[2:4])}
+	msg.payload = make([]byte, binary.BigEndian.Uint16(header[4:6])+1)
+	if _, err := io.ReadFull(r, msg.payload); err != nil {
+		return nil, err
+	}
+	if msg.payload[len(msg.payload)-1] != 0 {
+		return nil, errors.New("ultravox: bad message terminator")
+	}
+	msg.payload = msg.payload[:len(msg.payload)-1]
+	return msg, nil
+}
+
+func writeUvoxMessage(w io.Writer, typ uint16, payload string) error {
+	buf := make([]byte, 6, len(payload)+7)
+	buf[0] = cUvoxSync
+	binary.BigEndian.PutUint16(buf[2:4], typ)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(payload)))
+	buf = append(buf, payload...)
+	buf = append(buf, 0)
+	_, err := w.Write(buf)
+	return err
+}
+
+// xteaDecrypt - Ultravox credentials are XTEA encrypted with the cipher key, hex encoded
+func xteaDecrypt(key string, data string) (string, error) {
+	raw, err := hex.DecodeString(data)
+	if err != nil || len(raw)%8 != 0 {
+		return "", errors.New("ultravox: bad encrypted value")
+	}
+	var k [4]uint32
+	kb := make([]byte, 16)
+	copy(kb, key)
+	for idx := range k {
+		k[idx] = binary.BigEndian.Uint32(kb[idx*4:])
+	}
+	// delta and the initial sum (delta * 32) of 32 rounds
+	const delta, start = 0x9E3779B9, 0xC6EF3720
+	for off := 0; off < len(raw); off += 8 {
+		v0 := binary.BigEndian.Uint32(raw[off:])
+		v1 := binary.BigEndian.Uint32(raw[off+4:])
+		sum := uint32(start)
+		for round := 0; round < 32; round++ {
+			v1 -= (((v0 << 4) ^ (v0 >> 5)) + v0) ^ (sum + k[(sum>>11)&3])
+			sum -= delta
+			v0 -= (((v1 << 4) ^ (v1 >> 5)) + v1) ^ (sum + k[sum&3])
+		}
+		binary.BigEndian.PutUint32(raw[off:], v0)
+		binary.BigEndian.PutUint32(raw[off+4:], v1)
+	}
+	return strings.TrimRight(string(raw), "\x00"), nil
+}
+
+func randomCipherKey() string {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	key := make([]byte, 16)
+	for idx := range key {
+		key[idx] = letters[rand.Intn(len(letters))]
+	}
+	return string(key)
+}
+
+func (i *Server) findMountBySID(sid int) *mount {
+	for _, m := range i.Options.Mounts {
+		if m.SID == sid {
+			return m
+		}
+	}
+	return nil
+}
+
+// checkUvoxCredentials - priority of the source, credentials are either encrypted with cipher key or sent as is
+func (m *mount) checkUvoxCredentials(cipher, user, pass string) int {
+	if u, err := xteaDecrypt(cipher, user); err == nil {
+		if p, err := xteaDecrypt(cipher, pass); err == nil {
+			if priority := m.checkUvoxPlain(u, p); priority > 0 {
+				return priority
+			}
+		}
+	}
+	return m.checkUvoxPlain(user, pass)
+}
+
+func (m *mount) checkUvoxPlain(user, pass string) int {
+	return m.sourcePriority(func(u, p string) bool {
+		return pass == p && (user == "" || user == u)
+	})
+}
+
+/*
+	writeUltravox
+	SHOUTcast v2 source: cipher and authentication negotiation, broadcast setup
+	and then audio data messages, which are written to the mount with chosen stream ID
+*/
+func (i *Server) writeUltravox(conn net.Conn, reader *bufio.Reader) {
+	var m *mount
+	var name, genre string
+	bitRate, priority := 0, 0
+	cipher := randomCipherKey()
+	host := i.getHost(conn.RemoteAddr().String())
+
+	reply := func(typ uint16, payload string) bool {
+		if err := writeUvoxMessage(conn, typ, payload); err != nil {
+			i.logger.Error(err.Error())
+			return false
+		}
+		return true
+	}
+
+Handshake:
+	for {
+		msg, err := readUvoxMessage(reader)
+		if err != nil {
+			i.logger.Error(err.Error())
+			return
+		}
+		payload := string(msg.payload)
+
+		switch msg.typ {
+		case uvoxCipher:
+			if !reply(msg.typ, "ACK:"+cipher) {
+				return
+			}
+		case uvoxAuth:
+			// 2.1:sid:user:password
+			parts := strings.SplitN(payload, ":", 4)
+			if len(parts) != 4 {
+				reply(msg.typ, "NAK:2.1:Parse Error")
+				return
+			}
+			sid, err := strconv.Atoi(parts[1])
+			if err == nil {
+				m = i.findMountBySID(sid)
+			}
+			if m == nil {
+				i.logger.Error("Ultravox source %s: unknown stream ID %s", host, parts[1])
+				reply(msg.typ, "NAK:2.1:Stream ID Error")
+				return
+			}
+			if priority = m.checkUvoxCredentials(cipher, parts[2], parts[3]); priority == 0 {
+				i.logger.Error("Ultravox source %s: wrong user or password", host)
+				reply(msg.typ, "NAK:2.1:Deny")
+				return
+			}
+			if !reply(msg.typ, "ACK:2.1:Allow") {
+				return
+			}
+		case uvoxSetup:
+			// average:maximum bitrate, bits per second
+			parts := strings.SplitN(payload, ":", 2)
+			if bRate, err := strconv.Atoi(parts[0]); err == nil {
+				bitRate = bRate / 1000
+			}
+			if !reply(msg.typ, "ACK") {
+				return
+			}
+		case uvoxPayloadSize, uvoxBufferSize:
+			// desired:minimum
+			parts := strings.SplitN(payload, ":", 2)
+			if !reply(msg.typ, "ACK:"+parts[0]) {
+				return
+			}
+		case uvoxIcyName:
+			name = payload
+			reply(msg.typ, "ACK")
+		case uvoxIcyGenre:
+			genre = payload
+			reply(msg.typ, "ACK")
+		case uvoxIcyURL, uvoxIcyPub, uvoxListenerAuth, uvoxFlushMeta:
+			reply(msg.typ, "ACK")
+		case uvoxStandby:
+			if m == nil {
+				reply(msg.typ, "NAK:Not authorized")
+				return
+			}
+			break Handshake
+		case uvoxTerminate:
+			return
+		default:
+			// metadata could be sent before the data transfer mode
+			if msg.class() != uvoxClassBroadcaster {
+				continue
+			}
+			reply(msg.typ, "NAK:Parse Error")
+			return
+		}
+	}
+
+	if !i.checkSources() {
+		i.logger.Error("Number of sources exceeded")
+		reply(uvoxStandby, "NAK:Number of sources exceeded")
+		return
+	}
+
+	m.mux.Lock()
+	id, err := m.claimLive(priority)
+	if err != nil {
+		m.mux.Unlock()
+		i.logger.Error(err.Error())
+		reply(uvoxStandby, "NAK:Stream In Use")
+		return
+	}
+	if m.source == id {
+		if bitRate > 0 {
+			m.BitRate = bitRate
+		}
+		m.Genre = genre
+		m.StreamName = name
+		m.ContentType = "audio/mpeg"
+	}
+	m.mux.Unlock()
+	defer m.releaseSource(id)
+
+	if !reply(uvoxStandby, "ACK:Data transfer mode") {
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	bytesSent := 0
+	start := time.Now()
+
+	m.logger.Info("writeMount %s (Ultravox 2.1, sid %d)", m.Name, m.SID)
+	defer m.closeConn(true, &bytesSent, start, host, "SOURCE /"+m.Name+" UVOX/2.1", "-", "-")
+
+	m.ingest(id, &uvoxReader{r: reader, m: m, id: id}, &bytesSent)
+}
+
+// uvoxReader - returns audio data from Ultravox messages, metadata messages are
+// applied to the mount
+type uvoxReader struct {
+	r        *bufio.Reader
+	m        *mount
+	id       int64
+	left     []byte
+	metaID   uint16
+	metaPart []string
+}
+
+func (u *uvoxReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(u.left) == 0 {
+			// do not wait for new messages when something is already read
+			if n > 0 && u.r.Buffered() == 0 {
+				break
+			}
+			msg, err := readUvoxMessage(u.r)
+			if err != nil {
+				if n > 0 {
+					return n, nil
+				}
+				return 0, err
+			}
+			switch msg.class() {
+			case uvoxClassMP3Data, uvoxClassAACData:
+				u.setClass(msg.class())
+				u.left = msg.payload
+			case uvoxClassMetadata:
+				u.metadata(msg)
+			case uvoxClassBroadcaster:
+				if msg.typ == uvoxTerminate {
+					if n > 0 {
+						return n, nil
+					}
+					return 0, io.EOF
+				}
+			}
+			continue
+		}
+		copied := copy(p[n:], u.left)
+		u.left = u.left[copied:]
+		n += copied
+	}
+	return n, nil
+}
+
+// setClass - content type of the mount follows the data class of the active source only,
+// the standby source applies its class, when it takes the mount
+func (u *uvoxReader) setClass(class uint16) {
+	contentType := "audio/mpeg"
+	if class == uvoxClassAACData {
+		contentType = "audio/aacp"
+	}
+	u.m.mux.Lock()
+	if u.m.source == u.id {
+		u.m.ContentType = contentType
+	}
+	u.m.mux.Unlock()
+}
+
+var (
+	uvoxTitleTag  = regexp.MustCompile(`(?s)<TIT2>(.*?)</TIT2>`)
+	uvoxArtistTag = regexp.MustCompile(`(?s)<TPE1>(.*?)</TPE1>`)
+	uvoxIcyTitle  = regexp.MustCompile(`StreamTitle='(.*?)';`)
+)
+
+// metadata - XML metadata may be split into several messages:
+// id, span and index (2 bytes each) precede every part
+func (u *uvoxReader) metadata(msg *uvoxMessage) {
+	payload := msg.payload
+	if msg.typ == uvoxXMLMetadata || msg.typ == uvoxXMLMetadataOther {
+		if len(payload) < 6 {
+			return
+		}
+		id := binary.BigEndian.Uint16(payload[0:2])
+		span := int(binary.BigEndian.Uint16(payload[2:4]))
+		index := int(binary.BigEndian.Uint16(payload[4:6]))
+		if id != u.metaID || index == 1 {
+			u.metaID = id
+			u.metaPart = u.metaPart[:0]
+		}
+		u.metaPart = append(u.metaPart, string(payload[6:]))
+		if index < span {
+			return
+		}
+		payload = []byte(strings.Join(u.metaPart, ""))
+		u.metaPart = u.metaPart[:0]
+	}
+
+	var title string
+	if t := uvoxTitleTag.FindSubmatch(payload); t != nil {
+		title = xmlUnescape(string(t[1]))
+		if a := uvoxArtistTag.FindSubmatch(payload); a != nil {
+			title = xmlUnescape(string(a[1])) + " - " + title
+		}
+	} else if t := uvoxIcyTitle.FindSubmatch(payload); t != nil {
+		title = string(t[1])
+	} else {
+		return
+	}
+	if u.m.isSource(u.id) {
+		u.m.setStreamTitle(title)
+	}
+}
+
+var xmlUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", "\"", "&apos;", "'")
+
+func xmlUnescape(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "<![CDATA[")
+	s = strings.TrimSuffix(s, "]]>")
+	return xmlUnescaper.Replace(s)
+}
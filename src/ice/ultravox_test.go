@@ -0,0 +1,96 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import "testing"
+
+// the key of the cipher exchange and the credentials encrypted with it by the reference XTEA
+// (32 rounds, big-endian words, zero padded to 8 bytes blocks)
+const (
+	uvoxTestKey      = "k3Yc9RpTz0LmQa7W"
+	uvoxTestUser     = "bd8589e10e467be4"                 // source
+	uvoxTestPassword = "baf992b81f5f4df0786eaafd57ec56c0" // hackme!secret
+	uvoxTestBackup   = "bcebb4c939809d74"                 // backup
+	uvoxTestStandby  = "aebb57812687b44e"                 // standby
+	uvoxTestWrong    = "e30deb5844cd50a8"                 // wrong
+)
+
+func TestXTEADecrypt(t *testing.T) {
+	key := string([]byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f})
+	tests := []struct {
+		name string
+		key  string
+		data string
+		want string
+		err  bool
+	}{
+		{"test vector", key, "497df3d072612cb5", "ABCDEFGH", false},
+		{"test vector of repeated bytes", key, "e78f2d13744341d8", "AAAAAAAA", false},
+		{"test vector of zero key", "", "a0390589f8b8efa5", "ABCDEFGH", false},
+		{"upper case hex", key, "497DF3D072612CB5", "ABCDEFGH", false},
+		{"padded blocks", uvoxTestKey, uvoxTestPassword, "hackme!secret", false},
+		{"empty", uvoxTestKey, "", "", false},
+		{"not hex", uvoxTestKey, "hackme!secret", "", true},
+		{"partial block", uvoxTestKey, "497df3d072612c", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := xteaDecrypt(tt.key, tt.data)
+			if (err != nil) != tt.err || got != tt.want {
+				t.Errorf("xteaDecrypt(%s) = %q, %v, want %q, error %v", tt.data, got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+// TestUvoxCredentials - user and password of 2.1:sid:user:password encrypted with the key of the cipher
+// exchange or sent as is
+func TestUvoxCredentials(t *testing.T) {
+	m := &mount{User: "source", Password: "hackme!secret",
+		Failover: &failover{Sources: []*backupSource{{User: "backup", Password: "standby", Priority: 5}}}}
+	tests := []struct {
+		name     string
+		key      string
+		user     string
+		password string
+		priority int
+	}{
+		{"encrypted", uvoxTestKey, uvoxTestUser, uvoxTestPassword, cPrimaryPriority},
+		{"encrypted backup", uvoxTestKey, uvoxTestBackup, uvoxTestStandby, 5},
+		{"encrypted wrong password", uvoxTestKey, uvoxTestUser, uvoxTestWrong, 0},
+		{"encrypted with the other key", "k3Yc9RpTz0LmQa7X", uvoxTestUser, uvoxTestPassword, 0},
+		{"plain", uvoxTestKey, "source", "hackme!secret", cPrimaryPriority},
+		{"plain without user", uvoxTestKey, "", "hackme!secret", cPrimaryPriority},
+		{"plain wrong user", uvoxTestKey, "backup", "hackme!secret", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if priority := m.checkUvoxCredentials(tt.key, tt.user, tt.password); priority != tt.priority {
+				t.Errorf("priority %d, want %d", priority, tt.priority)
+			}
+		})
+	}
+}
+
+// TestUvoxSetClass - the data class of the standby source doesn't change the mount
+func TestUvoxSetClass(t *testing.T) {
+	m := &mount{ContentType: "audio/mpeg", source: 1}
+	active := &uvoxReader{m: m, id: 1}
+	standby := &uvoxReader{m: m, id: 2}
+
+	standby.setClass(uvoxClassAACData)
+	if m.ContentType != "audio/mpeg" {
+		t.Errorf("content type %s after the standby source, want audio/mpeg", m.ContentType)
+	}
+	active.setClass(uvoxClassAACData)
+	if m.ContentType != "audio/aacp" {
+		t.Errorf("content type %s after the active source, want audio/aacp", m.ContentType)
+	}
+
+	m.source = 2
+	standby.setClass(uvoxClassMP3Data)
+	if m.ContentType != "audio/mpeg" {
+		t.Errorf("content type %s after the standby source took the mount, want audio/mpeg", m.ContentType)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// WebM/Opus (as produced by browser MediaRecorder) to Ogg/Opus remuxer.
+// Segment and clusters of unknown size are supported, blocks with lacing are skipped.
+// Only the first Opus track is remuxed, blocks of the other tracks (video) are dropped
+
+const (
+	ebmlSegment      = 0x18538067
+	ebmlCluster      = 0x1F43B675
+	ebmlTracks       = 0x1654AE6B
+	ebmlTrackEntry   = 0xAE
+	ebmlTrackNumber  = 0xD7
+	ebmlAudio        = 0xE1
+	ebmlChannels     = 0x9F
+	ebmlCodecID      = 0x86
+	ebmlCodecPrivate = 0x63A2
+	ebmlBlockGroup   = 0xA0
+	ebmlBlock        = 0xA1
+	ebmlSimpleBlock  = 0xA3
+
+	cWebMMaxElementSize = 1 << 20
+	// packets per ogg page
+	cOggPagePackets = 25
+)
+
+var webmMagic = []byte{0x1A, 0x45, 0xDF, 0xA3}
+
+// webmTrack - fields of the TrackEntry
+type webmTrack struct {
+	number       uint64
+	codecID      string
+	codecPrivate []byte
+	channels     int
+}
+
+type webmRemuxer struct {
+	buf  []byte
+	skip int
+
+	// the TrackEntry being read and the Opus track
+	entry *webmTrack
+	track *webmTrack
+
+	ogg       oggMuxer
+	started   bool
+	granule   int64
+	packets   [][]byte
+	pageBytes []byte
+}
+
+func newWebMRemuxer(serial uint32) *webmRemuxer {
+	return &webmRemuxer{ogg: oggMuxer{serial: serial}}
+}
+
+// ebmlVint - variable size integer, returns value, its length and whether all value bits are set
+func ebmlVint(b []byte, keepMarker bool) (uint64, int, bool) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, false
+	}
+	length := 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(b) < length {
+		return 0, 0, false
+	}
+	v := uint64(b[0])
+	if !keepMarker {
+		v &= uint64(0xFF >> uint(length))
+	}
+	allOnes := v == uint64(0xFF>>uint(length))
+	for _, c := range b[1:length] {
+		v = v<<8 | uint64(c)
+		allOnes = allOnes && c == 0xFF
+	}
+	return v, length, allOnes
+}
+
+// Write - consume WebM data, returns produced Ogg pages
+func (x *webmRemuxer) Write(p []byte) ([]byte, error) {
+	x.buf = append(x.buf, p...)
+	x.pageBytes = x.pageBytes[:0]
+
+	for {
+		if x.skip > 0 {
+			n := x.skip
+			if n > len(x.buf) {
+				n = len(x.buf)
+			}
+			x.buf = x.buf[n:]
+			x.skip -= n
+			if x.skip > 0 {
+				break
+			}
+		}
+
+		id, idLen, _ := ebmlVint(x.buf, true)
+		if idLen == 0 {
+			break
+		}
+		size, sizeLen, unknown := ebmlVint(x.buf[idLen:], false)
+		if sizeLen == 0 {
+			break
+		}
+		header := idLen + sizeLen
+
+		switch id {
+		case ebmlTrackEntry, ebmlCluster:
+			x.endTrack()
+			if id == ebmlTrackEntry {
+				x.entry = &webmTrack{}
+			}
+		}
+		switch id {
+		case ebmlSegment, ebmlCluster, ebmlTracks, ebmlTrackEntry, ebmlAudio, ebmlBlockGroup:
+			// step into the master element
+			x.buf = x.buf[header:]
+			continue
+		}
+		if unknown {
+			return nil, errors.New("webm element of unknown size")
+		}
+
+		switch id {
+		case ebmlTrackNumber, ebmlCodecID, ebmlCodecPrivate, ebmlChannels, ebmlBlock, ebmlSimpleBlock:
+			if size > cWebMMaxElementSize {
+				return nil, errors.New("webm element is too big")
+			}
+			if len(x.buf) < header+int(size) {
+				return x.flush(), nil
+			}
+			if err := x.element(id, x.buf[header:header+int(size)]); err != nil {
+				return nil, err
+			}
+			x.buf = x.buf[header+int(size):]
+		default:
+			x.buf = x.buf[header:]
+			x.skip = int(size)
+		}
+	}
+	return x.flush(), nil
+}
+
+// ebmlUint - unsigned integer of 1-8 bytes
+func ebmlUint(data []byte) (uint64, bool) {
+	if len(data) == 0 || len(data) > 8 {
+		return 0, false
+	}
+	var v uint64
+	for _, c := range data {
+		v = v<<8 | uint64(c)
+	}
+	return v, true
+}
+
+// endTrack - the TrackEntry is read, the first Opus track is kept
+func (x *webmRemuxer) endTrack() {
+	if x.entry == nil {
+		return
+	}
+	if x.track == nil && x.entry.codecID == "A_OPUS" && x.entry.number > 0 {
+		x.track = x.entry
+	}
+	x.entry = nil
+}
+
+func (x *webmRemuxer) element(id uint64, data []byte) error {
+	if id != ebmlBlock && id != ebmlSimpleBlock {
+		// track fields outside of the TrackEntry are ignored
+		if x.entry == nil {
+			return nil
+		}
+	}
+	switch id {
+	case ebmlTrackNumber:
+		number, ok := ebmlUint(data)
+		if !ok || number == 0 {
+			return errors.New("bad webm track number")
+		}
+		x.entry.number = number
+	case ebmlCodecID:
+		x.entry.codecID = string(data)
+	case ebmlCodecPrivate:
+		x.entry.codecPrivate = append([]byte(nil), data...)
+	case ebmlChannels:
+		// Opus has up to 255 channels
+		channels, ok := ebmlUint(data)
+		if !ok || channels == 0 || channels > 255 {
+			return errors.New("bad webm channels")
+		}
+		x.entry.channels = int(channels)
+	case ebmlBlock, ebmlSimpleBlock:
+		x.endTrack()
+		track, trackLen, _ := ebmlVint(data, false)
+		if trackLen == 0 || len(data) < trackLen+3 {
+			return errors.New("bad webm block")
+		}
+		if x.track == nil {
+			return errors.New("webm stream without Opus track")
+		}
+		if track != x.track.number {
+			return nil
+		}
+		flags := data[trackLen+2]
+		if flags&0x06 != 0 {
+			return nil
+		}
+		return x.packet(data[trackLen+3:])
+	}
+	return nil
+}
+
+func (x *webmRemuxer) packet(p []byte) error {
+	if !x.started {
+		head := x.track.codecPrivate
+		if _, ok := parseOpusHead(head); !ok {
+			head = defaultOpusHead(x.track.channels)
+		}
+		x.pageBytes = append(x.pageBytes, x.ogg.Page([][]byte{head}, 0, 0x02)...)
+		x.pageBytes = append(x.pageBytes, x.ogg.Page([][]byte{opusTags(cServerName)}, 0, 0)...)
+		x.started = true
+	}
+	x.packets = append(x.packets, append([]byte(nil), p...))
+	x.granule += int64(opusPacketSamples(p))
+	if len(x.packets) >= cOggPagePackets {
+		x.flush()
+	}
+	return nil
+}
+
+// flush - put collected packets to the ogg page
+func (x *webmRemuxer) flush() []byte {
+	if len(x.packets) > 0 {
+		x.pageBytes = append(x.pageBytes, x.ogg.Page(x.packets, x.granule, 0)...)
+		x.packets = x.packets[:0]
+	}
+	return x.pageBytes
+}
+
+func defaultOpusHead(channels int) []byte {
+	if channels == 0 {
+		channels = 2
+	}
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = byte(channels)
+	binary.LittleEndian.PutUint16(head[10:], 312)
+	binary.LittleEndian.PutUint32(head[12:], 48000)
+	return head
+}
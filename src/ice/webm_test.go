@@ -0,0 +1,172 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEBMLVint(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         []byte
+		keepMarker bool
+		value      uint64
+		length     int
+		allOnes    bool
+	}{
+		{"empty", nil, false, 0, 0, false},
+		{"zero byte", []byte{0x00, 0x01}, false, 0, 0, false},
+		{"one byte", []byte{0x81}, false, 1, 1, false},
+		{"zero size", []byte{0x80}, false, 0, 1, false},
+		{"two bytes", []byte{0x40, 0x02}, false, 2, 2, false},
+		{"truncated", []byte{0x40}, false, 0, 0, false},
+		{"truncated id", []byte{0x1A, 0x45, 0xDF}, true, 0, 0, false},
+		{"id with marker", []byte{0x1A, 0x45, 0xDF, 0xA3}, true, 0x1A45DFA3, 4, false},
+		{"unknown size", []byte{0xFF}, false, 0x7F, 1, true},
+		{"unknown size 8 bytes", []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, false, 1<<56 - 1, 8, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, length, allOnes := ebmlVint(tt.in, tt.keepMarker)
+			if value != tt.value || length != tt.length || allOnes != tt.allOnes {
+				t.Errorf("ebmlVint(%x) = %d, %d, %v, want %d, %d, %v", tt.in, value, length, allOnes, tt.value, tt.length, tt.allOnes)
+			}
+		})
+	}
+}
+
+// webmElement - element with one byte size
+func webmElement(id []byte, data ...byte) []byte {
+	return append(append(append([]byte(nil), id...), 0x80|byte(len(data))), data...)
+}
+
+var webmUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// webmStream - WebM header, Opus track 1 with the Channels element and the cluster of one block
+func webmStream(channels []byte, block []byte) []byte {
+	audio := webmElement([]byte{0xE1}, channels...)
+	return webmTracks(block, webmEntry(1, "A_OPUS", audio...))
+}
+
+// webmEntry - TrackEntry with the TrackNumber (0 for none) and the CodecID
+func webmEntry(number byte, codecID string, fields ...byte) []byte {
+	var data []byte
+	if number > 0 {
+		data = webmElement([]byte{0xD7}, number)
+	}
+	data = append(data, webmElement([]byte{0x86}, []byte(codecID)...)...)
+	return webmElement([]byte{0xAE}, append(data, fields...)...)
+}
+
+// webmTracks - WebM header, given track entries and the cluster of blocks
+func webmTracks(blocks []byte, entries ...[]byte) []byte {
+	var b []byte
+	b = append(b, webmElement([]byte{0x1A, 0x45, 0xDF, 0xA3}, 0x42, 0x82, 0x84, 'w', 'e', 'b', 'm')...)
+	b = append(b, 0x18, 0x53, 0x80, 0x67)
+	b = append(b, webmUnknownSize...)
+	var tracks []byte
+	for _, e := range entries {
+		tracks = append(tracks, e...)
+	}
+	b = append(b, webmElement([]byte{0x16, 0x54, 0xAE, 0x6B}, tracks...)...)
+	b = append(b, 0x1F, 0x43, 0xB6, 0x75)
+	b = append(b, webmUnknownSize...)
+	return append(b, blocks...)
+}
+
+var (
+	webmChannels = webmElement([]byte{0x9F}, 0x02)
+	// track 1, timecode 0, keyframe, 20 ms Opus packet
+	webmBlock = webmElement([]byte{0xA3}, 0x81, 0x00, 0x00, 0x80, 0xFC, 0xFF, 0xFE)
+	// track 2, timecode 0, keyframe, 20 ms Opus packet
+	webmBlock2 = webmElement([]byte{0xA3}, 0x82, 0x00, 0x00, 0x80, 0xFC, 0xFF, 0xFE)
+)
+
+func TestWebMRemuxer(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    []byte
+		err   bool
+		pages int
+	}{
+		{"stream", webmStream(webmChannels, webmBlock), false, 3},
+		{"empty", nil, false, 0},
+		{"header only", webmStream(webmChannels, nil), false, 0},
+		{"truncated block", webmStream(webmChannels, webmBlock[:5]), false, 0},
+		{"zero size channels", webmStream([]byte{0x9F, 0x80}, webmBlock), true, 0},
+		{"zero channels", webmStream([]byte{0x9F, 0x81, 0x00}, webmBlock), true, 0},
+		{"oversized channels", webmStream(webmElement([]byte{0x9F}, 0, 0, 0, 0, 0, 0, 0, 0, 2), webmBlock), true, 0},
+		{"too many channels", webmStream(webmElement([]byte{0x9F}, 0x01, 0x00), webmBlock), true, 0},
+		{"zero size block", webmStream(webmChannels, []byte{0xA3, 0x80}), true, 0},
+		{"short block", webmStream(webmChannels, webmElement([]byte{0xA3}, 0x81, 0x00)), true, 0},
+		{"huge block", webmStream(webmChannels, []byte{0xA3, 0x10, 0x20, 0x00, 0x00}), true, 0},
+		{"unknown size block", webmStream(webmChannels, append([]byte{0xA3}, webmUnknownSize...)), true, 0},
+		{"video and audio", webmTracks(append(append([]byte(nil), webmBlock...), webmBlock2...),
+			webmEntry(1, "V_VP8"), webmEntry(2, "A_OPUS")), false, 3},
+		{"video blocks only", webmTracks(append(append([]byte(nil), webmBlock...), webmBlock...),
+			webmEntry(1, "V_VP8"), webmEntry(2, "A_OPUS")), false, 0},
+		{"audio and video", webmTracks(append(append([]byte(nil), webmBlock...), webmBlock2...),
+			webmEntry(1, "A_OPUS"), webmEntry(2, "V_VP8")), false, 3},
+		{"video only", webmTracks(webmBlock, webmEntry(1, "V_VP8")), true, 0},
+		{"track without number", webmTracks(webmBlock, webmEntry(0, "A_OPUS")), true, 0},
+		{"zero track number", webmTracks(webmBlock, webmElement([]byte{0xAE}, 0xD7, 0x81, 0x00)), true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := newWebMRemuxer(1).Write(tt.in)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if pages := bytes.Count(out, []byte("OggS")); pages != tt.pages {
+				t.Errorf("%d ogg pages, want %d", pages, tt.pages)
+			}
+		})
+	}
+}
+
+// TestWebMRemuxerByteByByte - the stream split at every byte gives the same pages
+func TestWebMRemuxerByteByByte(t *testing.T) {
+	stream := webmStream(webmChannels, webmBlock)
+	whole, err := newWebMRemuxer(1).Write(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole = append([]byte(nil), whole...)
+
+	x := newWebMRemuxer(1)
+	var out []byte
+	for i := range stream {
+		pages, err := x.Write(stream[i : i+1])
+		if err != nil {
+			t.Fatalf("byte %d: %v", i, err)
+		}
+		out = append(out, pages...)
+	}
+	if !bytes.Equal(out, whole) {
+		t.Errorf("byte by byte output differs: %x, want %x", out, whole)
+	}
+	if !bytes.Contains(out, []byte("OpusHead")) || !bytes.Contains(out, []byte("OpusTags")) {
+		t.Error("Opus headers are missing")
+	}
+}
+
+// TestWebMRemuxerTracks - blocks of the video track are dropped, the Opus track gives the same pages
+func TestWebMRemuxerTracks(t *testing.T) {
+	audio, err := newWebMRemuxer(1).Write(webmStream(webmChannels, webmBlock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio = append([]byte(nil), audio...)
+
+	blocks := append(append(append([]byte(nil), webmBlock...), webmBlock2...), webmBlock...)
+	out, err := newWebMRemuxer(1).Write(webmTracks(blocks, webmEntry(1, "V_VP8"), webmEntry(2, "A_OPUS", webmChannels...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, audio) {
+		t.Errorf("video and audio output differs: %x, want %x", out, audio)
+	}
+}
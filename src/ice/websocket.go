@@ -0,0 +1,360 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package ice
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket delivery for browser players: binary messages contain whole audio frames (pages for ogg),
+// text messages are JSON with stream info, metadata and stream position.
+// Stream position of the first byte is sent in the info message, so the client can count received bytes
+// and reconnect with ?offset=position to continue without gaps and duplicates
+
+const cWSBatchSize = 16384
+
+type wsInfo struct {
+	Type        string `json:"type"`
+	Mount       string `json:"mount"`
+	ContentType string `json:"contentType"`
+	BitRate     int    `json:"bitrate"`
+	Offset      int64  `json:"offset"`
+	Resumed     bool   `json:"resumed"`
+}
+
+type wsMetadata struct {
+	Type        string `json:"type"`
+	StreamTitle string `json:"StreamTitle"`
+	Offset      int64  `json:"offset"`
+}
+
+type wsPosition struct {
+	Type   string `json:"type"`
+	Offset int64  `json:"offset"`
+}
+
+/*
+	wsRead
+	Send stream from requested mount to the WebSocket client
+*/
+func (m *mount) wsRead(w http.ResponseWriter, r *http.Request) {
+	if !m.Server.checkListeners() {
+		m.logger.Error("Number of listeners exceeded")
+		http.Error(w, "Number of listeners exceeded", 403)
+		return
+	}
+
+	var reader *frameReader
+	resumed := false
+	if str := r.URL.Query().Get("offset"); str > "" {
+		if pos, err := strconv.ParseInt(str, 10, 64); err == nil {
+			if cursor, skip := m.buffer.NewCursorAt(pos); cursor != nil {
+				reader = m.newFrameReaderFrom(cursor, skip)
+				resumed = true
+			}
+		}
+	}
+	if reader == nil {
+		cursor := m.buffer.NewBurstCursor(m.BurstSize)
+		if cursor.start == nil {
+			m.logger.Error("wsRead Empty buffer")
+			http.Error(w, "Stream is not available", http.StatusNotFound)
+			return
+		}
+		reader = m.newFrameReaderFrom(cursor, 0)
+	}
+	defer reader.Close()
+
+	conn, err := upGrader.Upgrade(w, r, nil)
+	if err != nil {
+		m.logger.Error(err.Error())
+		return
+	}
+	defer conn.Close()
+
+	bytesSent := 0
+	start := time.Now()
+	host, request := m.Server.getHost(r.RemoteAddr), r.Method+" "+r.RequestURI+" "+r.Proto
+	m.incListeners()
+	defer m.closeConn(false, &bytesSent, start, host, request, r.Referer(), r.UserAgent())
+
+	// control messages have to be read, the client doesn't send anything else
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				close(closed)
+				return
+			}
+		}
+	}()
+
+	err = m.wsSend(conn, reader, resumed, closed, &bytesSent)
+	if err != nil {
+		m.logger.Error(err.Error())
+	}
+}
+
+func (m *mount) wsSend(conn *websocket.Conn, reader *frameReader, resumed bool, closed chan struct{}, bytesSent *int) error {
+	writeTimeOut := time.Second * time.Duration(m.Server.Options.Limits.WriteTimeOut)
+	idleTimeOut := time.Second * time.Duration(m.Server.Options.Limits.EmptyBufferIdleTimeOut)
+	idle := time.Duration(0)
+
+	infoSent := false
+	title := ""
+	expected := int64(-1)
+	batch := make([]byte, 0, cWSBatchSize)
+
+	sendJSON := func(v interface{}) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeOut))
+		return conn.WriteJSON(v)
+	}
+	sendBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(writeTimeOut))
+		if err := conn.WriteMessage(websocket.BinaryMessage, batch); err != nil {
+			return err
+		}
+		*bytesSent += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		if atomic.LoadInt32(&m.Server.Started) == 0 {
+			return nil
+		}
+		select {
+		case <-closed:
+			return nil
+		default:
+		}
+
+		frame, _, _ := reader.Next(time.Second)
+		if frame == nil {
+			idle += time.Second
+			if idle >= idleTimeOut {
+				return errors.New("empty Buffer idle time is reached")
+			}
+			continue
+		}
+		idle = 0
+
+		// collect frames, which are already in the buffer, into one message
+		for frame != nil {
+			pos := reader.Pos() - int64(len(frame))
+			if !infoSent {
+				m.mux.Lock()
+				info := wsInfo{Type: "info", Mount: m.Name, ContentType: m.ContentType, BitRate: m.BitRate, Offset: pos, Resumed: resumed}
+				m.mux.Unlock()
+				if err := sendJSON(info); err != nil {
+					return err
+				}
+				infoSent = true
+				expected = pos
+			}
+			if pos != expected {
+				// garbage between frames was skipped
+				if err := sendBatch(); err != nil {
+					return err
+				}
+				if err := sendJSON(wsPosition{Type: "position", Offset: pos}); err != nil {
+					return err
+				}
+			}
+			if t := m.getStreamTitle(); t != title {
+				if err := sendBatch(); err != nil {
+					return err
+				}
+				title = t
+				if err := sendJSON(wsMetadata{Type: "metadata", StreamTitle: title, Offset: pos}); err != nil {
+					return err
+				}
+			}
+			batch = append(batch, frame...)
+			expected = pos + int64(len(frame))
+			if len(batch) >= cWSBatchSize {
+				break
+			}
+			frame, _, _ = reader.Next(0)
+		}
+		if err := sendBatch(); err != nil {
+			return err
+		}
+	}
+}
+
+//***************************************
+
+// WebSocket source: the first text message is JSON hello with credentials (if there is no
+// Authorization header) and stream description, then binary messages carry WebM/Opus or Ogg/Opus
+// produced by MediaRecorder. WebM is remuxed into Ogg. Text messages with type "metadata" update StreamTitle
+
+const cWSSourceHandshakeTimeOut = 10 * time.Second
+
+type wsSourceHello struct {
+	User        string `json:"user"`
+	Password    string `json:"password"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Genre       string `json:"genre"`
+	BitRate     int    `json:"bitrate"`
+}
+
+type wsSourceMessage struct {
+	Type        string `json:"type"`
+	StreamTitle string `json:"StreamTitle,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// wsReceive - collects stream from WebSocket messages into the pipe
+func (m *mount) wsReceive(id int64, conn *websocket.Conn, pipe *sourcePipe) {
+	var remuxer *webmRemuxer
+	passThrough := false
+	idleTimeOut := time.Second * time.Duration(m.Server.Options.Limits.SourceIdleTimeOut)
+
+	defer pipe.CloseWrite()
+
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(idleTimeOut))
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			m.logger.Error(err.Error())
+			return
+		}
+
+		if kind == websocket.TextMessage {
+			var msg wsSourceMessage
+			if json.Unmarshal(data, &msg) == nil && msg.Type == "metadata" && m.isSource(id) {
+				m.setStreamTitle(msg.StreamTitle)
+			}
+			continue
+		}
+
+		if remuxer == nil && !passThrough {
+			switch {
+			case bytes.HasPrefix(data, webmMagic):
+				remuxer = newWebMRemuxer(rand.Uint32())
+			case bytes.HasPrefix(data, []byte("OggS")):
+				passThrough = true
+			default:
+				m.logger.Error("WebSocket source: unsupported stream format")
+				return
+			}
+		}
+		if remuxer != nil {
+			if data, err = remuxer.Write(data); err != nil {
+				m.logger.Error(err.Error())
+				return
+			}
+		}
+		if _, err = pipe.Write(data); err != nil {
+			if err != io.ErrClosedPipe {
+				m.logger.Error(err.Error())
+			}
+			return
+		}
+	}
+}
+
+/*
+	wsWrite
+	Authenticate WebSocket source and write stream from it to the mount buffer
+*/
+func (m *mount) wsWrite(w http.ResponseWriter, r *http.Request) {
+	if !m.Server.checkSources() {
+		m.logger.Error("Number of sources exceeded")
+		http.Error(w, "Number of sources exceeded", 403)
+		return
+	}
+	priority := 0
+	if r.Header.Get("Authorization") > "" {
+		user, password, ok := r.BasicAuth()
+		if ok {
+			priority = m.checkCredentials(user, password)
+		}
+		if priority == 0 {
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	conn, err := upGrader.Upgrade(w, r, nil)
+	if err != nil {
+		m.logger.Error(err.Error())
+		return
+	}
+	defer conn.Close()
+
+	reject := func(reason string) {
+		m.logger.Error("WebSocket source: %s", reason)
+		_ = conn.WriteJSON(wsSourceMessage{Type: "error", Error: reason})
+		_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason))
+	}
+
+	var hello wsSourceHello
+	_ = conn.SetReadDeadline(time.Now().Add(cWSSourceHandshakeTimeOut))
+	if err = conn.ReadJSON(&hello); err != nil {
+		reject("bad hello message")
+		return
+	}
+	if priority == 0 {
+		priority = m.checkCredentials(hello.User, hello.Password)
+	}
+	if priority == 0 {
+		reject("wrong user or password")
+		return
+	}
+
+	m.mux.Lock()
+	id, err := m.claimLive(priority)
+	if err != nil {
+		m.mux.Unlock()
+		reject(err.Error())
+		return
+	}
+	if m.source == id {
+		m.writeWSHeaders(hello)
+	}
+	m.mux.Unlock()
+	defer m.releaseSource(id)
+
+	bytesSent := 0
+	start := time.Now()
+
+	m.logger.Info("writeMount %s (WebSocket)", m.Name)
+	defer m.close(true, &bytesSent, start, r)
+
+	if err = conn.WriteJSON(wsSourceMessage{Type: "ready"}); err != nil {
+		m.logger.Error(err.Error())
+		return
+	}
+	pipe := newSourcePipe(m.BitRate, false)
+	defer pipe.Close()
+	go m.wsReceive(id, conn, pipe)
+	m.ingest(id, pipe, &bytesSent)
+}
+
+// writeWSHeaders - WebSocket flavour of writeICEHeaders, the stream is always Ogg
+func (m *mount) writeWSHeaders(hello wsSourceHello) {
+	if hello.BitRate > 0 {
+		m.BitRate = hello.BitRate
+	}
+	m.Genre = hello.Genre
+	m.ContentType = "audio/ogg"
+	m.Description = hello.Description
+	m.StreamName = hello.Name
+}
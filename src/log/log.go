@@ -24,10 +24,14 @@ type iceLogger struct {
 	logError  *log.Logger
 	logAccess *log.Logger
 	logStat   *log.Logger
+	logAudit  *log.Logger
+	logImpr   *log.Logger
 
 	logErrorFile  *os.File
 	logAccessFile *os.File
 	statFile      *os.File
+	auditFile     *os.File
+	imprFile      *os.File
 }
 
 func NewLogger(level LogsLevel, logsPath string) (*iceLogger, error) {
@@ -38,6 +42,8 @@ func NewLogger(level LogsLevel, logsPath string) (*iceLogger, error) {
 	errorFileName := logsPath + "error.log"
 	accessFileName := logsPath + "access.log"
 	statFileName := logsPath + "stat.log"
+	auditFileName := logsPath + "audit.log"
+	imprFileName := logsPath + "impressions.log"
 
 	var err error
 	newLogger.logErrorFile, err = os.OpenFile(errorFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -50,6 +56,16 @@ func NewLogger(level LogsLevel, logsPath string) (*iceLogger, error) {
 		return nil, err
 	}
 
+	newLogger.auditFile, err = os.OpenFile(auditFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	newLogger.imprFile, err = os.OpenFile(imprFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
 	if len(statFileName) > 0 {
 		newLogger.statFile, err = os.OpenFile(statFileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 		if err != nil {
@@ -61,6 +77,8 @@ func NewLogger(level LogsLevel, logsPath string) (*iceLogger, error) {
 
 	newLogger.logError = log.New(newLogger.logErrorFile, "", log.Ldate|log.Ltime)
 	newLogger.logAccess = log.New(newLogger.logAccessFile, "", 0)
+	newLogger.logAudit = log.New(newLogger.auditFile, "", log.Ldate|log.Ltime)
+	newLogger.logImpr = log.New(newLogger.imprFile, "", log.Ldate|log.Ltime)
 
 	return newLogger, nil
 }
@@ -103,6 +121,16 @@ func (l *iceLogger) Access(format string, v ...interface{}) {
 	l.logAccess.Printf(format, v...)
 }
 
+// Audit - administrative actions, which should be kept regardless of the log level
+func (l *iceLogger) Audit(format string, v ...interface{}) {
+	l.logAudit.Printf(format, v...)
+}
+
+// Impression - spot insertions for billing
+func (l *iceLogger) Impression(format string, v ...interface{}) {
+	l.logImpr.Printf(format, v...)
+}
+
 func (l *iceLogger) Log(format string, v ...interface{}) {
 	log.Printf(format, v...)
 }
@@ -114,6 +142,8 @@ func (l *iceLogger) Stat(format string, v ...interface{}) {
 func (l *iceLogger) Close() {
 	_ = l.logErrorFile.Close()
 	_ = l.logAccessFile.Close()
+	_ = l.auditFile.Close()
+	_ = l.imprFile.Close()
 	if l.statFile != nil {
 		_ = l.statFile.Close()
 	}
@@ -0,0 +1,198 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// AMF0 types
+const (
+	amfNumber      = 0x00
+	amfBoolean     = 0x01
+	amfString      = 0x02
+	amfObject      = 0x03
+	amfNull        = 0x05
+	amfUndefined   = 0x06
+	amfECMAArray   = 0x08
+	amfObjectEnd   = 0x09
+	amfStrictArray = 0x0A
+	amfDate        = 0x0B
+	amfLongString  = 0x0C
+	amfTypedObject = 0x10
+)
+
+// nesting of objects and arrays
+const amfMaxDepth = 32
+
+var errAMF = errors.New("rtmp: bad AMF0 data")
+
+// Object - AMF0 object or ECMA array
+type Object map[string]interface{}
+
+// DecodeAMF0 - decode all values of the message
+func DecodeAMF0(b []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(b) > 0 {
+		v, n, err := decodeAMF0Value(b, 0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
+
+func decodeAMF0String(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, errAMF
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return "", 0, errAMF
+	}
+	return string(b[2 : 2+l]), 2 + l, nil
+}
+
+func decodeAMF0Object(b []byte, depth int) (Object, int, error) {
+	obj := Object{}
+	pos := 0
+	for {
+		if len(b) >= pos+3 && b[pos] == 0 && b[pos+1] == 0 && b[pos+2] == amfObjectEnd {
+			return obj, pos + 3, nil
+		}
+		key, n, err := decodeAMF0String(b[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		v, n, err := decodeAMF0Value(b[pos:], depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		obj[key] = v
+	}
+}
+
+func decodeAMF0Value(b []byte, depth int) (interface{}, int, error) {
+	if len(b) == 0 || depth > amfMaxDepth {
+		return nil, 0, errAMF
+	}
+	switch b[0] {
+	case amfNumber:
+		if len(b) < 9 {
+			return nil, 0, errAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:])), 9, nil
+	case amfBoolean:
+		if len(b) < 2 {
+			return nil, 0, errAMF
+		}
+		return b[1] != 0, 2, nil
+	case amfString:
+		s, n, err := decodeAMF0String(b[1:])
+		return s, n + 1, err
+	case amfLongString:
+		if len(b) < 5 {
+			return nil, 0, errAMF
+		}
+		l := int(binary.BigEndian.Uint32(b[1:]))
+		if len(b) < 5+l {
+			return nil, 0, errAMF
+		}
+		return string(b[5 : 5+l]), 5 + l, nil
+	case amfObject:
+		obj, n, err := decodeAMF0Object(b[1:], depth+1)
+		return obj, n + 1, err
+	case amfTypedObject:
+		_, cn, err := decodeAMF0String(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		obj, n, err := decodeAMF0Object(b[1+cn:], depth+1)
+		return obj, n + 1 + cn, err
+	case amfECMAArray:
+		if len(b) < 5 {
+			return nil, 0, errAMF
+		}
+		obj, n, err := decodeAMF0Object(b[5:], depth+1)
+		return obj, n + 5, err
+	case amfStrictArray:
+		if len(b) < 5 {
+			return nil, 0, errAMF
+		}
+		count := int(binary.BigEndian.Uint32(b[1:]))
+		pos := 5
+		var arr []interface{}
+		for idx := 0; idx < count; idx++ {
+			v, n, err := decodeAMF0Value(b[pos:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, v)
+			pos += n
+		}
+		return arr, pos, nil
+	case amfDate:
+		if len(b) < 11 {
+			return nil, 0, errAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:])), 11, nil
+	case amfNull, amfUndefined:
+		return nil, 1, nil
+	}
+	return nil, 0, errAMF
+}
+
+// EncodeAMF0 - encode values: float64, int, bool, string, Object and nil
+func EncodeAMF0(values ...interface{}) []byte {
+	var b []byte
+	for _, v := range values {
+		b = encodeAMF0Value(b, v)
+	}
+	return b
+}
+
+func encodeAMF0String(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func encodeAMF0Value(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case float64:
+		b = append(b, amfNumber, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[len(b)-8:], math.Float64bits(v))
+	case int:
+		return encodeAMF0Value(b, float64(v))
+	case bool:
+		if v {
+			return append(b, amfBoolean, 1)
+		}
+		return append(b, amfBoolean, 0)
+	case string:
+		b = append(b, amfString)
+		b = encodeAMF0String(b, v)
+	case Object:
+		b = append(b, amfObject)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b = encodeAMF0String(b, k)
+			b = encodeAMF0Value(b, v[k])
+		}
+		b = append(b, 0, 0, amfObjectEnd)
+	default:
+		b = append(b, amfNull)
+	}
+	return b
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package rtmp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeAMF0(t *testing.T) {
+	number := []byte{amfNumber, 0x40, 0x45, 0, 0, 0, 0, 0, 0}
+	tests := []struct {
+		name   string
+		in     []byte
+		values []interface{}
+		err    bool
+	}{
+		{"empty", nil, nil, false},
+		{"number", number, []interface{}{42.0}, false},
+		{"truncated number", number[:5], nil, true},
+		{"boolean", []byte{amfBoolean, 1}, []interface{}{true}, false},
+		{"truncated boolean", []byte{amfBoolean}, nil, true},
+		{"string", []byte{amfString, 0, 2, 'o', 'k'}, []interface{}{"ok"}, false},
+		{"zero size string", []byte{amfString, 0, 0}, []interface{}{""}, false},
+		{"truncated string", []byte{amfString, 0, 5, 'o'}, nil, true},
+		{"truncated string size", []byte{amfString, 0}, nil, true},
+		{"long string", []byte{amfLongString, 0, 0, 0, 1, 'x'}, []interface{}{"x"}, false},
+		{"truncated long string", []byte{amfLongString, 0xFF, 0xFF, 0xFF, 0xFF, 'x'}, nil, true},
+		{"null and undefined", []byte{amfNull, amfUndefined}, []interface{}{nil, nil}, false},
+		{"object", []byte{amfObject, 0, 1, 'a', amfBoolean, 0, 0, 0, amfObjectEnd}, []interface{}{Object{"a": false}}, false},
+		{"empty object", []byte{amfObject, 0, 0, amfObjectEnd}, []interface{}{Object{}}, false},
+		{"object without end", []byte{amfObject, 0, 1, 'a', amfNull}, nil, true},
+		{"object without value", []byte{amfObject, 0, 1, 'a'}, nil, true},
+		{"ecma array", []byte{amfECMAArray, 0, 0, 0, 1, 0, 1, 'a', amfNull, 0, 0, amfObjectEnd}, []interface{}{Object{"a": nil}}, false},
+		{"truncated ecma array", []byte{amfECMAArray, 0, 0}, nil, true},
+		{"typed object", []byte{amfTypedObject, 0, 1, 'T', 0, 0, amfObjectEnd}, []interface{}{Object{}}, false},
+		{"truncated typed object", []byte{amfTypedObject, 0, 3, 'T'}, nil, true},
+		{"strict array", []byte{amfStrictArray, 0, 0, 0, 2, amfNull, amfBoolean, 1}, []interface{}{[]interface{}{nil, true}}, false},
+		{"zero size strict array", []byte{amfStrictArray, 0, 0, 0, 0}, []interface{}{[]interface{}(nil)}, false},
+		{"strict array of huge count", []byte{amfStrictArray, 0xFF, 0xFF, 0xFF, 0xFF, amfNull}, nil, true},
+		{"date", []byte{amfDate, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []interface{}{0.0}, false},
+		{"truncated date", []byte{amfDate, 0, 0, 0}, nil, true},
+		{"unknown type", []byte{0x11}, nil, true},
+		{"value after error", append(number, amfBoolean), []interface{}{42.0}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, err := DecodeAMF0(tt.in)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("values %#v, want %#v", values, tt.values)
+			}
+		})
+	}
+}
+
+// TestDecodeAMF0Depth - nested objects are limited, the decoder doesn't recurse for every byte of the message
+func TestDecodeAMF0Depth(t *testing.T) {
+	nested := func(depth int) []byte {
+		b := []byte{}
+		for i := 0; i < depth; i++ {
+			b = append(b, amfObject, 0, 1, 'a')
+		}
+		b = append(b, amfNull)
+		for i := 0; i < depth; i++ {
+			b = append(b, 0, 0, amfObjectEnd)
+		}
+		return b
+	}
+	if _, err := DecodeAMF0(nested(amfMaxDepth)); err != nil {
+		t.Errorf("depth %d: %v", amfMaxDepth, err)
+	}
+	if _, err := DecodeAMF0(nested(amfMaxDepth + 2)); err == nil {
+		t.Errorf("depth %d is decoded", amfMaxDepth+2)
+	}
+	if _, err := DecodeAMF0(bytes.Repeat([]byte{amfObject, 0, 1, 'a'}, 1<<20)); err == nil {
+		t.Error("unterminated nesting is decoded")
+	}
+}
+
+func TestEncodeAMF0(t *testing.T) {
+	values := []interface{}{"connect", 1.0, Object{"app": "live", "flag": true, "none": nil}, 2}
+	decoded, err := DecodeAMF0(EncodeAMF0(values...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"connect", 1.0, Object{"app": "live", "flag": true, "none": nil}, 2.0}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("decoded %#v, want %#v", decoded, want)
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+// Package rtmp implements the publishing side of RTMP server: handshake, chunk stream,
+// AMF0 commands and media messages
+package rtmp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Message types
+const (
+	TypeSetChunkSize     = 1
+	TypeAbort            = 2
+	TypeAck              = 3
+	TypeUserControl      = 4
+	TypeWindowAckSize    = 5
+	TypeSetPeerBandwidth = 6
+	TypeAudio            = 8
+	TypeVideo            = 9
+	TypeDataAMF3         = 15
+	TypeCommandAMF3      = 17
+	TypeDataAMF0         = 18
+	TypeCommandAMF0      = 20
+)
+
+const (
+	handshakeSize   = 1536
+	defaultChunk    = 128
+	serverChunk     = 4096
+	windowAckSize   = 2500000
+	maxMessageSize  = 4 << 20
+	publishStreamID = 1
+)
+
+// ErrUnpublished - publisher has stopped the stream
+var ErrUnpublished = errors.New("rtmp: stream is unpublished")
+
+// Message - complete RTMP message
+type Message struct {
+	Type      uint8
+	Timestamp uint32
+	StreamID  uint32
+	Data      []byte
+}
+
+type chunkStream struct {
+	timestamp uint32
+	delta     uint32
+	length    uint32
+	typ       uint8
+	streamID  uint32
+	extended  bool
+	payload   []byte
+}
+
+// Conn - server side connection of the publisher
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	chunkSize  uint32
+	streams    map[uint32]*chunkStream
+	ackWindow  uint32
+	received   uint32
+	acked      uint32
+	publishing bool
+
+	// App - application name from connect command
+	App string
+	// Name - published stream name without query
+	Name string
+	// Query - parameters of the published stream name (?key=...)
+	Query url.Values
+}
+
+// NewConn - wrap accepted connection
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		conn:      conn,
+		reader:    bufio.NewReaderSize(conn, 64*1024),
+		chunkSize: defaultChunk,
+		streams:   make(map[uint32]*chunkStream),
+	}
+}
+
+// Read - counts received bytes for acknowledgements
+func (c *Conn) read(p []byte) error {
+	n, err := io.ReadFull(c.reader, p)
+	c.received += uint32(n)
+	return err
+}
+
+// Handshake - simple (not digest) handshake, which is accepted by encoders
+func (c *Conn) Handshake() error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	if err := c.read(c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != 3 {
+		return errors.New("rtmp: unsupported version")
+	}
+
+	s0s1s2 := make([]byte, 1+handshakeSize*2)
+	s0s1s2[0] = 3
+	if _, err := rand.Read(s0s1s2[9 : 1+handshakeSize]); err != nil {
+		return err
+	}
+	copy(s0s1s2[1+handshakeSize:], c0c1[1:])
+	if _, err := c.conn.Write(s0s1s2); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, handshakeSize)
+	return c.read(c2)
+}
+
+// readChunk - read one chunk, returns complete message if it's the last chunk of the message
+func (c *Conn) readChunk() (*Message, error) {
+	header := make([]byte, 3)
+	if err := c.read(header[:1]); err != nil {
+		return nil, err
+	}
+	format := header[0] >> 6
+	csid := uint32(header[0] & 0x3F)
+	switch csid {
+	case 0:
+		if err := c.read(header[1:2]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(header[1])
+	case 1:
+		if err := c.read(header[1:3]); err != nil {
+			return nil, err
+		}
+		csid = 64 + uint32(header[1]) + uint32(header[2])*256
+	}
+
+	cs := c.streams[csid]
+	if cs == nil {
+		if format != 0 {
+			return nil, errors.New("rtmp: chunk stream starts without full header")
+		}
+		cs = &chunkStream{}
+		c.streams[csid] = cs
+	}
+
+	sizes := [4]int{11, 7, 3, 0}
+	mh := make([]byte, sizes[format])
+	if err := c.read(mh); err != nil {
+		return nil, err
+	}
+	var ts uint32
+	if format < 3 {
+		ts = uint32(mh[0])<<16 | uint32(mh[1])<<8 | uint32(mh[2])
+		cs.extended = ts == 0xFFFFFF
+	}
+	if format < 2 {
+		cs.length = uint32(mh[3])<<16 | uint32(mh[4])<<8 | uint32(mh[5])
+		cs.typ = mh[6]
+		if cs.length > maxMessageSize {
+			return nil, errors.New("rtmp: message is too big")
+		}
+	}
+	if format == 0 {
+		cs.streamID = binary.LittleEndian.Uint32(mh[7:])
+	}
+	if cs.extended {
+		ext := make([]byte, 4)
+		if err := c.read(ext); err != nil {
+			return nil, err
+		}
+		if format < 3 {
+			ts = binary.BigEndian.Uint32(ext)
+		}
+	}
+
+	// new message starts, if there is no unfinished one
+	if len(cs.payload) == 0 {
+		switch format {
+		case 0:
+			cs.timestamp = ts
+			cs.delta = 0
+		case 1, 2:
+			cs.delta = ts
+			cs.timestamp += ts
+		case 3:
+			cs.timestamp += cs.delta
+		}
+	}
+
+	size := cs.length - uint32(len(cs.payload))
+	if size > c.chunkSize {
+		size = c.chunkSize
+	}
+	start := len(cs.payload)
+	cs.payload = append(cs.payload, make([]byte, size)...)
+	if err := c.read(cs.payload[start:]); err != nil {
+		return nil, err
+	}
+	if err := c.sendAck(); err != nil {
+		return nil, err
+	}
+	if uint32(len(cs.payload)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &Message{Type: cs.typ, Timestamp: cs.timestamp, StreamID: cs.streamID, Data: cs.payload}
+	cs.payload = nil
+	return msg, nil
+}
+
+func (c *Conn) sendAck() error {
+	if c.ackWindow == 0 || c.received-c.acked < c.ackWindow {
+		return nil
+	}
+	c.acked = c.received
+	return c.writeMessage(2, &Message{Type: TypeAck, Data: u32(c.received)})
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// writeMessage - write message on the chunk stream using server chunk size
+func (c *Conn) writeMessage(csid byte, msg *Message) error {
+	header := make([]byte, 12)
+	header[0] = csid
+	header[4], header[5], header[6] = byte(len(msg.Data)>>16), byte(len(msg.Data)>>8), byte(len(msg.Data))
+	header[7] = msg.Type
+	binary.LittleEndian.PutUint32(header[8:], msg.StreamID)
+
+	b := header
+	for pos := 0; pos < len(msg.Data); pos += serverChunk {
+		end := pos + serverChunk
+		if end > len(msg.Data) {
+			end = len(msg.Data)
+		}
+		if pos > 0 {
+			b = append(b, 0xC0|csid)
+		}
+		b = append(b, msg.Data[pos:end]...)
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *Conn) writeCommand(streamID uint32, values ...interface{}) error {
+	return c.writeMessage(3, &Message{Type: TypeCommandAMF0, StreamID: streamID, Data: EncodeAMF0(values...)})
+}
+
+// handleControl - protocol control messages
+func (c *Conn) handleControl(msg *Message) error {
+	switch msg.Type {
+	case TypeSetChunkSize:
+		if len(msg.Data) < 4 {
+			return errors.New("rtmp: bad chunk size")
+		}
+		c.chunkSize = binary.BigEndian.Uint32(msg.Data) & 0x7FFFFFFF
+		if c.chunkSize == 0 {
+			return errors.New("rtmp: bad chunk size")
+		}
+	case TypeAbort:
+		if len(msg.Data) >= 4 {
+			if cs := c.streams[binary.BigEndian.Uint32(msg.Data)]; cs != nil {
+				cs.payload = nil
+			}
+		}
+	case TypeWindowAckSize:
+		if len(msg.Data) >= 4 {
+			c.ackWindow = binary.BigEndian.Uint32(msg.Data)
+		}
+	}
+	return nil
+}
+
+// ReadPublish - process commands until the client asks to publish the stream.
+// The caller has to answer with AcceptPublish or RejectPublish
+func (c *Conn) ReadPublish() error {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		if msg.Type < TypeAudio {
+			if err = c.handleControl(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Type != TypeCommandAMF0 && msg.Type != TypeCommandAMF3 {
+			continue
+		}
+		published, err := c.handleCommand(msg)
+		if err != nil || published {
+			return err
+		}
+	}
+}
+
+func commandValues(msg *Message) ([]interface{}, error) {
+	data := msg.Data
+	if msg.Type == TypeCommandAMF3 && len(data) > 0 {
+		data = data[1:]
+	}
+	values, err := DecodeAMF0(data)
+	if err != nil && len(values) < 2 {
+		return nil, err
+	}
+	if len(values) < 2 {
+		return nil, errors.New("rtmp: bad command")
+	}
+	return values, nil
+}
+
+func (c *Conn) handleCommand(msg *Message) (bool, error) {
+	values, err := commandValues(msg)
+	if err != nil {
+		return false, err
+	}
+	name, _ := values[0].(string)
+	txID, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		if len(values) > 2 {
+			if obj, ok := values[2].(Object); ok {
+				c.App, _ = obj["app"].(string)
+			}
+		}
+		if err = c.writeMessage(2, &Message{Type: TypeWindowAckSize, Data: u32(windowAckSize)}); err != nil {
+			return false, err
+		}
+		if err = c.writeMessage(2, &Message{Type: TypeSetPeerBandwidth, Data: append(u32(windowAckSize), 2)}); err != nil {
+			return false, err
+		}
+		if err = c.writeMessage(2, &Message{Type: TypeSetChunkSize, Data: u32(serverChunk)}); err != nil {
+			return false, err
+		}
+		return false, c.writeCommand(0, "_result", txID,
+			Object{"fmsVer": "FMS/3,0,1,123", "capabilities": 31.0},
+			Object{"level": "status", "code": "NetConnection.Connect.Success", "description": "Connection succeeded.", "objectEncoding": 0.0})
+	case "releaseStream", "FCPublish":
+		return false, c.writeCommand(0, "_result", txID, nil)
+	case "createStream":
+		return false, c.writeCommand(0, "_result", txID, nil, float64(publishStreamID))
+	case "publish":
+		if len(values) < 4 {
+			return false, errors.New("rtmp: publish without stream name")
+		}
+		name, _ := values[3].(string)
+		c.Name = name
+		c.Query = url.Values{}
+		if idx := strings.Index(name, "?"); idx >= 0 {
+			c.Name = name[:idx]
+			c.Query, _ = url.ParseQuery(name[idx+1:])
+		}
+		return true, nil
+	case "FCUnpublish", "deleteStream", "closeStream":
+		return false, ErrUnpublished
+	}
+	return false, nil
+}
+
+func (c *Conn) onStatus(level, code, description string) error {
+	return c.writeCommand(publishStreamID, "onStatus", 0.0, nil,
+		Object{"level": level, "code": code, "description": description})
+}
+
+// AcceptPublish - confirm the publishing
+func (c *Conn) AcceptPublish() error {
+	// user control message: stream begin
+	begin := append([]byte{0, 0}, u32(publishStreamID)...)
+	if err := c.writeMessage(2, &Message{Type: TypeUserControl, Data: begin}); err != nil {
+		return err
+	}
+	c.publishing = true
+	return c.onStatus("status", "NetStream.Publish.Start", c.Name+" is now published")
+}
+
+// RejectPublish - refuse the publishing
+func (c *Conn) RejectPublish(description string) error {
+	return c.onStatus("error", "NetStream.Publish.BadName", description)
+}
+
+// ReadMessage - returns next audio, video or data message of the published stream.
+// ErrUnpublished is returned, when the client stops publishing
+func (c *Conn) ReadMessage() (*Message, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.Type {
+		case TypeAudio, TypeVideo, TypeDataAMF0:
+			return msg, nil
+		case TypeDataAMF3:
+			if len(msg.Data) > 0 {
+				msg.Data = msg.Data[1:]
+			}
+			msg.Type = TypeDataAMF0
+			return msg, nil
+		case TypeCommandAMF0, TypeCommandAMF3:
+			if _, err = c.handleCommand(msg); err != nil {
+				return nil, err
+			}
+		default:
+			if err = c.handleControl(msg); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 Setin Sergei
+// Licensed under the Apache License, Version 2.0 (the "License")
+
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// readMessages - messages of the chunk stream until the error, the input is written by the peer
+func readMessages(in []byte, setup func(c *Conn)) ([]*Message, error) {
+	server, client := net.Pipe()
+	go func() {
+		_, _ = client.Write(in)
+		client.Close()
+	}()
+	defer server.Close()
+
+	c := NewConn(server)
+	if setup != nil {
+		setup(c)
+	}
+	var messages []*Message
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return messages, err
+		}
+		if msg != nil {
+			messages = append(messages, msg)
+		}
+	}
+}
+
+// chunk0 - chunk with the full header on the chunk stream 3
+func chunk0(typ byte, timestamp uint32, length int, streamID byte, payload []byte) []byte {
+	b := []byte{0x03, byte(timestamp >> 16), byte(timestamp >> 8), byte(timestamp),
+		byte(length >> 16), byte(length >> 8), byte(length), typ, streamID, 0, 0, 0}
+	return append(b, payload...)
+}
+
+func TestReadChunk(t *testing.T) {
+	long := bytes.Repeat([]byte{0xAA}, defaultChunk+10)
+	tests := []struct {
+		name       string
+		in         []byte
+		setup      func(c *Conn)
+		messages   int
+		lastType   uint8
+		lastTime   uint32
+		lastLength int
+		err        error
+	}{
+		{"empty", nil, nil, 0, 0, 0, 0, io.EOF},
+		{"one chunk", chunk0(TypeAudio, 10, 3, 1, []byte{1, 2, 3}), nil, 1, TypeAudio, 10, 3, io.EOF},
+		{"zero size message", chunk0(TypeAudio, 10, 0, 1, nil), nil, 1, TypeAudio, 10, 0, io.EOF},
+		{"continuation chunk", append(chunk0(TypeAudio, 0, len(long), 1, long[:defaultChunk]), append([]byte{0xC3}, long[defaultChunk:]...)...),
+			nil, 1, TypeAudio, 0, len(long), io.EOF},
+		{"missing continuation", chunk0(TypeAudio, 0, len(long), 1, long[:defaultChunk]), nil, 0, 0, 0, 0, io.EOF},
+		{"delta chunks", append(append(chunk0(TypeAudio, 100, 1, 1, []byte{1}), 0x43, 0, 0, 20, 0, 0, 1, TypeAudio, 2), 0xC3, 3),
+			nil, 3, TypeAudio, 140, 1, io.EOF},
+		{"type 2 chunk", append(chunk0(TypeAudio, 100, 1, 1, []byte{1}), 0x83, 0, 0, 5, 2), nil, 2, TypeAudio, 105, 1, io.EOF},
+		{"extended timestamp", []byte{0x03, 0xFF, 0xFF, 0xFF, 0, 0, 1, TypeAudio, 1, 0, 0, 0, 0x01, 0x00, 0x00, 0x00, 7},
+			nil, 1, TypeAudio, 0x01000000, 1, io.EOF},
+		{"truncated extended timestamp", []byte{0x03, 0xFF, 0xFF, 0xFF, 0, 0, 1, TypeAudio, 1, 0, 0, 0, 0x01},
+			nil, 0, 0, 0, 0, io.ErrUnexpectedEOF},
+		{"two byte chunk stream id", []byte{0x00, 0x05, 0, 0, 0, 0, 0, 1, TypeAudio, 1, 0, 0, 0, 9}, nil, 1, TypeAudio, 0, 1, io.EOF},
+		{"truncated chunk stream id", []byte{0x01, 0x05}, nil, 0, 0, 0, 0, io.ErrUnexpectedEOF},
+		{"truncated header", []byte{0x03, 0, 0, 0, 0, 0}, nil, 0, 0, 0, 0, io.ErrUnexpectedEOF},
+		{"truncated payload", chunk0(TypeAudio, 0, 3, 1, []byte{1}), nil, 0, 0, 0, 0, io.ErrUnexpectedEOF},
+		{"chunk size", chunk0(TypeAudio, 0, len(long), 1, long),
+			func(c *Conn) { c.chunkSize = 4096 }, 1, TypeAudio, 0, len(long), io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := readMessages(tt.in, tt.setup)
+			if err != tt.err {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+			if len(messages) != tt.messages {
+				t.Fatalf("%d messages, want %d", len(messages), tt.messages)
+			}
+			if len(messages) == 0 {
+				return
+			}
+			last := messages[len(messages)-1]
+			if last.Type != tt.lastType || last.Timestamp != tt.lastTime || len(last.Data) != tt.lastLength {
+				t.Errorf("last message type %d, time %d, length %d, want %d, %d, %d",
+					last.Type, last.Timestamp, len(last.Data), tt.lastType, tt.lastTime, tt.lastLength)
+			}
+		})
+	}
+}
+
+func TestReadChunkErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"stream without full header", []byte{0x43, 0, 0, 0, 0, 0, 1, TypeAudio, 1}},
+		{"continuation of unknown stream", []byte{0xC3, 1}},
+		{"message is too big", chunk0(TypeAudio, 0, maxMessageSize+1, 1, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := readMessages(tt.in, nil)
+			if err == nil || err == io.EOF || err == io.ErrUnexpectedEOF || len(messages) > 0 {
+				t.Errorf("%d messages, error %v, want protocol error", len(messages), err)
+			}
+		})
+	}
+}
+
+func TestHandleControl(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   *Message
+		chunk uint32
+		err   bool
+	}{
+		{"chunk size", &Message{Type: TypeSetChunkSize, Data: u32(4096)}, 4096, false},
+		{"zero chunk size", &Message{Type: TypeSetChunkSize, Data: u32(0)}, 0, true},
+		{"truncated chunk size", &Message{Type: TypeSetChunkSize, Data: []byte{0, 0}}, defaultChunk, true},
+		{"empty chunk size", &Message{Type: TypeSetChunkSize}, defaultChunk, true},
+		{"truncated abort", &Message{Type: TypeAbort, Data: []byte{0}}, defaultChunk, false},
+		{"empty window", &Message{Type: TypeWindowAckSize}, defaultChunk, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConn(nil)
+			err := c.handleControl(tt.msg)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want error %v", err, tt.err)
+			}
+			if !tt.err && c.chunkSize != tt.chunk {
+				t.Errorf("chunk size %d, want %d", c.chunkSize, tt.chunk)
+			}
+		})
+	}
+}
+
+func TestCommandValues(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *Message
+		err  bool
+	}{
+		{"command", &Message{Type: TypeCommandAMF0, Data: EncodeAMF0("connect", 1.0)}, false},
+		{"AMF3 command", &Message{Type: TypeCommandAMF3, Data: append([]byte{0}, EncodeAMF0("connect", 1.0)...)}, false},
+		{"empty", &Message{Type: TypeCommandAMF0}, true},
+		{"empty AMF3", &Message{Type: TypeCommandAMF3}, true},
+		{"name only", &Message{Type: TypeCommandAMF0, Data: EncodeAMF0("connect")}, true},
+		{"truncated", &Message{Type: TypeCommandAMF0, Data: EncodeAMF0("connect", 1.0)[:12]}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := commandValues(tt.msg); (err != nil) != tt.err {
+				t.Errorf("error %v, want error %v", err, tt.err)
+			}
+		})
+	}
+}